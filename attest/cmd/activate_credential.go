@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/chkimes/image-attestation/internal"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/spf13/cobra"
+)
+
+var activateCredentialCmd = &cobra.Command{
+	Use:   "activate-credential",
+	Short: "Obtains an AK certificate from a privacy CA by proving the AK is resident on the same TPM as the EK",
+}
+
+var akRequestCmd = &cobra.Command{
+	Use:   "request",
+	Short: "Outputs a JSON-formatted AK certificate request with the EK certificate and the EK and AK public areas",
+	RunE:  genAKCertRequest,
+}
+
+var akActivateCmd = &cobra.Command{
+	Use:   "activate",
+	Args:  cobra.ExactArgs(1),
+	Short: "Activates a credential challenge with the TPM and outputs the decrypted AK certificate",
+	RunE:  activateAKCredential,
+}
+
+var (
+	ekLocation     uint32
+	ekCertLocation uint32
+	akRequestPath  string
+	akCertOutPath  string
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{akRequestCmd, akActivateCmd} {
+		cmd.Flags().StringVarP(
+			&tpmPath,
+			"tpm-path",
+			"t",
+			"/dev/tpmrm0",
+			"Device path for TPM",
+		)
+
+		cmd.Flags().Uint32VarP(
+			&akLocation,
+			"ak-location",
+			"a",
+			0x81000003,
+			"Location of AK public key",
+		)
+
+		cmd.Flags().Uint32VarP(
+			&ekLocation,
+			"ek-location",
+			"e",
+			0x81010001,
+			"Location of EK public key",
+		)
+	}
+
+	akRequestCmd.Flags().Uint32Var(
+		&ekCertLocation,
+		"ek-cert-location",
+		0x1c00002,
+		"Location of EK cert. Set to 0 to omit the EK cert",
+	)
+
+	akRequestCmd.Flags().StringVarP(
+		&akRequestPath,
+		"out-file",
+		"o",
+		"ak-request.json",
+		"Filename to write out the JSON-encoded AK certificate request",
+	)
+
+	akActivateCmd.Flags().StringVarP(
+		&akCertOutPath,
+		"out-file",
+		"o",
+		"ak.pem",
+		"Filename to write out the PEM-encoded AK certificate",
+	)
+
+	activateCredentialCmd.AddCommand(akRequestCmd)
+	activateCredentialCmd.AddCommand(akActivateCmd)
+}
+
+func genAKCertRequest(_ *cobra.Command, args []string) error {
+	rwc, err := tpm2.OpenTPM(tpmPath)
+	if err != nil {
+		return fmt.Errorf("can't open TPM %s: %w", tpmPath, err)
+	}
+	defer rwc.Close()
+
+	akPublic, err := readPublicArea(rwc, akLocation)
+	if err != nil {
+		return fmt.Errorf("can't read AK public area at %x: %w", akLocation, err)
+	}
+
+	ekPublic, err := readPublicArea(rwc, ekLocation)
+	if err != nil {
+		return fmt.Errorf("can't read EK public area at %x: %w", ekLocation, err)
+	}
+
+	request := internal.AKCertRequest{
+		EkPublic: ekPublic,
+		AkPublic: akPublic,
+	}
+
+	if ekCertLocation != 0 {
+		request.EkCert, err = readNVCert(rwc, ekCertLocation)
+		if err != nil {
+			return fmt.Errorf("can't read EK cert at %x: %w", ekCertLocation, err)
+		}
+	}
+
+	return writeJSON(akRequestPath, request)
+}
+
+func activateAKCredential(_ *cobra.Command, args []string) error {
+	var challenge internal.AKCertChallenge
+	err := readJSON(args[0], &challenge)
+	if err != nil {
+		return fmt.Errorf("couldn't read credential challenge: %w", err)
+	}
+
+	rwc, err := tpm2.OpenTPM(tpmPath)
+	if err != nil {
+		return fmt.Errorf("can't open TPM %s: %w", tpmPath, err)
+	}
+	defer rwc.Close()
+
+	secret, err := activateCredential(rwc, tpmutil.Handle(akLocation), tpmutil.Handle(ekLocation), challenge.Credential, challenge.EncryptedSecret)
+	if err != nil {
+		return fmt.Errorf("couldn't activate credential: %w", err)
+	}
+
+	akCert, err := challenge.DecryptAKCert(secret)
+	if err != nil {
+		return err
+	}
+
+	if debugLogging {
+		log.Printf("AK cert: %x", akCert)
+	}
+
+	return os.WriteFile(akCertOutPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: akCert}), 0644)
+}
+
+// activateCredential runs TPM2_ActivateCredential. The EK's auth policy
+// requires PolicySecret on the endorsement hierarchy.
+func activateCredential(rw io.ReadWriter, akHandle tpmutil.Handle, ekHandle tpmutil.Handle, credential []byte, encryptedSecret []byte) ([]byte, error) {
+	// The challenge holds TPM2B structures, strip the size prefixes
+	if len(credential) < 2 || len(encryptedSecret) < 2 {
+		return nil, fmt.Errorf("malformed credential challenge")
+	}
+
+	session, err := ekPolicySession(rw)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(rw, session)
+
+	return tpm2.ActivateCredentialUsingAuth(rw, []tpm2.AuthCommand{
+		{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession},
+		{Session: session, Attributes: tpm2.AttrContinueSession},
+	}, akHandle, ekHandle, credential[2:], encryptedSecret[2:])
+}
+
+// ekPolicySession starts a policy session satisfying the EK's auth policy,
+// PolicySecret on the endorsement hierarchy. The caller flushes it.
+func ekPolicySession(rw io.ReadWriter) (tpmutil.Handle, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, nonce, nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't start policy session: %w", err)
+	}
+
+	_, _, err = tpm2.PolicySecret(rw, tpm2.HandleEndorsement, tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}, session, nil, nil, nil, 0)
+	if err != nil {
+		tpm2.FlushContext(rw, session)
+		return 0, fmt.Errorf("couldn't satisfy EK policy: %w", err)
+	}
+
+	return session, nil
+}
+
+func readPublicArea(rw io.ReadWriter, handle uint32) ([]byte, error) {
+	pub, _, _, err := tpm2.ReadPublic(rw, tpmutil.Handle(handle))
+	if err != nil {
+		return nil, err
+	}
+	return pub.Encode()
+}
+
+func readNVCert(rw io.ReadWriter, index uint32) ([]byte, error) {
+	certBytes, err := tpm2.NVRead(rw, tpmutil.Handle(index))
+	if err != nil {
+		return nil, err
+	}
+
+	// NV indices are often larger than the certificate, drop the padding
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse cert: %w", err)
+	}
+	return cert.Raw, nil
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("couldn't serialize %s: %w", path, err)
+	}
+
+	err = os.WriteFile(path, data, 0666)
+	if err != nil {
+		return fmt.Errorf("writing file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chkimes/image-attestation/internal"
+	"github.com/spf13/cobra"
+)
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Runs a local privacy CA issuing AK certificates through credential activation",
+}
+
+var caInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Creates the privacy CA key and self-signed certificate",
+	RunE:  initCA,
+}
+
+var caIssueCmd = &cobra.Command{
+	Use:   "issue",
+	Args:  cobra.ExactArgs(1),
+	Short: "Validates an AK certificate request, issues the AK certificate and outputs it as a JSON-formatted credential challenge",
+	RunE:  issueAKCert,
+}
+
+var caListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the AK certificates issued by the privacy CA",
+	RunE:  listAKCerts,
+}
+
+var (
+	caDir                 string
+	caCommonName          string
+	caValidity            time.Duration
+	akCertTemplatePath    string
+	ekRootCAPemPaths      []string
+	ekIntermediateCAPaths []string
+	insecureSkipEKVerify  bool
+	akChallengePath       string
+)
+
+func init() {
+	caCmd.PersistentFlags().StringVar(
+		&caDir,
+		"ca-dir",
+		"privacy-ca",
+		"Directory holding the privacy CA key, certificate and issued AK certificates",
+	)
+
+	caInitCmd.Flags().StringVar(
+		&caCommonName,
+		"common-name",
+		"Image Attestation Privacy CA",
+		"Common name of the privacy CA certificate",
+	)
+
+	caInitCmd.Flags().DurationVar(
+		&caValidity,
+		"validity",
+		10*365*24*time.Hour,
+		"Validity period of the privacy CA certificate",
+	)
+
+	caIssueCmd.Flags().StringVar(
+		&akCertTemplatePath,
+		"template",
+		"",
+		"File path for a YAML AK certificate template",
+	)
+
+	caIssueCmd.Flags().StringSliceVar(
+		&ekRootCAPemPaths,
+		"ek-root-ca-path",
+		nil,
+		"File or directory paths for the trusted TPM manufacturer root CA certificates (PEM, may be bundles)",
+	)
+
+	caIssueCmd.Flags().StringSliceVar(
+		&ekIntermediateCAPaths,
+		"ek-intermediate-ca-path",
+		nil,
+		"File or directory paths for the TPM manufacturer intermediate CA certificates (PEM, may be bundles)",
+	)
+
+	caIssueCmd.Flags().BoolVar(
+		&insecureSkipEKVerify,
+		"insecure-skip-ek-verify",
+		false,
+		"Flag to issue AK certificates without validating the EK certificate",
+	)
+
+	caIssueCmd.Flags().StringVarP(
+		&akChallengePath,
+		"out-file",
+		"o",
+		"ak-challenge.json",
+		"Filename to write out the JSON-encoded credential challenge",
+	)
+
+	caCmd.AddCommand(caInitCmd)
+	caCmd.AddCommand(caIssueCmd)
+	caCmd.AddCommand(caListCmd)
+}
+
+func initCA(_ *cobra.Command, args []string) error {
+	ca, err := internal.InitPrivacyCA(caDir, caCommonName, caValidity)
+	if err != nil {
+		return fmt.Errorf("couldn't initialize privacy CA: %w", err)
+	}
+
+	fmt.Printf("Initialized privacy CA %s in %s\n", ca.Cert.Subject, caDir)
+	return nil
+}
+
+func issueAKCert(_ *cobra.Command, args []string) error {
+	var request internal.AKCertRequest
+	err := readJSON(args[0], &request)
+	if err != nil {
+		return fmt.Errorf("couldn't read AK certificate request: %w", err)
+	}
+
+	ca, err := internal.OpenPrivacyCA(caDir)
+	if err != nil {
+		return fmt.Errorf("couldn't open privacy CA: %w", err)
+	}
+
+	template := &internal.AKCertTemplate{}
+	if akCertTemplatePath != "" {
+		template, err = internal.LoadAKCertTemplate(akCertTemplatePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ekTrust *internal.TrustStore
+	if !insecureSkipEKVerify {
+		ekTrust, err = internal.LoadTrustStore(ekRootCAPemPaths, ekIntermediateCAPaths)
+		if err != nil {
+			return fmt.Errorf("couldn't load EK trust store: %w", err)
+		}
+	}
+
+	challenge, akCert, err := ca.Issue(&request, template, ekTrust, time.Now())
+	if err != nil {
+		return fmt.Errorf("couldn't issue AK certificate: %w", err)
+	}
+
+	log.Printf("Issued AK certificate %s (serial %s)", akCert.Subject, akCert.SerialNumber.Text(16))
+
+	return writeJSON(akChallengePath, challenge)
+}
+
+func listAKCerts(_ *cobra.Command, args []string) error {
+	ca, err := internal.OpenPrivacyCA(caDir)
+	if err != nil {
+		return fmt.Errorf("couldn't open privacy CA: %w", err)
+	}
+
+	certs, err := ca.Issued()
+	if err != nil {
+		return err
+	}
+
+	for _, cert := range certs {
+		fmt.Printf("%s\t%s\t%s\t%s\n", cert.SerialNumber.Text(16), cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339), cert.Subject)
+	}
+
+	return nil
+}
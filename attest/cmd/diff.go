@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/chkimes/image-attestation/internal"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <golden attestation> <attestation>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Compares the PCRs and the boot and verity event logs of two attestations, e.g. a golden and a failing one",
+	Long: `Compares the PCRs and the boot and verity event logs of two attestations, e.g. a golden and a failing one.
+Like diff(1), it exits with a non-zero status when the attestations differ.`,
+	RunE: diffAttestations,
+}
+
+// errAttestationsDiffer makes diff exit with a non-zero status after printing
+// the differences
+var errAttestationsDiffer = errors.New("attestations differ")
+
+// verityPCR is the PCR the initramfs extends with the verity events
+const verityPCR = 11
+
+func diffAttestations(cmd *cobra.Command, args []string) error {
+	var attestations [2]*internal.Attestation
+	var events [2][]internal.DiffEvent
+	for i, path := range args {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("couldn't read attestation %s: %w", path, err)
+		}
+
+		attestations[i], err = internal.ParseAttestation(data, false)
+		if err != nil {
+			return fmt.Errorf("couldn't parse attestation %s: %w", path, err)
+		}
+
+		events[i], err = attestationDiffEvents(attestations[i])
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	differentPCRs := diffPCRValues(attestations[0].PCRs, attestations[1].PCRs)
+	changes := internal.DiffEventLogs(events[0], events[1])
+
+	if len(differentPCRs) == 0 && len(changes) == 0 {
+		fmt.Println("No differences")
+		return nil
+	}
+
+	if len(differentPCRs) > 0 {
+		fmt.Println("PCR values differ:")
+		for _, line := range differentPCRs {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+
+	var pcrs []int
+	for pcr := range changes {
+		pcrs = append(pcrs, pcr)
+	}
+	sort.Ints(pcrs)
+
+	for _, pcr := range pcrs {
+		fmt.Printf("\nPCR %d:\n", pcr)
+		for _, change := range changes[pcr] {
+			printEventChange(change)
+		}
+	}
+
+	// The differences were printed, the usage would only bury them
+	cmd.SilenceUsage = true
+	return errAttestationsDiffer
+}
+
+// attestationDiffEvents returns the boot and verity events of an attestation
+func attestationDiffEvents(attestation *internal.Attestation) ([]internal.DiffEvent, error) {
+	var events []internal.DiffEvent
+	if len(attestation.BootEventLog) > 0 {
+		bootEventLog, err := internal.ParseEventLog(attestation.BootEventLog)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse boot event log: %w", err)
+		}
+		events = internal.DiffEvents(bootEventLog)
+	}
+
+	for i, event := range internal.VerityEvents(attestation.VerityEventLog) {
+		digest := sha256.Sum256([]byte(event))
+		events = append(events, internal.DiffEvent{
+			Sequence:    i + 1,
+			PCR:         verityPCR,
+			Type:        "VERITY",
+			Digest:      digest[:],
+			Description: event,
+		})
+	}
+
+	return events, nil
+}
+
+func diffPCRValues(old []internal.PCRValue, new []internal.PCRValue) []string {
+	values := make(map[int][2][]byte)
+	for _, pcr := range old {
+		value := values[pcr.Index]
+		value[0] = pcr.Value
+		values[pcr.Index] = value
+	}
+	for _, pcr := range new {
+		value := values[pcr.Index]
+		value[1] = pcr.Value
+		values[pcr.Index] = value
+	}
+
+	var indexes []int
+	for index, value := range values {
+		if !bytes.Equal(value[0], value[1]) {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	var lines []string
+	for _, index := range indexes {
+		lines = append(lines, fmt.Sprintf("%2d: %s -> %s", index, pcrHex(values[index][0]), pcrHex(values[index][1])))
+	}
+	return lines
+}
+
+func pcrHex(value []byte) string {
+	if value == nil {
+		return "(not quoted)"
+	}
+	return fmt.Sprintf("%x", value)
+}
+
+func printEventChange(change internal.EventChange) {
+	switch change.Kind {
+	case internal.EventRemoved:
+		fmt.Printf("  - #%d %s %s\n", change.Old.Sequence, change.Old.Type, oneLine(change.Old.Description))
+	case internal.EventAdded:
+		fmt.Printf("  + #%d %s %s\n", change.New.Sequence, change.New.Type, oneLine(change.New.Description))
+	case internal.EventChanged:
+		fmt.Printf("  ~ #%d -> #%d %s\n", change.Old.Sequence, change.New.Sequence, change.Old.Type)
+		if change.Old.Description != change.New.Description {
+			fmt.Printf("      - %s\n", oneLine(change.Old.Description))
+			fmt.Printf("      + %s\n", oneLine(change.New.Description))
+		} else {
+			fmt.Printf("      %s\n", oneLine(change.Old.Description))
+			fmt.Printf("      - %x\n", change.Old.Digest)
+			fmt.Printf("      + %x\n", change.New.Digest)
+		}
+	}
+}
+
+// oneLine escapes the newlines of multi-line event data, e.g. GRUB menu
+// entries
+func oneLine(s string) string {
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
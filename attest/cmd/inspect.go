@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chkimes/image-attestation/internal"
+	"github.com/spf13/cobra"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [-a <attestation>]",
+	Args:  cobra.MaximumNArgs(1),
+	Short: "Prints the decoded certificates, quote, PCRs and event logs of an attestation without verifying it",
+	RunE:  inspectAttestation,
+}
+
+var (
+	inspectAttestationPath string
+	inspectJSON            bool
+)
+
+func init() {
+	inspectCmd.Flags().StringVarP(
+		&inspectAttestationPath,
+		"attestation-path",
+		"a",
+		"attestation.json",
+		"File path for the attestation document",
+	)
+
+	inspectCmd.Flags().BoolVar(
+		&inspectJSON,
+		"json",
+		false,
+		"Print the decoded attestation as JSON",
+	)
+}
+
+func inspectAttestation(cmd *cobra.Command, args []string) error {
+	// The attestation used to be a positional argument, which is still
+	// accepted
+	if len(args) > 0 {
+		if cmd.Flags().Changed("attestation-path") {
+			return fmt.Errorf("the attestation is given both as an argument and with --attestation-path")
+		}
+		inspectAttestationPath = args[0]
+	}
+
+	data, err := os.ReadFile(inspectAttestationPath)
+	if err != nil {
+		return fmt.Errorf("couldn't read attestation: %w", err)
+	}
+
+	attestation, err := internal.ParseAttestation(data, false)
+	if err != nil {
+		return fmt.Errorf("couldn't parse attestation: %w", err)
+	}
+
+	summary, err := internal.InspectAttestation(attestation)
+	if err != nil {
+		return err
+	}
+
+	if inspectJSON {
+		output, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return fmt.Errorf("couldn't serialize attestation summary: %w", err)
+		}
+		fmt.Println(string(output))
+		return nil
+	}
+
+	printSummary(summary)
+	return nil
+}
+
+func printSummary(summary *internal.AttestationSummary) {
+	fmt.Printf("Attestation %s %s\n", summary.APIVersion, summary.Kind)
+	if summary.TPM != nil {
+		fmt.Printf("  TPM:       %s %s (firmware %s)\n", summary.TPM.Manufacturer, summary.TPM.VendorString, summary.TPM.FirmwareVersion)
+	}
+	if summary.Platform != nil {
+		fmt.Printf("  Platform:  %s %s\n", summary.Platform.Vendor, summary.Platform.Product)
+	}
+	fmt.Printf("  Evidence:  %s\n", strings.Join(summary.Evidence, ", "))
+
+	printCertificate("AK certificate", summary.AKCert)
+	printCertificate("EK certificate", summary.EKCert)
+	if summary.AKName != "" {
+		fmt.Printf("\nAK name: %s\n", summary.AKName)
+	}
+
+	if quote := summary.Quote; quote != nil {
+		fmt.Println("\nQuote:")
+		fmt.Printf("  Qualified signer: %s\n", quote.QualifiedSigner)
+		fmt.Printf("  Nonce:            %s\n", quote.Nonce)
+		fmt.Printf("  Clock:            %d ms (reset %d, restart %d, safe %t)\n", quote.Clock, quote.ResetCount, quote.RestartCount, quote.Safe)
+		fmt.Printf("  Firmware version: %s\n", quote.FirmwareVersion)
+		fmt.Printf("  PCR selection:    %s %v\n", quote.PCRBank, quote.PCRs)
+		fmt.Printf("  PCR digest:       %s\n", quote.PCRDigest)
+		fmt.Printf("  Signature:        %s\n", summary.Signature)
+	}
+
+	fmt.Println("\nPCRs:")
+	for _, pcr := range summary.PCRs {
+		fmt.Printf("  %2d: %s\n", pcr.Index, pcr.Value)
+	}
+
+	if len(summary.BootEvents) > 0 {
+		fmt.Println("\nBoot events:")
+		for _, event := range summary.BootEvents {
+			fmt.Printf("  #%-3d PCR %-2d %s\n", event.Sequence, event.PCR, event.Type)
+			fmt.Printf("        %s\n", event.Digest)
+			if event.Description != "" {
+				fmt.Printf("        %s\n", oneLine(event.Description))
+			}
+		}
+	}
+
+	if len(summary.VerityEvents) > 0 {
+		fmt.Println("\nVerity events:")
+		for _, event := range summary.VerityEvents {
+			fmt.Printf("  %s\n", event)
+		}
+	}
+
+	if len(summary.IMAEvents) > 0 {
+		fmt.Println("\nIMA events:")
+		for _, event := range summary.IMAEvents {
+			fmt.Printf("  #%-3d %s %s %s\n", event.Sequence, event.Type, event.Digest, event.Description)
+		}
+	}
+
+	if len(summary.ContainerEvents) > 0 {
+		fmt.Println("\nContainer events:")
+		for i, event := range summary.ContainerEvents {
+			fmt.Printf("  #%-3d %s %s\n", i+1, event.ImageDigest, event.ImageName)
+			if len(event.Args) > 0 {
+				fmt.Printf("        args %q\n", event.Args)
+			}
+			for _, mount := range event.Mounts {
+				fmt.Printf("        mount %s -> %s %s\n", mount.Source, mount.Destination, strings.Join(mount.Options, ","))
+			}
+		}
+	}
+}
+
+func printCertificate(name string, cert *internal.CertificateSummary) {
+	if cert == nil {
+		return
+	}
+
+	fmt.Printf("\n%s:\n", name)
+	fmt.Printf("  Subject:    %s\n", cert.Subject)
+	fmt.Printf("  Issuer:     %s\n", cert.Issuer)
+	fmt.Printf("  Serial:     %s\n", cert.SerialNumber)
+	fmt.Printf("  Not before: %s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Printf("  Not after:  %s\n", cert.NotAfter.Format(time.RFC3339))
+	fmt.Printf("  Key:        %s\n", cert.PublicKey)
+}
@@ -1,14 +1,21 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/chkimes/image-attestation/internal"
 	"github.com/google/go-tpm/legacy/tpm2"
@@ -25,10 +32,27 @@ var quoteCmd = &cobra.Command{
 var (
 	tpmPath                    string
 	akLocation                 uint32
+	akTemplateLocation         uint32
+	createAK                   bool
+	akParent                   string
+	persistAK                  bool
 	certLocation               uint32
+	akCertPath                 string
+	includeEK                  bool
+	includeHCLReport           bool
+	hclReportLocation          uint32
 	bootMeasurementsLocation   string
 	verityMeasurementsLocation string
+	includeIMA                 bool
+	imaMeasurementsLocation    string
+	includeContainers          bool
+	containerLogLocation       string
+	measureContainer           string
+	measureContainerName       string
+	measureContainerConfig     string
+	measureContainerMounts     []string
 	outputPath                 string
+	outputFormat               string
 )
 
 func init() {
@@ -45,7 +69,42 @@ func init() {
 		"ak-location",
 		"a",
 		0x81000003,
-		"Location of AK public key",
+		"Location of AK public key. Default: from --platform",
+	)
+
+	quoteCmd.Flags().Uint32Var(
+		&akTemplateLocation,
+		"ak-template-location",
+		0,
+		"Location of an AK template to create the AK from under the endorsement hierarchy, used when --ak-location is 0. Default: from --platform",
+	)
+
+	quoteCmd.Flags().BoolVar(
+		&createAK,
+		"create-ak",
+		false,
+		"Flag to create a new AK from the TCG AK template instead of using the one at --ak-location",
+	)
+
+	quoteCmd.Flags().StringVar(
+		&akParent,
+		"ak-parent",
+		"ek",
+		"Parent of the AK created with --create-ak: ek (at --ek-location) or srk (transient, from the TCG SRK template)",
+	)
+
+	quoteCmd.Flags().BoolVar(
+		&persistAK,
+		"persist-ak",
+		false,
+		"Flag to persist the AK created with --create-ak at --ak-location rather than flushing it after the quote",
+	)
+
+	quoteCmd.Flags().Uint32Var(
+		&ekLocation,
+		"ek-location",
+		0x81010001,
+		"Location of EK public key, the parent of the AK created with --create-ak. Default: from --platform",
 	)
 
 	quoteCmd.Flags().Uint32VarP(
@@ -53,7 +112,42 @@ func init() {
 		"cert-location",
 		"c",
 		0x1c101d0,
-		"Location of AK cert",
+		"Location of AK cert. Default: from --platform",
+	)
+
+	quoteCmd.Flags().StringVar(
+		&akCertPath,
+		"ak-cert-path",
+		"",
+		"File path for a PEM or DER AK cert, e.g. issued by activate-credential, used instead of --cert-location",
+	)
+
+	quoteCmd.Flags().BoolVar(
+		&includeEK,
+		"include-ek",
+		false,
+		"Flag to include the EK cert in the attestation",
+	)
+
+	quoteCmd.Flags().Uint32Var(
+		&ekCertLocation,
+		"ek-cert-location",
+		0x1c00002,
+		"Location of EK cert. Default: from --platform",
+	)
+
+	quoteCmd.Flags().BoolVar(
+		&includeHCLReport,
+		"include-hcl-report",
+		false,
+		"Flag to include the HCL report of Azure confidential VMs, whose SEV-SNP or TDX report binds the vTPM AK",
+	)
+
+	quoteCmd.Flags().Uint32Var(
+		&hclReportLocation,
+		"hcl-report-location",
+		internal.HCLReportNVIndex,
+		"Location of the HCL report",
 	)
 
 	quoteCmd.Flags().StringVarP(
@@ -72,6 +166,62 @@ func init() {
 		"File path for verity measurements",
 	)
 
+	quoteCmd.Flags().BoolVar(
+		&includeIMA,
+		"include-ima",
+		false,
+		"Flag to quote PCR 10 and include the IMA runtime measurement log",
+	)
+
+	quoteCmd.Flags().StringVar(
+		&imaMeasurementsLocation,
+		"ima-measurements",
+		internal.IMABinaryMeasurementsPath,
+		"File path for the IMA runtime measurements, in the binary format",
+	)
+
+	quoteCmd.Flags().BoolVar(
+		&includeContainers,
+		"include-containers",
+		false,
+		"Flag to quote PCR 13 and include the container event log",
+	)
+
+	quoteCmd.Flags().StringVar(
+		&containerLogLocation,
+		"container-measurements",
+		internal.ContainerMeasurementsPath,
+		"File path for the container event log",
+	)
+
+	quoteCmd.Flags().StringVar(
+		&measureContainer,
+		"measure-container",
+		"",
+		"Digest (sha256:<hex>) of the image of a starting container, to record in the container event log and measure before quoting. Implies --include-containers",
+	)
+
+	quoteCmd.Flags().StringVar(
+		&measureContainerName,
+		"measure-container-name",
+		"",
+		"Name of the image of the container measured with --measure-container",
+	)
+
+	quoteCmd.Flags().StringVar(
+		&measureContainerConfig,
+		"measure-container-config",
+		"",
+		"File path for the runtime config of the container measured with --measure-container, e.g. its OCI config.json",
+	)
+
+	quoteCmd.Flags().StringArrayVar(
+		&measureContainerMounts,
+		"measure-container-mount",
+		nil,
+		"Mount of the container measured with --measure-container, as source:destination[:option,...]. May be repeated",
+	)
+
 	quoteCmd.Flags().BoolVarP(
 		&debugLogging,
 		"debug",
@@ -87,9 +237,19 @@ func init() {
 		"attestion.json",
 		"Attestation output location",
 	)
+
+	quoteCmd.Flags().StringVar(
+		&outputFormat,
+		"format",
+		"json",
+		"Attestation output format: json, or eat for a CBOR Entity Attestation Token",
+	)
 }
 
 func getQuote(_ *cobra.Command, args []string) error {
+	if outputFormat != "json" && outputFormat != "eat" {
+		return fmt.Errorf("unsupported output format %s", outputFormat)
+	}
 
 	// Access the TPM and its metadata
 	rwc, err := tpm2.OpenTPM(tpmPath)
@@ -98,31 +258,126 @@ func getQuote(_ *cobra.Command, args []string) error {
 	}
 	defer rwc.Close()
 
-	akCertBytes, err := tpm2.NVRead(rwc, tpmutil.Handle(certLocation))
-	if err != nil {
-		return fmt.Errorf("can't read AK cert at %x: %w", certLocation, err)
+	var akCertBytes []byte
+	if akCertPath != "" {
+		akCertBytes, err = os.ReadFile(akCertPath)
+		if err != nil {
+			return fmt.Errorf("can't read AK cert %s: %w", akCertPath, err)
+		}
+		if block, _ := pem.Decode(akCertBytes); block != nil {
+			akCertBytes = block.Bytes
+		}
+	} else if createAK {
+		log.Printf("WARNING: the attestation has no AK cert, certify the new AK with activate-credential")
+	} else if certLocation != 0 {
+		akCertBytes, err = tpm2.NVRead(rwc, tpmutil.Handle(certLocation))
+		if err != nil {
+			return fmt.Errorf("can't read AK cert at %x: %w", certLocation, err)
+		}
+	} else {
+		return fmt.Errorf("platform %s has no AK cert in NV, set --ak-cert-path", platform)
+	}
+
+	var akCert *x509.Certificate
+	if akCertBytes != nil {
+		akCert, err = x509.ParseCertificate(akCertBytes)
+		if err != nil {
+			return fmt.Errorf("can't parse AK cert: %w", err)
+		}
+		akCertBytes = akCert.Raw
+
+		if akCert.PublicKeyAlgorithm.String() != "RSA" {
+			return fmt.Errorf("Public key algorithm %s not supported", akCert.PublicKeyAlgorithm.String())
+		}
+
+		akPub := akCert.PublicKey.(*rsa.PublicKey)
+
+		if debugLogging {
+			log.Printf("AK cert:")
+			log.Printf("\tSubject: %s", akCert.Subject)
+			log.Printf("\tPubkey Alg: %s", akCert.PublicKeyAlgorithm.String())
+			log.Printf("\t\tModulus: %x", akPub.N)
+			log.Printf("\t\tExponent: %d", akPub.E)
+			log.Printf("\tPubkey: %s", akCert.PublicKeyAlgorithm)
+			log.Printf("\tIssuer: %s", akCert.Issuer)
+			log.Printf("\tSignature: %x", akCert.Signature)
+		}
+	}
+
+	akHandle := tpmutil.Handle(akLocation)
+	var creation *akCreation
+	if createAK {
+		akHandle, creation, err = createTCGAK(rwc, akParent)
+		if err != nil {
+			return fmt.Errorf("can't create AK under the %s: %w", akParent, err)
+		}
+
+		if persistAK {
+			// Evicting to an occupied handle fails with a bare TPM error, and
+			// platforms like Azure keep their own AK at the default location
+			_, _, _, err = tpm2.ReadPublic(rwc, tpmutil.Handle(akLocation))
+			if err == nil {
+				tpm2.FlushContext(rwc, akHandle)
+				return fmt.Errorf("can't persist AK at %x: the handle is in use, set --ak-location to a free persistent handle", akLocation)
+			}
+
+			err = tpm2.EvictControl(rwc, "", tpm2.HandleOwner, akHandle, tpmutil.Handle(akLocation))
+			tpm2.FlushContext(rwc, akHandle)
+			if err != nil {
+				return fmt.Errorf("can't persist AK at %x: %w", akLocation, err)
+			}
+			akHandle = tpmutil.Handle(akLocation)
+			log.Printf("Persisted the new AK at %x", akLocation)
+		} else {
+			defer tpm2.FlushContext(rwc, akHandle)
+		}
+	} else if akLocation == 0 {
+		if akTemplateLocation == 0 {
+			return fmt.Errorf("platform %s has no persistent AK or AK template, set --ak-location or --create-ak", platform)
+		}
+
+		akHandle, err = createAKFromTemplate(rwc, akTemplateLocation)
+		if err != nil {
+			return fmt.Errorf("can't create AK from template at %x: %w", akTemplateLocation, err)
+		}
+		defer tpm2.FlushContext(rwc, akHandle)
 	}
 
-	akCert, err := x509.ParseCertificate(akCertBytes)
+	akPublic, err := readPublicArea(rwc, uint32(akHandle))
 	if err != nil {
-		return fmt.Errorf("can't parse AK cert: %w", err)
+		return fmt.Errorf("can't read AK public area at %x: %w", akHandle, err)
 	}
 
-	if akCert.PublicKeyAlgorithm.String() != "RSA" {
-		return fmt.Errorf("Public key algorithm %s not supported", akCert.PublicKeyAlgorithm.String())
+	if akCert != nil {
+		err = checkAKCertMatches(akCert, akPublic)
+		if err != nil {
+			return fmt.Errorf("AK cert doesn't match the AK at %x: %w", akHandle, err)
+		}
 	}
 
-	akPub := akCert.PublicKey.(*rsa.PublicKey)
+	var ekCertBytes []byte
+	if includeEK {
+		ekCertBytes, err = readNVCert(rwc, ekCertLocation)
+		if err != nil {
+			return fmt.Errorf("can't read EK cert at %x: %w", ekCertLocation, err)
+		}
+	}
 
-	if debugLogging {
-		log.Printf("AK cert:")
-		log.Printf("\tSubject: %s", akCert.Subject)
-		log.Printf("\tPubkey Alg: %s", akCert.PublicKeyAlgorithm.String())
-		log.Printf("\t\tModulus: %x", akPub.N)
-		log.Printf("\t\tExponent: %d", akPub.E)
-		log.Printf("\tPubkey: %s", akCert.PublicKeyAlgorithm)
-		log.Printf("\tIssuer: %s", akCert.Issuer)
-		log.Printf("\tSignature: %x", akCert.Signature)
+	var hclReport []byte
+	if includeHCLReport {
+		hclReport, err = tpm2.NVRead(rwc, tpmutil.Handle(hclReportLocation))
+		if err != nil {
+			return fmt.Errorf("can't read HCL report at %x: %w", hclReportLocation, err)
+		}
+	}
+
+	// Measure the container start before quoting, so the quote covers it
+	if measureContainer != "" {
+		err = measureContainerStart(rwc)
+		if err != nil {
+			return err
+		}
+		includeContainers = true
 	}
 
 	// Get the boot measurements
@@ -144,85 +399,369 @@ func getQuote(_ *cobra.Command, args []string) error {
 	nonce := make([]byte, 8)
 	rand.Read(nonce)
 
-	// PCR_Read only supports reading 8 PCRs at a time
-	// Select the first PCRs to quote
-	pcrsel := tpm2.PCRSelection{
-		Hash: tpm2.AlgSHA256,
-		PCRs: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11},
+	quotedPCRs := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11}
+	if includeIMA {
+		quotedPCRs = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, internal.IMAPCR, 11}
+	}
+	if includeContainers {
+		quotedPCRs = append(quotedPCRs, internal.ContainerPCR)
 	}
-	quoteData, quoteSig, err := tpm2.QuoteRaw(rwc, tpmutil.Handle(akLocation), "", "", nonce, pcrsel, tpm2.AlgNull)
+
+	// IMA may extend PCR 10 between the quote and reading the PCRs, so quote
+	// again until the PCR values match the quoted digest
+	var quoteData, quoteSig []byte
+	var pcrValues []internal.PCRValue
+	for attempt := 1; ; attempt++ {
+		quoteData, quoteSig, pcrValues, err = quotePCRs(rwc, akHandle, nonce, quotedPCRs)
+		if err != nil {
+			return err
+		}
+
+		matches, err := pcrDigestMatches(quoteData, pcrValues)
+		if err != nil {
+			return err
+		}
+		if matches {
+			break
+		}
+		if attempt == maxQuoteAttempts {
+			return fmt.Errorf("PCR values changed while quoting %d times", attempt)
+		}
+	}
+
+	// The IMA log is read after the quote, so it covers at least the quoted
+	// PCR 10 value. verify ignores entries added since.
+	var imaMeasurements []byte
+	if includeIMA {
+		imaMeasurements, err = os.ReadFile(imaMeasurementsLocation)
+		if err != nil {
+			return fmt.Errorf("couldn't read IMA measurements: %w", err)
+		}
+	}
+
+	// Likewise for containers started while quoting
+	var containerMeasurements []byte
+	if includeContainers {
+		containerMeasurements, err = os.ReadFile(containerLogLocation)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("couldn't read container measurements: %w", err)
+		}
+	}
+
+	if debugLogging {
+		log.Printf("PCR Values:")
+		for _, pcr := range pcrValues {
+			log.Printf("\t%d: %x", pcr.Index, pcr.Value)
+		}
+
+		log.Printf("Quote Data: %x", quoteData)
+		log.Printf("Quote Sig: %x", quoteSig)
+	}
+
+	tpmInfo, err := readTPMInfo(rwc)
 	if err != nil {
-		return fmt.Errorf("couldn't quote PCRs: %w", err)
+		return fmt.Errorf("couldn't read TPM properties: %w", err)
 	}
 
-	// PCR_Read only supports reading 8 PCRs at a time
-	pcrsel = tpm2.PCRSelection{
-		Hash: tpm2.AlgSHA256,
-		PCRs: []int{0, 1, 2, 3, 4, 5, 6, 7},
+	// Generate the attestation to output
+	attestation := internal.NewAttestation()
+	attestation.TPM = tpmInfo
+	attestation.Platform = readPlatformInfo()
+	attestation.AkCert = akCertBytes
+	attestation.BootEventLog = bootMeasurements
+	attestation.VerityEventLog = verityMeasurements
+	attestation.IMAEventLog = imaMeasurements
+	attestation.QuoteData = quoteData
+	attestation.QuoteSignature = quoteSig
+	attestation.PCRs = pcrValues
+	attestation.EkCert = ekCertBytes
+	attestation.AkPublic = akPublic
+	attestation.HCLReport = hclReport
+	attestation.ContainerEventLog = containerMeasurements
+	if creation != nil {
+		attestation.AkCreationData = creation.creationData
+		attestation.AkCreationTicket = creation.ticket
+	}
+	attestation.DescribeEvidence()
+
+	var output []byte
+	if outputFormat == "eat" {
+		output, err = internal.EncodeEAT(attestation)
+	} else {
+		output, err = json.Marshal(attestation)
 	}
-	pcrs, err := tpm2.ReadPCRs(rwc, pcrsel)
 	if err != nil {
-		return fmt.Errorf("couldn't read PCRs: %w", err)
+		return fmt.Errorf("couldn't serialize attestation: %w", err)
 	}
 
-	// convert pcrs map to a list of PCRValue
-	var pcrValues []internal.PCRValue
-	for k, v := range pcrs {
-		pcrValues = append(pcrValues, internal.PCRValue{
-			Index: k,
-			Value: v,
-		})
+	err = os.WriteFile(outputPath, output, 0666)
+	if err != nil {
+		return fmt.Errorf("writing file: %w", err)
+	}
+
+	return nil
+}
+
+// measureContainerStart records a container start event in the container
+// event log and extends its digest into the container PCR. The event is logged
+// first, so that a failed extend leaves a trailing event that verify ignores
+// rather than a PCR value the log can't replay.
+func measureContainerStart(rw io.ReadWriter) error {
+	event, err := internal.NewContainerEvent(measureContainerName, measureContainer, measureContainerConfig, measureContainerMounts)
+	if err != nil {
+		return err
+	}
+
+	line, err := event.Marshal()
+	if err != nil {
+		return fmt.Errorf("couldn't serialize container event: %w", err)
 	}
 
-	// read remaining PCRs
-	pcrsel = tpm2.PCRSelection{
+	err = os.MkdirAll(filepath.Dir(containerLogLocation), 0755)
+	if err != nil {
+		return fmt.Errorf("couldn't create container measurements directory: %w", err)
+	}
+	file, err := os.OpenFile(containerLogLocation, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't open container measurements: %w", err)
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write container measurements: %w", err)
+	}
+
+	digest := sha256.Sum256(line)
+	err = tpm2.PCRExtend(rw, tpmutil.Handle(internal.ContainerPCR), tpm2.AlgSHA256, digest[:], "")
+	if err != nil {
+		return fmt.Errorf("couldn't extend PCR %d: %w", internal.ContainerPCR, err)
+	}
+
+	if debugLogging {
+		log.Printf("Measured container start: %s", line)
+	}
+
+	return nil
+}
+
+// maxQuoteAttempts bounds how often quote retries when PCRs are extended
+// while quoting
+const maxQuoteAttempts = 5
+
+// quotePCRs quotes the given SHA-256 PCRs and reads their values
+func quotePCRs(rw io.ReadWriter, akHandle tpmutil.Handle, nonce []byte, indexes []int) ([]byte, []byte, []internal.PCRValue, error) {
+	pcrsel := tpm2.PCRSelection{
 		Hash: tpm2.AlgSHA256,
-		PCRs: []int{8, 9, 11},
+		PCRs: indexes,
 	}
-	pcrs, err = tpm2.ReadPCRs(rwc, pcrsel)
+	quoteData, quoteSig, err := tpm2.QuoteRaw(rw, akHandle, "", "", nonce, pcrsel, tpm2.AlgNull)
 	if err != nil {
-		return fmt.Errorf("couldn't read PCRs: %w", err)
+		return nil, nil, nil, fmt.Errorf("couldn't quote PCRs: %w", err)
 	}
 
-	for k, v := range pcrs {
-		pcrValues = append(pcrValues, internal.PCRValue{
-			Index: k,
-			Value: v,
+	// PCR_Read only supports reading 8 PCRs at a time
+	var pcrValues []internal.PCRValue
+	for start := 0; start < len(indexes); start += 8 {
+		end := start + 8
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+
+		pcrs, err := tpm2.ReadPCRs(rw, tpm2.PCRSelection{
+			Hash: tpm2.AlgSHA256,
+			PCRs: indexes[start:end],
 		})
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("couldn't read PCRs: %w", err)
+		}
+
+		for k, v := range pcrs {
+			pcrValues = append(pcrValues, internal.PCRValue{
+				Index: k,
+				Value: v,
+			})
+		}
 	}
 
 	sort.Slice(pcrValues, func(i, j int) bool {
 		return pcrValues[i].Index < pcrValues[j].Index
 	})
 
-	if debugLogging {
-		log.Printf("PCR Values:")
-		for _, pcr := range pcrValues {
-			log.Printf("\t%d: %x", pcr.Index, pcr.Value)
+	return quoteData, quoteSig, pcrValues, nil
+}
+
+// pcrDigestMatches checks the PCR values against the digest in the quote
+func pcrDigestMatches(quoteData []byte, pcrValues []internal.PCRValue) (bool, error) {
+	quote, err := tpm2.DecodeAttestationData(quoteData)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse quote: %w", err)
+	}
+
+	hasher := sha256.New()
+	for _, pcr := range pcrValues {
+		hasher.Write(pcr.Value)
+	}
+
+	return bytes.Equal(hasher.Sum(nil), quote.AttestedQuoteInfo.PCRDigest), nil
+}
+
+// akCreation is the creation data of a new AK and the ticket proving the TPM
+// created it
+type akCreation struct {
+	creationData []byte // TPMS_CREATION_DATA
+	ticket       []byte // TPMT_TK_CREATION
+}
+
+// createTCGAK creates and loads an AK from the TCG AK template under the EK or
+// a transient SRK. The caller flushes or persists it.
+func createTCGAK(rw io.ReadWriter, parent string) (tpmutil.Handle, *akCreation, error) {
+	var parentHandle tpmutil.Handle
+	switch parent {
+	case "ek":
+		parentHandle = tpmutil.Handle(ekLocation)
+	case "srk":
+		srk, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", internal.SRKTemplateRSA())
+		if err != nil {
+			return 0, nil, fmt.Errorf("can't create SRK: %w", err)
 		}
+		defer tpm2.FlushContext(rw, srk)
+		parentHandle = srk
+	default:
+		return 0, nil, fmt.Errorf("unsupported AK parent %s, expected ek or srk", parent)
+	}
 
-		log.Printf("Quote Data: %x", quoteData)
-		log.Printf("Quote Sig: %x", quoteSig)
+	// The EK's auth policy needs a fresh policy session for each command
+	parentAuth := func() (tpm2.AuthCommand, func(), error) {
+		if parent != "ek" {
+			return tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}, func() {}, nil
+		}
+		session, err := ekPolicySession(rw)
+		if err != nil {
+			return tpm2.AuthCommand{}, nil, err
+		}
+		return tpm2.AuthCommand{Session: session, Attributes: tpm2.AttrContinueSession}, func() { tpm2.FlushContext(rw, session) }, nil
 	}
 
-	// Generate the attestation to output
-	attestation := internal.Attestation{
-		AkCert:         akCertBytes,
-		BootEventLog:   bootMeasurements,
-		VerityEventLog: verityMeasurements,
-		QuoteData:      quoteData,
-		QuoteSignature: quoteSig,
-		PCRs:           pcrValues,
+	auth, done, err := parentAuth()
+	if err != nil {
+		return 0, nil, err
 	}
-	json, err := json.Marshal(attestation)
+	private, public, creationData, _, ticket, err := tpm2.CreateKeyUsingAuth(rw, parentHandle, tpm2.PCRSelection{}, auth, "", internal.AKTemplateRSA())
+	done()
 	if err != nil {
-		return fmt.Errorf("couldn't serialize attestation: %w", err)
+		return 0, nil, err
 	}
 
-	err = os.WriteFile(outputPath, json, 0666)
+	auth, done, err = parentAuth()
 	if err != nil {
-		return fmt.Errorf("writing file: %w", err)
+		return 0, nil, err
+	}
+	handle, _, err := tpm2.LoadUsingAuth(rw, parentHandle, auth, public, private)
+	done()
+	if err != nil {
+		return 0, nil, fmt.Errorf("can't load AK: %w", err)
+	}
+
+	ticketBytes, err := tpmutil.Pack(ticket.Type, ticket.Hierarchy, ticket.Digest)
+	if err != nil {
+		tpm2.FlushContext(rw, handle)
+		return 0, nil, fmt.Errorf("can't encode creation ticket: %w", err)
+	}
+
+	return handle, &akCreation{creationData: creationData, ticket: ticketBytes}, nil
+}
+
+// checkAKCertMatches checks that the AK cert certifies the AK's public key
+func checkAKCertMatches(akCert *x509.Certificate, akPublic []byte) error {
+	pub, err := tpm2.DecodePublic(akPublic)
+	if err != nil {
+		return fmt.Errorf("can't decode AK public area: %w", err)
+	}
+
+	key, err := pub.Key()
+	if err != nil {
+		return fmt.Errorf("can't get AK public key: %w", err)
+	}
+
+	if !key.(interface{ Equal(crypto.PublicKey) bool }).Equal(akCert.PublicKey) {
+		return fmt.Errorf("public keys differ")
 	}
 
 	return nil
 }
+
+// createAKFromTemplate creates a primary AK under the endorsement hierarchy
+// from the TPMT_PUBLIC template stored in NV, e.g. on GCP. Primary keys are
+// derived from the hierarchy seed, so the AK is the same on every call.
+func createAKFromTemplate(rw io.ReadWriter, templateIndex uint32) (tpmutil.Handle, error) {
+	templateBytes, err := tpm2.NVRead(rw, tpmutil.Handle(templateIndex))
+	if err != nil {
+		return 0, err
+	}
+
+	template, err := tpm2.DecodePublic(templateBytes)
+	if err != nil {
+		return 0, fmt.Errorf("can't decode AK template: %w", err)
+	}
+
+	handle, _, err := tpm2.CreatePrimary(rw, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", template)
+	if err != nil {
+		return 0, err
+	}
+
+	return handle, nil
+}
+
+// readTPMInfo reads the manufacturer, vendor string, firmware and spec
+// version from the TPM's fixed properties
+func readTPMInfo(rw io.ReadWriter) (*internal.TPMInfo, error) {
+	vals, _, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, uint32(tpm2.FirmwareVersion2-tpm2.FamilyIndicator)+1, uint32(tpm2.FamilyIndicator))
+	if err != nil {
+		return nil, err
+	}
+
+	props := make(map[tpm2.TPMProp]uint32)
+	for _, val := range vals {
+		if prop, ok := val.(tpm2.TaggedProperty); ok {
+			props[prop.Tag] = prop.Value
+		}
+	}
+
+	vendorString := ""
+	for _, prop := range []tpm2.TPMProp{tpm2.VendorString1, tpm2.VendorString2, tpm2.VendorString3, tpm2.VendorString4} {
+		vendorString += propertyString(props[prop])
+	}
+	vendorString = strings.TrimRight(vendorString, "\x00 ")
+
+	return &internal.TPMInfo{
+		Manufacturer:    strings.TrimSpace(propertyString(props[tpm2.Manufacturer])),
+		VendorString:    vendorString,
+		FirmwareVersion: fmt.Sprintf("%08x%08x", props[tpm2.FirmwareVersion1], props[tpm2.FirmwareVersion2]),
+		SpecFamily:      propertyString(props[tpm2.FamilyIndicator]),
+		SpecLevel:       props[tpm2.SpecLevel],
+		SpecRevision:    props[tpm2.SpecRevision],
+	}, nil
+}
+
+// propertyString decodes a TPM property holding up to four ASCII characters
+func propertyString(value uint32) string {
+	b := []byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}
+	return strings.TrimRight(string(b), "\x00")
+}
+
+// readPlatformInfo reads the system vendor and product name from SMBIOS. It
+// returns nil when they aren't available.
+func readPlatformInfo() *internal.PlatformInfo {
+	vendor, _ := os.ReadFile("/sys/class/dmi/id/sys_vendor")
+	product, _ := os.ReadFile("/sys/class/dmi/id/product_name")
+	if len(vendor) == 0 && len(product) == 0 {
+		return nil
+	}
+
+	return &internal.PlatformInfo{
+		Vendor:  strings.TrimSpace(string(vendor)),
+		Product: strings.TrimSpace(string(product)),
+	}
+}
@@ -1,10 +1,17 @@
 package cmd
 
 import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/chkimes/image-attestation/internal"
-	//"github.com/in-toto/scai-demos/scai-gen/pkg/fileio"
+	"github.com/in-toto/scai-demos/scai-gen/pkg/fileio"
 	"github.com/in-toto/scai-demos/scai-gen/pkg/generators"
 
 	scai "github.com/in-toto/attestation/go/predicates/scai/v0"
@@ -12,6 +19,7 @@ import (
 
 	"github.com/spf13/cobra"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 var refValuesCmd = &cobra.Command{
@@ -20,6 +28,13 @@ var refValuesCmd = &cobra.Command{
 	RunE:  genRefValues,
 }
 
+var refValuesRevokeCmd = &cobra.Command{
+	Use:   "revoke [image digest]",
+	Args:  cobra.MaximumNArgs(1),
+	Short: "Adds the reference values of a build image to a signed revocation list, or re-issues the list without an image digest",
+	RunE:  revokeRefValues,
+}
+
 var (
 	buildImgFile     string
 	kernelFile       string
@@ -28,6 +43,29 @@ var (
 	vmmPcrsFile      string
 	previewRefValues bool
 	prettyPrint      bool
+	fromAttestation  string
+	refSigningKey    string
+	refValuesStore   string
+	validFrom        string
+	validFor         time.Duration
+	revokeReason     string
+	revocationsPath  string
+	revocationsValid time.Duration
+
+	producerRepo      string
+	producerCommit    string
+	producerRun       string
+	producerBuilder   string
+	kernelEvidence    string
+	initramfsEvidence string
+	verityEvidence    string
+	vmmPcrsEvidence   string
+
+	containerImagePath string
+	containerImageName string
+	containerPlatform  string
+	containerEvidence  string
+	containerMounts    []string
 )
 
 func init() {
@@ -68,7 +106,7 @@ func init() {
 		"verity-file",
 		"v",
 		"",
-		"The name of the verity tree file",
+		"The name of the verity root hash file (veritysetup format --root-hash-file), or of the verity hash tree file",
 	)
 
 	refValuesCmd.Flags().StringVarP(
@@ -92,28 +130,226 @@ func init() {
 		false,
 		"Flag to JSON pretty-print the generated Report",
 	)
+
+	refValuesCmd.Flags().StringVar(
+		&refSigningKey,
+		"signing-key",
+		"",
+		"File path for the PEM private key signing the DSSE envelope (ECDSA, RSA or Ed25519)",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&refValuesStore,
+		"store",
+		"",
+		"Directory of a reference value store to write the signed reference values to, as <image digest>.json, instead of --out-file",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&validFrom,
+		"valid-from",
+		"",
+		"RFC 3339 time from which the reference values are valid. Default: now",
+	)
+
+	refValuesCmd.Flags().DurationVar(
+		&validFor,
+		"valid-for",
+		90*24*time.Hour,
+		"Duration for which the reference values are valid, 0 for no expiry",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&producerRepo,
+		"producer-repo",
+		"",
+		"URL of the repository the build image was built from. Default: $GITHUB_SERVER_URL/$GITHUB_REPOSITORY",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&producerCommit,
+		"producer-commit",
+		"",
+		"Git commit the build image was built from. Default: $GITHUB_SHA",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&producerRun,
+		"producer-run",
+		"",
+		"URL of the workflow run that built the build image. Default: $GITHUB_SERVER_URL/$GITHUB_REPOSITORY/actions/runs/$GITHUB_RUN_ID",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&producerBuilder,
+		"producer-builder",
+		"",
+		"Identity of the builder, e.g. the workflow ref. Default: $GITHUB_WORKFLOW_REF",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&kernelEvidence,
+		"kernel-evidence",
+		"",
+		"File path for the evidence backing the kernel reference value, e.g. its Sigstore bundle. Default with --from-attestation: the attestation",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&initramfsEvidence,
+		"initramfs-evidence",
+		"",
+		"File path for the evidence backing the initramfs reference value. Default with --from-attestation: the attestation",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&verityEvidence,
+		"verity-evidence",
+		"",
+		"File path for the evidence backing the verity hash reference value. Default with --from-attestation: the attestation",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&vmmPcrsEvidence,
+		"vmm-pcrs-evidence",
+		"",
+		"File path for the evidence backing the VMM-set PCR reference values. Default with --from-attestation: the attestation",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&containerImagePath,
+		"container",
+		"",
+		"File path for an OCI layout directory, or an OCI layout or docker save tarball, to generate container image reference values for instead of the VM components",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&containerImageName,
+		"container-name",
+		"",
+		"Reference name or tag selecting the image of a --container layout or archive with several images",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&containerPlatform,
+		"container-platform",
+		"linux/amd64",
+		"Platform (os/arch[/variant]) selecting the image of a multi-platform --container index",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&containerEvidence,
+		"container-evidence",
+		"",
+		"File path for the evidence backing the container image reference values, e.g. its SLSA provenance bundle",
+	)
+
+	refValuesCmd.Flags().StringArrayVar(
+		&containerMounts,
+		"container-mount",
+		nil,
+		"Bind mount that containers of the --container image may have, as source:destination[:option,...]. May be repeated. Default: none",
+	)
+
+	refValuesCmd.Flags().StringVar(
+		&fromAttestation,
+		"from-attestation",
+		"",
+		"File path for a known-good attestation to verify and learn the PCR, verity hash, kernel, initramfs and command line reference values from, instead of the component files. It's verified like verify does, with the same AK, revocation, clock, SEV-SNP, TDX and boot revocation flags",
+	)
+
+	addEvidenceFlags(refValuesCmd.Flags())
+
+	refValuesCmd.Flags().BoolVarP(
+		&debugLogging,
+		"debug",
+		"d",
+		false,
+		"Flag enabling debug logging. Default: false",
+	)
+
+	refValuesRevokeCmd.Flags().StringVar(
+		&revokeReason,
+		"reason",
+		"",
+		"Why the reference values are revoked, e.g. a CVE. Required with an image digest",
+	)
+
+	refValuesRevokeCmd.Flags().StringVar(
+		&revocationsPath,
+		"revocations",
+		"ref-value-revocations.json",
+		"File path for the signed revocation list, created if it doesn't exist",
+	)
+
+	refValuesRevokeCmd.Flags().DurationVar(
+		&revocationsValid,
+		"next-update",
+		7*24*time.Hour,
+		"Duration until the revocation list's next update, after which verify rejects it as stale",
+	)
+
+	refValuesRevokeCmd.Flags().StringVar(
+		&refSigningKey,
+		"signing-key",
+		"",
+		"File path for the PEM private key signing the revocation list (ECDSA, RSA or Ed25519)",
+	)
+	refValuesRevokeCmd.MarkFlagRequired("signing-key")
+
+	refValuesCmd.AddCommand(refValuesRevokeCmd)
 }
 
 func genRefValues(_ *cobra.Command, args []string) error {
+	conditions, err := refValueConditions()
+	if err != nil {
+		return err
+	}
+
+	producer := refValueProducer()
+	producerDesc, err := producer.ResourceDescriptor()
+	if err != nil {
+		return err
+	}
+
+	if containerImagePath != "" {
+		if fromAttestation != "" {
+			return fmt.Errorf("--container and --from-attestation are mutually exclusive")
+		}
+		return genContainerRefValues(conditions, producer, producerDesc)
+	}
+
+	if fromAttestation != "" {
+		return learnRefValues(conditions, producer, producerDesc)
+	}
+
+	evidence, err := refValueEvidence("", producer.WorkflowRun)
+	if err != nil {
+		return err
+	}
 
 	// Generate SCAI attribute assertions for each measured build environment component
 
-	kernelRef, err := internal.NewRefValueSCAIAssertion("REF_VALUE:kernel", kernelFile, false)
+	kernelRef, err := internal.NewRefValueSCAIAssertion(internal.RefValueKernel, kernelFile, false, conditions, evidence[internal.RefValueKernel])
 	if err != nil {
 		return fmt.Errorf("failed to generate SCAI assertion for the kernel %s: %w", kernelFile, err)
 	}
 
-	initramfsRef, err := internal.NewRefValueSCAIAssertion("REF_VALUE:initramfs", initramfsFile, false)
+	initramfsRef, err := internal.NewRefValueSCAIAssertion(internal.RefValueInitramfs, initramfsFile, false, conditions, evidence[internal.RefValueInitramfs])
 	if err != nil {
 		return fmt.Errorf("failed to generate SCAI assertion for the initramfs %s: %w", initramfsFile, err)
 	}
 
-	verityRef, err := internal.NewRefValueSCAIAssertion("REF_VALUE:verity-hash", verityFile, false)
+	// verify compares the root hash, not the digest of the file
+	verityHash, err := internal.ReadVerityRootHash(verityFile)
+	if err != nil {
+		return err
+	}
+	verityRef, err := internal.NewRefValueDigestAssertion(internal.RefValueVerityHash, "verity-root-hash", verityHash, nil, conditions, evidence[internal.RefValueVerityHash])
 	if err != nil {
 		return fmt.Errorf("failed to generate SCAI assertion for the verity hash %s: %w", verityFile, err)
 	}
 
-	vmmPcrsRef, err := internal.NewRefValueSCAIAssertion("REF_VALUE:vmm-pcrs", vmmPcrsFile, true)
+	vmmPcrsRef, err := internal.NewRefValueSCAIAssertion(internal.RefValueVMMPCRs, vmmPcrsFile, true, conditions, evidence[internal.RefValueVMMPCRs])
 	if err != nil {
 		return fmt.Errorf("failed to generate SCAI assertion for the VMM-set PCRs %s: %w", vmmPcrsFile, err)
 	}
@@ -124,19 +360,320 @@ func genRefValues(_ *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to generate RD for the build image %s: %w", buildImgFile, err)
 	}
 
-	statement, err := internal.NewSCAIStatement([]*ita.ResourceDescriptor{subject}, []*scai.AttributeAssertion{kernelRef, initramfsRef, verityRef, vmmPcrsRef}, nil)
+	statement, err := internal.NewSCAIStatement([]*ita.ResourceDescriptor{subject}, []*scai.AttributeAssertion{kernelRef, initramfsRef, verityRef, vmmPcrsRef}, producerDesc)
+	if err != nil {
+		return fmt.Errorf("failed to generate in-toto Statement for SCAI predicate: %w", err)
+	}
+
+	return writeRefValues(statement)
+}
+
+// learnRefValues verifies a known-good attestation and generates the
+// reference values from its PCRs and event logs
+func learnRefValues(conditions *structpb.Struct, producer internal.Producer, producerDesc *ita.ResourceDescriptor) error {
+	if refSigningKey == "" {
+		return fmt.Errorf("--signing-key is required with --from-attestation")
+	}
+
+	attestationBytes, err := os.ReadFile(fromAttestation)
+	if err != nil {
+		return fmt.Errorf("couldn't read attestation: %w", err)
+	}
+
+	attestation, err := internal.ParseAttestation(attestationBytes, true)
+	if err != nil {
+		return err
+	}
+
+	// Verify the evidence like verify does, there are no reference values to
+	// compare it with yet
+	var appraising internal.TrustClaim
+	ev, err := verifyEvidence(attestation, evidenceOptions{
+		checkQuotedPCRs:   true,
+		requireContainers: requireContainers,
+	}, internal.NewAttestationResult(), &appraising)
+	if err != nil {
+		return err
+	}
+
+	// Extract the reference values
+	kernelPath, kernelDigest, err := ev.bootEventLog.GrubLoadedFile("linux")
+	if err != nil {
+		return fmt.Errorf("couldn't find the kernel: %w", err)
+	}
+
+	initramfsPath, initramfsDigest, err := ev.bootEventLog.GrubLoadedFile("initrd")
+	if err != nil {
+		return fmt.Errorf("couldn't find the initramfs: %w", err)
+	}
+
+	cmdline := ev.bootEventLog.KernelCmdline()
+	if cmdline == "" {
+		return fmt.Errorf("no kernel command line in the boot event log")
+	}
+
+	// The IMA and container PCRs change at runtime, so they're no reference
+	// values
+	var expectedPcrs internal.ExpectedPCRs
+	for _, pcr := range attestation.PCRs {
+		if pcr.Index != internal.IMAPCR && pcr.Index != internal.ContainerPCR {
+			expectedPcrs.PCRs = append(expectedPcrs.PCRs, pcr)
+		}
+	}
+	expectedPcrsBytes, err := json.MarshalIndent(expectedPcrs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't serialize expected PCR values: %w", err)
+	}
+
+	if debugLogging {
+		log.Printf("kernel: %s %x", kernelPath, kernelDigest)
+		log.Printf("initramfs: %s %x", initramfsPath, initramfsDigest)
+		log.Printf("kernel command line: %s", cmdline)
+	}
+
+	// The attestation the values were learned from backs every value
+	evidence, err := refValueEvidence(fromAttestation, producer.WorkflowRun)
+	if err != nil {
+		return err
+	}
+
+	kernelRef, err := internal.NewRefValueDigestAssertion(internal.RefValueKernel, kernelPath, kernelDigest, nil, conditions, evidence[internal.RefValueKernel])
+	if err != nil {
+		return fmt.Errorf("failed to generate SCAI assertion for the kernel %s: %w", kernelPath, err)
+	}
+
+	initramfsRef, err := internal.NewRefValueDigestAssertion(internal.RefValueInitramfs, initramfsPath, initramfsDigest, nil, conditions, evidence[internal.RefValueInitramfs])
+	if err != nil {
+		return fmt.Errorf("failed to generate SCAI assertion for the initramfs %s: %w", initramfsPath, err)
+	}
+
+	// The root hash is itself a SHA-256 digest, of the top verity tree block
+	verityRef, err := internal.NewRefValueDigestAssertion(internal.RefValueVerityHash, "verity-root-hash", ev.verityHash, nil, conditions, evidence[internal.RefValueVerityHash])
+	if err != nil {
+		return fmt.Errorf("failed to generate SCAI assertion for the verity hash: %w", err)
+	}
+
+	pcrsDigest := sha256.Sum256(expectedPcrsBytes)
+	vmmPcrsRef, err := internal.NewRefValueDigestAssertion(internal.RefValueVMMPCRs, "expected-pcrs.json", pcrsDigest[:], expectedPcrsBytes, conditions, evidence[internal.RefValueVMMPCRs])
+	if err != nil {
+		return fmt.Errorf("failed to generate SCAI assertion for the PCRs: %w", err)
+	}
+
+	cmdlineDigest := sha256.Sum256([]byte(cmdline))
+	cmdlineRef, err := internal.NewRefValueDigestAssertion(internal.RefValueKernelCmdline, "kernel-cmdline", cmdlineDigest[:], []byte(cmdline), conditions, evidence[internal.RefValueKernelCmdline])
+	if err != nil {
+		return fmt.Errorf("failed to generate SCAI assertion for the kernel command line: %w", err)
+	}
+
+	// The build image file is the subject of the in-toto attestation
+	subject, err := generators.NewRdForFile(buildImgFile, "", "", "sha256", false, "", "", nil)
+	if err != nil {
+		return fmt.Errorf("failed to generate RD for the build image %s: %w", buildImgFile, err)
+	}
+
+	statement, err := internal.NewSCAIStatement([]*ita.ResourceDescriptor{subject}, []*scai.AttributeAssertion{kernelRef, initramfsRef, verityRef, vmmPcrsRef, cmdlineRef}, producerDesc)
 	if err != nil {
 		return fmt.Errorf("failed to generate in-toto Statement for SCAI predicate: %w", err)
 	}
 
+	return writeRefValues(statement)
+}
+
+// genContainerRefValues generates the reference values of a container image,
+// which is the subject of the statement instead of the build image
+func genContainerRefValues(conditions *structpb.Struct, producer internal.Producer, producerDesc *ita.ResourceDescriptor) error {
+	image, err := internal.LoadContainerImage(containerImagePath, containerImageName, containerPlatform)
+	if err != nil {
+		return err
+	}
+
+	if image.ManifestDigest == "" {
+		log.Printf("WARNING: the docker archive has no image manifest, the image is identified by its config digest %s", image.ConfigDigest)
+	}
+	if debugLogging {
+		log.Printf("container image: %s %s", image.Name, image.Digest())
+		log.Printf("config: %s", image.ConfigDigest)
+		for _, layer := range image.Layers {
+			if layer.DiffID {
+				log.Printf("layer diff ID: %s", layer.Digest)
+			} else {
+				log.Printf("layer: %s", layer.Digest)
+			}
+		}
+	}
+
+	evidence, err := internal.NewEvidenceDescriptor(containerEvidence, producer.WorkflowRun)
+	if err != nil {
+		return err
+	}
+
+	var mounts []internal.ContainerMount
+	for _, mount := range containerMounts {
+		containerMount, err := internal.ParseContainerMount(mount)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, containerMount)
+	}
+
+	assertions, err := internal.NewContainerRefValueAssertions(image, mounts, conditions, evidence)
+	if err != nil {
+		return fmt.Errorf("failed to generate SCAI assertions for the container image: %w", err)
+	}
+
+	statement, err := internal.NewSCAIStatement([]*ita.ResourceDescriptor{internal.NewContainerSubject(image)}, assertions, producerDesc)
+	if err != nil {
+		return fmt.Errorf("failed to generate in-toto Statement for SCAI predicate: %w", err)
+	}
+
+	return writeRefValues(statement)
+}
+
+// refValueConditions returns the SCAI conditions recording the validity window
+// of the reference values
+func refValueConditions() (*structpb.Struct, error) {
+	validity := internal.RefValueValidity{NotBefore: time.Now()}
+	if validFrom != "" {
+		var err error
+		validity.NotBefore, err = time.Parse(time.RFC3339, validFrom)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse --valid-from: %w", err)
+		}
+	}
+	if validFor > 0 {
+		validity.NotAfter = validity.NotBefore.Add(validFor)
+	}
+
+	return validity.Conditions()
+}
+
+// refValueProducer returns the producer of the reference values from the
+// flags, defaulting to the GitHub Actions run they're generated in
+func refValueProducer() internal.Producer {
+	producer := internal.Producer{
+		Repository:  producerRepo,
+		Commit:      producerCommit,
+		WorkflowRun: producerRun,
+		Builder:     producerBuilder,
+	}
+
+	server, repo := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY")
+	if producer.Repository == "" && server != "" && repo != "" {
+		producer.Repository = server + "/" + repo
+	}
+	if producer.Commit == "" {
+		producer.Commit = os.Getenv("GITHUB_SHA")
+	}
+	if runID := os.Getenv("GITHUB_RUN_ID"); producer.WorkflowRun == "" && server != "" && repo != "" && runID != "" {
+		producer.WorkflowRun = fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, runID)
+	}
+	if producer.Builder == "" {
+		producer.Builder = os.Getenv("GITHUB_WORKFLOW_REF")
+	}
+
+	return producer
+}
+
+// refValueEvidence returns the evidence descriptors of the reference values
+// by attribute, from the evidence flags or else the default evidence file
+func refValueEvidence(defaultEvidence string, downloadLocation string) (map[string]*ita.ResourceDescriptor, error) {
+	paths := map[string]string{
+		internal.RefValueKernel:        kernelEvidence,
+		internal.RefValueInitramfs:     initramfsEvidence,
+		internal.RefValueVerityHash:    verityEvidence,
+		internal.RefValueVMMPCRs:       vmmPcrsEvidence,
+		internal.RefValueKernelCmdline: "",
+	}
+
+	evidence := make(map[string]*ita.ResourceDescriptor)
+	for attribute, path := range paths {
+		if path == "" {
+			path = defaultEvidence
+		}
+		rd, err := internal.NewEvidenceDescriptor(path, downloadLocation)
+		if err != nil {
+			return nil, err
+		}
+		evidence[attribute] = rd
+	}
+
+	return evidence, nil
+}
+
+// writeRefValues signs the reference value statement into a DSSE envelope
+// and writes it to the output file
+func writeRefValues(statement *ita.Statement) error {
 	if previewRefValues {
 		fmt.Printf("%s\n", protojson.Format(statement))
 	}
 
-	// TODO: Implement DSSE signing
-	fmt.Printf("CAUTION: DSSE signing not implemented yet. NOT READY FOR PRODUCTION!!\n")
+	if refSigningKey == "" {
+		fmt.Printf("CAUTION: no --signing-key set, the reference values are not signed. NOT READY FOR PRODUCTION!!\n")
+		return nil
+	}
+
+	keyBytes, err := os.ReadFile(refSigningKey)
+	if err != nil {
+		return fmt.Errorf("couldn't read signing key: %w", err)
+	}
+	key, err := internal.ParsePEMPrivateKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("couldn't parse signing key: %w", err)
+	}
+
+	envelope, err := internal.SignStatement(statement, key)
+	if err != nil {
+		return err
+	}
+
+	path := outFile
+	if refValuesStore != "" {
+		path = filepath.Join(refValuesStore, statement.GetSubject()[0].GetDigest()["sha256"]+".json")
+	}
+
+	return fileio.WriteDSSEToFile(append(envelope, '\n'), path)
+}
+
+func revokeRefValues(_ *cobra.Command, args []string) error {
+	if len(args) > 0 && revokeReason == "" {
+		return fmt.Errorf("--reason is required to revoke an image")
+	}
+
+	keyBytes, err := os.ReadFile(refSigningKey)
+	if err != nil {
+		return fmt.Errorf("couldn't read signing key: %w", err)
+	}
+	key, err := internal.ParsePEMPrivateKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("couldn't parse signing key: %w", err)
+	}
 
-	return nil
+	// Extend the existing list, which must have been signed with the same key
+	revocations := &internal.RefValueRevocations{}
+	if _, err := os.Stat(revocationsPath); err == nil {
+		revocations, err = internal.LoadRefValueRevocations(revocationsPath, []crypto.PublicKey{key.Public()})
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if len(args) > 0 {
+		err = revocations.Revoke(args[0], revokeReason, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = revocations.Issue(now, revocationsValid)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := revocations.Sign(key)
+	if err != nil {
+		return err
+	}
 
-	//return fileio.WritePbToFile(st, outFile, prettyPrint)
+	return fileio.WriteDSSEToFile(append(envelope, '\n'), revocationsPath)
 }
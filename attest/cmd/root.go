@@ -1,19 +1,25 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/chkimes/image-attestation/internal"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "image-attestation",
-	Short: "A CLI tool for the SLSA Attested Build Environments track",
+	Use:               "image-attestation",
+	Short:             "A CLI tool for the SLSA Attested Build Environments track",
+	PersistentPreRunE: applyPlatform,
 }
 
 var (
-	outFile string
+	outFile       string
+	platform      string
+	platformsFile string
 )
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -28,12 +34,57 @@ func Execute() {
 var debugLogging bool
 
 func init() {
+	rootCmd.PersistentFlags().StringVar(
+		&platform,
+		"platform",
+		"azure",
+		"Platform profile providing the AK, EK and CA defaults: azure, gcp, aws-nitrotpm, generic, or one from --platforms-file",
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&platformsFile,
+		"platforms-file",
+		"",
+		"File path for YAML platform profiles extending or overriding the built-in ones",
+	)
+
 	rootCmd.AddCommand(quoteCmd)
 	rootCmd.AddCommand(verifyCmd)
 	rootCmd.AddCommand(refValuesCmd)
+	rootCmd.AddCommand(activateCredentialCmd)
+	rootCmd.AddCommand(caCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(inspectCmd)
 	//rootCmd.AddCommand(parseCmd)
 }
 
+// applyPlatform sets the flags of the running command that the platform
+// profile provides, unless they were set on the command line
+func applyPlatform(cmd *cobra.Command, args []string) error {
+	profile, err := internal.LookupPlatform(platform, platformsFile)
+	if err != nil {
+		return err
+	}
+
+	for name, values := range profile.FlagValues() {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || flag.Changed {
+			continue
+		}
+
+		if sliceValue, ok := flag.Value.(pflag.SliceValue); ok {
+			err = sliceValue.Replace(values)
+		} else {
+			err = flag.Value.Set(values[0])
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't apply platform %s to --%s: %w", platform, name, err)
+		}
+	}
+
+	return nil
+}
+
 func main() {
 	Execute()
 }
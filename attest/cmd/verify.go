@@ -8,33 +8,73 @@ import (
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chkimes/image-attestation/internal"
 	"github.com/google/go-tpm/legacy/tpm2"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/exp/slices"
 )
 
 var verifyCmd = &cobra.Command{
 	Use:   "verify",
-	Short: "Verifies a JSON-formatted TPM attestation",
+	Short: "Verifies a TPM attestation, either JSON-formatted or as a CBOR EAT",
 	RunE:  verifyQuote,
 }
 
 var (
-	attestationPath       string
-	kernelHash            string
-	initramfsHash         string
-	verityRootHash        string
-	expectedPcrsPath      string
-	intermediateCAPemPath string
+	attestationPath        string
+	kernelHash             string
+	initramfsHash          string
+	verityRootHashHex      string
+	expectedPcrsPath       string
+	rootCAPemPaths         []string
+	intermediateCAPemPaths []string
+	akEKUs                 []string
+	verificationTime       string
+	checkRevocation        bool
+	crlPaths               []string
+	crlCacheDir            string
+	offline                bool
+	clockStatePath         string
+	referenceAttestation   string
+	failOnReset            bool
+	allowUnsafeClock       bool
+	allowMissingAKPublic   bool
+	imaAllowlistPath       string
+	imaAllowViolations     bool
+	bootRevocationsPath    string
+	policyPath             string
+	refValuesStorePath     string
+	refValuesKeyPaths      []string
+	refValuesRevocations   string
+	allowNoRevocations     bool
+	requireContainers      bool
+	snpCertChainPath       string
+	snpVCEKPath            string
+	snpMeasurementHex      string
+	snpAllowDebug          bool
+	snpARKFingerprints     []string
+	tdxQuotePath           string
+	tdxRootCAPaths         []string
+	tdxMRTDHex             string
+	tdxRTMRs               []string
+	tdxAllowDebug          bool
+	tdxPCKCRLPaths         []string
+	tdxQEIdentityPath      string
+	tdxQEIdentityChainPath string
+	resultFormat           string
+	earSigningKeyPath      string
+	resultOutputPath       string
 )
 
 func init() {
@@ -63,7 +103,7 @@ func init() {
 	)
 
 	verifyCmd.Flags().StringVarP(
-		&verityRootHash,
+		&verityRootHashHex,
 		"verity-root-hash",
 		"v",
 		"7c4770215babcd808f0b5d440bec40f1d0757fd25ca584a10781a00b7e239a0c",
@@ -78,12 +118,83 @@ func init() {
 		"File path for the expected PCR values",
 	)
 
-	verifyCmd.Flags().StringVarP(
-		&intermediateCAPemPath,
-		"intermediate-ca-path",
-		"c",
-		"certs/azure-tl-intermediate.pem",
-		"File path for the intermediate CA certificate",
+	addEvidenceFlags(verifyCmd.Flags())
+
+	verifyCmd.Flags().StringVar(
+		&clockStatePath,
+		"clock-state",
+		"",
+		"File path for the TPM clock state of previously verified quotes, checked and updated on success",
+	)
+
+	verifyCmd.Flags().StringVar(
+		&imaAllowlistPath,
+		"ima-allowlist",
+		"",
+		"File path for the digests of the files IMA may measure, in sha256sum format. Requires an attestation with an IMA log",
+	)
+
+	verifyCmd.Flags().BoolVar(
+		&imaAllowViolations,
+		"ima-allow-violations",
+		false,
+		"Flag to accept IMA measurement violations, whose file contents weren't measured, in --ima-allowlist checks",
+	)
+
+	verifyCmd.Flags().StringVar(
+		&policyPath,
+		"policy",
+		"",
+		"File path for a YAML policy of CEL rules. Replaces the expected PCR, PCR selection and verity hash checks",
+	)
+
+	verifyCmd.Flags().StringVar(
+		&refValuesStorePath,
+		"ref-values-store",
+		"",
+		"Directory of DSSE-signed reference values from ref-values, one file per build image. Replaces the expected PCR, kernel, initramfs and verity hash checks",
+	)
+
+	verifyCmd.Flags().StringSliceVar(
+		&refValuesKeyPaths,
+		"ref-values-key",
+		nil,
+		"File paths for the PEM public keys or certificates trusted to sign the reference values in --ref-values-store",
+	)
+
+	verifyCmd.Flags().StringVar(
+		&refValuesRevocations,
+		"ref-values-revocations",
+		"",
+		"File path for a revocation list from ref-values revoke, signed by a --ref-values-key. Reference values of revoked images don't match. Required with --ref-values-store",
+	)
+
+	verifyCmd.Flags().BoolVar(
+		&allowNoRevocations,
+		"allow-missing-ref-values-revocations",
+		false,
+		"Flag to verify against --ref-values-store without a --ref-values-revocations list, so revoked images still match",
+	)
+
+	verifyCmd.Flags().StringVar(
+		&resultFormat,
+		"result-format",
+		"text",
+		"Attestation result format: text, or ear for a signed EAT Attestation Result (EAR) JWT",
+	)
+
+	verifyCmd.Flags().StringVar(
+		&earSigningKeyPath,
+		"ear-signing-key",
+		"",
+		"File path for the PEM private key signing the EAR (ECDSA, RSA or Ed25519)",
+	)
+
+	verifyCmd.Flags().StringVar(
+		&resultOutputPath,
+		"result-output",
+		"",
+		"File path to write the EAR to. Default: stdout",
 	)
 
 	verifyCmd.Flags().BoolVarP(
@@ -95,7 +206,239 @@ func init() {
 	)
 }
 
-func verifyQuote(_ *cobra.Command, args []string) error {
+// addEvidenceFlags registers the flags of the checks verifyEvidence runs, which
+// verify and ref-values --from-attestation share
+func addEvidenceFlags(flags *pflag.FlagSet) {
+	flags.StringSliceVarP(
+		&rootCAPemPaths,
+		"root-ca-path",
+		"r",
+		[]string{"certs/azure-tl-root.pem"},
+		"File or directory paths for the trusted root CA certificates (PEM, may be bundles)",
+	)
+
+	flags.StringSliceVarP(
+		&intermediateCAPemPaths,
+		"intermediate-ca-path",
+		"c",
+		[]string{"certs/azure-tl-intermediate.pem"},
+		"File or directory paths for the intermediate CA certificates (PEM, may be bundles)",
+	)
+
+	flags.StringSliceVar(
+		&akEKUs,
+		"ak-eku",
+		[]string{internal.OIDTCGKpAIKCertificate.String()},
+		"Extended key usage OIDs required in the AK certificate",
+	)
+
+	flags.StringVar(
+		&verificationTime,
+		"verification-time",
+		"",
+		"RFC 3339 time at which the AK certificate chain must be valid. Default: now",
+	)
+
+	flags.BoolVar(
+		&checkRevocation,
+		"check-revocation",
+		false,
+		"Flag enabling CRL revocation checks of the AK certificate chain, downloading CRLs unless --offline. Default: enabled by --crl-path or --crl-cache-dir",
+	)
+
+	flags.StringSliceVar(
+		&crlPaths,
+		"crl-path",
+		nil,
+		"File paths for pre-fetched CRLs (DER or PEM), used instead of the certificates' CRL distribution points",
+	)
+
+	flags.StringVar(
+		&crlCacheDir,
+		"crl-cache-dir",
+		"",
+		"Directory to cache downloaded CRLs in. Default: no caching",
+	)
+
+	flags.BoolVar(
+		&offline,
+		"offline",
+		false,
+		"Flag disabling CRL downloads. Only pre-fetched and cached CRLs are used",
+	)
+
+	flags.StringVar(
+		&referenceAttestation,
+		"reference-attestation",
+		"",
+		"File path for an earlier attestation from the same AK, e.g. from the start of the build, to compare TPM clock and counters with",
+	)
+
+	flags.BoolVar(
+		&failOnReset,
+		"fail-on-reset",
+		false,
+		"Flag to reject attestations where the TPM was reset or restarted since the previous observation",
+	)
+
+	flags.BoolVar(
+		&allowUnsafeClock,
+		"allow-unsafe-clock",
+		false,
+		"Flag to accept quotes whose TPM clock isn't marked safe",
+	)
+
+	flags.BoolVar(
+		&allowMissingAKPublic,
+		"allow-missing-ak-public",
+		false,
+		"Flag to accept attestations without the AK public area, whose attributes then can't be checked",
+	)
+
+	flags.StringVar(
+		&bootRevocationsPath,
+		"boot-revocations",
+		"",
+		"File path for a YAML list of revoked boot components and signers, the up-to-date dbx and the minimum SBAT level",
+	)
+
+	flags.BoolVar(
+		&requireContainers,
+		"require-containers",
+		false,
+		"Flag to reject attestations that don't quote the container PCR 13. Default: required if --ref-values-store has container reference values",
+	)
+
+	flags.StringVar(
+		&snpCertChainPath,
+		"snp-cert-chain-path",
+		"",
+		"File path for the AMD ASK and ARK certificates (PEM bundle). Requires and verifies the SEV-SNP report in the attestation's HCL report",
+	)
+
+	flags.StringVar(
+		&snpVCEKPath,
+		"snp-vcek-path",
+		"",
+		"File path for the VCEK certificate that signed the SEV-SNP report (PEM or DER)",
+	)
+
+	flags.StringVar(
+		&snpMeasurementHex,
+		"snp-measurement",
+		"",
+		"Expected SEV-SNP launch measurement (hex). Default: any",
+	)
+
+	flags.BoolVar(
+		&snpAllowDebug,
+		"snp-allow-debug",
+		false,
+		"Flag to accept SEV-SNP reports of VMs whose policy allows debugging",
+	)
+
+	flags.StringSliceVar(
+		&snpARKFingerprints,
+		"snp-ark-fingerprint",
+		nil,
+		"SHA-256 fingerprints (hex) of the SubjectPublicKeyInfo of further trusted AMD ARKs, required on Genoa and later products. Default: only the built-in Milan ARK is trusted",
+	)
+
+	flags.StringVar(
+		&tdxQuotePath,
+		"tdx-quote-path",
+		"",
+		"File path for a TDX quote (v4) whose report data binds the HCL report in the attestation, and so the AK",
+	)
+
+	flags.StringSliceVar(
+		&tdxRootCAPaths,
+		"tdx-root-ca-path",
+		nil,
+		"File or directory paths for the trusted Intel SGX root CA certificates (PEM, may be bundles)",
+	)
+
+	flags.StringVar(
+		&tdxMRTDHex,
+		"tdx-mrtd",
+		"",
+		"Expected TDX MRTD (hex). Default: any",
+	)
+
+	flags.StringSliceVar(
+		&tdxRTMRs,
+		"tdx-rtmr",
+		nil,
+		"Expected TDX RTMR as index=hex, e.g. 1=<hex>. May be repeated",
+	)
+
+	flags.BoolVar(
+		&tdxAllowDebug,
+		"tdx-allow-debug",
+		false,
+		"Flag to accept TDX quotes of TDs whose attributes allow debugging",
+	)
+
+	flags.StringSliceVar(
+		&tdxPCKCRLPaths,
+		"tdx-pck-crl",
+		nil,
+		"File paths for pre-fetched Intel PCK CA and SGX root CA CRLs (DER or PEM). Default: downloaded from the PCK chain's CRL distribution points unless --offline, cached in --crl-cache-dir",
+	)
+
+	flags.StringVar(
+		&tdxQEIdentityPath,
+		"tdx-qe-identity",
+		"",
+		"File path for the TDX QE identity from Intel PCS (/tdx/certification/v4/qe/identity). Required with --tdx-quote-path",
+	)
+
+	flags.StringVar(
+		&tdxQEIdentityChainPath,
+		"tdx-qe-identity-issuer-chain",
+		"",
+		"File path for the PEM certificates of the QE identity's SGX-Enclave-Identity-Issuer-Chain response header. Required with --tdx-quote-path",
+	)
+}
+
+func verifyQuote(_ *cobra.Command, args []string) (err error) {
+	var earKey crypto.Signer
+	switch resultFormat {
+	case "text":
+	case "ear":
+		if earSigningKeyPath == "" {
+			return fmt.Errorf("--ear-signing-key is required for EAR results")
+		}
+		keyBytes, err := os.ReadFile(earSigningKeyPath)
+		if err != nil {
+			return fmt.Errorf("couldn't read EAR signing key: %w", err)
+		}
+		earKey, err = internal.ParsePEMPrivateKey(keyBytes)
+		if err != nil {
+			return fmt.Errorf("couldn't parse EAR signing key: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported result format %s", resultFormat)
+	}
+
+	// Each check appraises one claim of the attestation result. A failing
+	// check contraindicates the claim being appraised, errors outside of the
+	// appraisal (appraising == "") don't produce a result.
+	result := internal.NewAttestationResult()
+	var appraising internal.TrustClaim
+	defer func() {
+		if earKey == nil || (err != nil && appraising == "") {
+			return
+		}
+		if err != nil {
+			result.Contraindicate(appraising)
+		}
+
+		earErr := writeEAR(result, earKey)
+		if earErr != nil && err == nil {
+			err = earErr
+		}
+	}()
 
 	// Get the TPM attestation
 	attestationBytes, err := os.ReadFile(attestationPath)
@@ -103,120 +446,666 @@ func verifyQuote(_ *cobra.Command, args []string) error {
 		return fmt.Errorf("couldn't read attestation: %w", err)
 	}
 
-	var attestation internal.Attestation
-	err = json.Unmarshal(attestationBytes, &attestation)
+	attestation, err := internal.ParseAttestation(attestationBytes, true)
 	if err != nil {
-		return fmt.Errorf("couldn't deserialize attestation: %w", err)
+		return err
 	}
 
-	// Get TPM quote reference values
-	verityRootHash, err := hex.DecodeString(verityRootHash)
-	if err != nil {
-		return fmt.Errorf("couldn't decode verity root hash: %w", err)
+	// Get TPM quote reference values, either as a policy or from the flags
+	var policy *internal.Policy
+	var refValuesStore *internal.RefValueStore
+	var verityRootHash []byte
+	var expectedPcrs internal.ExpectedPCRs
+	if policyPath != "" && refValuesStorePath != "" {
+		return fmt.Errorf("--policy and --ref-values-store are mutually exclusive")
+	}
+	if refValuesRevocations != "" && refValuesStorePath == "" {
+		return fmt.Errorf("--ref-values-revocations requires --ref-values-store")
 	}
+	if policyPath != "" {
+		policy, err = internal.LoadPolicy(policyPath)
+		if err != nil {
+			return fmt.Errorf("couldn't load policy: %w", err)
+		}
+	} else if refValuesStorePath != "" {
+		if len(refValuesKeyPaths) == 0 {
+			return fmt.Errorf("--ref-values-key is required with --ref-values-store")
+		}
+		refValuesKeys, err := internal.LoadPublicKeys(refValuesKeyPaths)
+		if err != nil {
+			return fmt.Errorf("couldn't load reference value keys: %w", err)
+		}
 
-	expectedPcrsBytes, err := os.ReadFile(expectedPcrsPath)
-	if err != nil {
-		return fmt.Errorf("couldn't read expected PCR values: %w", err)
+		refValuesStore, err = internal.LoadRefValueStore(refValuesStorePath, refValuesKeys)
+		if err != nil {
+			return err
+		}
+
+		if refValuesRevocations != "" {
+			refValuesStore.Revocations, err = internal.LoadRefValueRevocations(refValuesRevocations, refValuesKeys)
+			if err != nil {
+				return err
+			}
+		} else if !allowNoRevocations {
+			return fmt.Errorf("--ref-values-revocations is required with --ref-values-store, set --allow-missing-ref-values-revocations to skip revocation checks")
+		}
+	} else {
+		verityRootHash, err = hex.DecodeString(verityRootHashHex)
+		if err != nil {
+			return fmt.Errorf("couldn't decode verity root hash: %w", err)
+		}
+
+		expectedPcrsBytes, err := os.ReadFile(expectedPcrsPath)
+		if err != nil {
+			return fmt.Errorf("couldn't read expected PCR values: %w", err)
+		}
+
+		err = json.Unmarshal(expectedPcrsBytes, &expectedPcrs)
+		if err != nil {
+			return fmt.Errorf("couldn't deserialize expected PCR values: %w", err)
+		}
 	}
 
-	var expectedPcrs internal.ExpectedPCRs
-	err = json.Unmarshal(expectedPcrsBytes, &expectedPcrs)
-	if err != nil {
-		return fmt.Errorf("couldn't deserialize expected PCR values: %w", err)
+	if policy != nil {
+		result.PolicyID = fmt.Sprintf("sha256:%x", policy.Digest)
 	}
 
-	// Extract AK cert from attestation
-	akCert, err := x509.ParseCertificate(attestation.AkCert)
+	ev, err := verifyEvidence(attestation, evidenceOptions{
+		checkQuotedPCRs:   policy == nil,
+		requireContainers: requireContainers || (refValuesStore != nil && len(refValuesStore.ContainerSets) > 0),
+		secureBoot:        policy != nil,
+	}, result, &appraising)
 	if err != nil {
-		return fmt.Errorf("couldn't parse AK certificate: %w", err)
+		return err
 	}
 
-	// Get the intermediate CA
-	intermediateCA, err := os.ReadFile(intermediateCAPemPath)
-	if err != nil {
-		return fmt.Errorf("couldn't read intermediate CA cert: %w", err)
+	if imaAllowlistPath != "" {
+		if len(attestation.IMAEventLog) == 0 {
+			return fmt.Errorf("attestation has no IMA event log, quote with --include-ima")
+		}
+
+		allowlist, err := internal.LoadIMAAllowlist(imaAllowlistPath)
+		if err != nil {
+			return err
+		}
+
+		err = allowlist.Check(ev.imaEntries, internal.IMACheckOptions{
+			PCRs:            attestation.PCRs,
+			Hash:            ev.hash,
+			AllowViolations: imaAllowViolations,
+		})
+		if err != nil {
+			return fmt.Errorf("IMA allowlist check failed: %w", err)
+		}
 	}
 
-	pemBlock, _ := pem.Decode(intermediateCA)
-	intermediate, err := x509.ParseCertificate(pemBlock.Bytes)
-	if err != nil {
-		return fmt.Errorf("couldn't parse intermediate CA: %w", err)
+	// Claims are only affirmed if their measurements were compared, e.g. the
+	// configuration if the kernel command line or PCR 8 was
+	var executablesAppraised, configurationAppraised, fileSystemAppraised bool
+	if policy != nil {
+		err = policy.Evaluate(&internal.PolicyInput{
+			PCRs:         attestation.PCRs,
+			QuotedPCRs:   ev.quotedPCRs,
+			Nonce:        ev.quote.ExtraData,
+			Clock:        ev.clock,
+			AKCert:       ev.akCert,
+			BootEventLog: ev.bootEventLog,
+			VerityEvents: internal.VerityEvents(attestation.VerityEventLog),
+			VerityHash:   ev.verityHash,
+			IMAEntries:   ev.imaEntries,
+			Containers:   ev.containerEntries,
+			SecureBoot:   ev.secureBoot,
+			SNPReport:    ev.snpReport,
+			TDXQuote:     ev.tdxQuote,
+		})
+		var ruleErr *internal.PolicyRuleError
+		if errors.As(err, &ruleErr) {
+			appraising = ruleErr.Rule.TrustClaim
+		}
+		if err != nil {
+			return fmt.Errorf("policy evaluation failed: %w", err)
+		}
+		executablesAppraised = policy.Appraises(internal.TrustClaimExecutables)
+		configurationAppraised = policy.Appraises(internal.TrustClaimConfiguration)
+		fileSystemAppraised = policy.Appraises(internal.TrustClaimFileSystem)
+	} else if refValuesStore != nil {
+		// Any image of the store may have been booted, e.g. during a rollout
+		appraising = internal.TrustClaimExecutables
+		measurements := &internal.Measurements{
+			PCRs:          attestation.PCRs,
+			VerityHash:    ev.verityHash,
+			KernelCmdline: ev.bootEventLog.KernelCmdline(),
+		}
+		// Sets asserting the kernel or initramfs report why they're missing
+		_, measurements.Kernel, measurements.KernelError = ev.bootEventLog.GrubLoadedFile("linux")
+		_, measurements.Initramfs, measurements.InitramfsError = ev.bootEventLog.GrubLoadedFile("initrd")
+
+		matchTime := ev.currentTime
+		if matchTime.IsZero() {
+			matchTime = time.Now()
+		}
+
+		if refValuesStore.Revocations != nil {
+			err = refValuesStore.Revocations.CheckFresh(matchTime)
+			if err != nil {
+				return fmt.Errorf("reference value revocation check failed: %w", err)
+			}
+		}
+
+		refValues, err := refValuesStore.Match(measurements, matchTime)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Booted image: %s", refValues.Image())
+		executablesAppraised = refValues.AppraisesExecutables()
+		configurationAppraised = refValues.AppraisesConfiguration()
+		fileSystemAppraised = refValues.AppraisesFileSystem()
+		if debugLogging {
+			log.Printf("Reference values: %s", refValues.Path)
+			if producer := refValues.Producer; producer != nil {
+				log.Printf("Reference values produced by %s, commit %s", producer.GetUri(), producer.GetDigest()["gitCommit"])
+			}
+		}
+
+		// Every container started in the VM must run a known image
+		for _, entry := range ev.containerEntries {
+			containerRefValues, err := refValuesStore.MatchContainer(&entry.Event, matchTime)
+			if err != nil {
+				return fmt.Errorf("container event %d: %w", entry.Sequence, err)
+			}
+
+			log.Printf("Started container: %s", containerRefValues.Image())
+			if debugLogging {
+				log.Printf("Container reference values: %s", containerRefValues.Path)
+			}
+		}
+	} else {
+		if len(ev.containerEntries) > 0 {
+			log.Printf("WARNING: container images not verified, set --ref-values-store or --policy to verify them")
+		}
+
+		appraising = internal.TrustClaimFileSystem
+		if !bytes.Equal(ev.verityHash, verityRootHash) {
+			return fmt.Errorf("verity hash mismatch, expected %x, got %x", verityRootHash, ev.verityHash)
+		}
+		fileSystemAppraised = true
+
+		// The kernel command line is measured into PCR 8, so the expected PCRs
+		// cover the configuration too
+		appraising = internal.TrustClaimExecutables
+		attestationPcrs := make(map[int][]byte)
+		for _, pcr := range attestation.PCRs {
+			attestationPcrs[pcr.Index] = pcr.Value
+		}
+
+		for _, expectedPcr := range expectedPcrs.PCRs {
+			if attestedPcr, ok := attestationPcrs[expectedPcr.Index]; !ok {
+				return fmt.Errorf("PCR %d missing from attestation", expectedPcr.Index)
+			} else if !bytes.Equal(expectedPcr.Value, attestedPcr) {
+				return fmt.Errorf("PCR %d value mismatch", expectedPcr.Index)
+			}
+			if slices.Contains(internal.ExecutablesPCRs, expectedPcr.Index) {
+				executablesAppraised = true
+			}
+			if expectedPcr.Index == internal.KernelCmdlinePCR {
+				configurationAppraised = true
+			}
+		}
 	}
 
-	roots := x509.NewCertPool()
-	roots.AddCert(intermediate)
+	claims := []struct {
+		claim     internal.TrustClaim
+		appraised bool
+		missing   string
+	}{
+		{internal.TrustClaimExecutables, executablesAppraised, "neither the kernel, the initramfs nor PCR 4 or 9 was compared"},
+		{internal.TrustClaimConfiguration, configurationAppraised, "neither the kernel command line nor PCR 8 was compared"},
+		{internal.TrustClaimFileSystem, fileSystemAppraised, "the verity root hash wasn't compared"},
+	}
+	for _, claim := range claims {
+		if claim.appraised {
+			result.Affirm(claim.claim)
+		} else if debugLogging && policy != nil {
+			log.Printf("%s not appraised, no policy rule appraises it", claim.claim)
+		} else if debugLogging {
+			log.Printf("%s not appraised, %s", claim.claim, claim.missing)
+		}
+	}
+	appraising = ""
 
-	// Validate the AK certificate from Azure VM vs the Azure vTPM intermediate CA
-	_, err = akCert.Verify(x509.VerifyOptions{
-		Roots:     roots,
-		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
-	})
+	// Only record the clock once the attestation is known to be good
+	if ev.clockState != nil {
+		ev.clockState.AKs[ev.akKeyID] = ev.clock
+		err = ev.clockState.Save(clockStatePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Attestation verified successfully")
+
+	// TODO:
+	//   - Validate grub, kernel, initramfs hashes from boot event log
+	//   - Validate kernel command line to make sure it's not using break=
+	// ^-- These are optional since we are validating the PCRs exactly, but
+	//     they are good to have for extra validation.
+
+	return nil
+}
+
+// evidence is an attestation whose AK, quote, hardware reports and event logs
+// were verified, ready to be compared with reference values
+type evidence struct {
+	akCert           *x509.Certificate
+	currentTime      time.Time
+	quote            *tpm2.AttestationData
+	quotedPCRs       []int
+	hash             crypto.Hash
+	clock            internal.ClockObservation
+	clockState       *internal.ClockState
+	akKeyID          string
+	verityHash       []byte
+	bootEventLog     *internal.EventLog
+	secureBoot       *internal.SecureBootState
+	imaEntries       []internal.IMAEntry
+	containerEntries []internal.ContainerLogEntry
+	snpReport        *internal.SNPReport
+	tdxQuote         *internal.TDXQuote
+}
+
+// evidenceOptions are the checks of verifyEvidence that depend on how the
+// evidence is appraised
+type evidenceOptions struct {
+	// checkQuotedPCRs requires exactly the PCRs the attestation's logs cover
+	// to be quoted, unless a policy checks them instead
+	checkQuotedPCRs bool
 
+	// requireContainers requires the container PCR to be quoted
+	requireContainers bool
+
+	// secureBoot decodes the Secure Boot state even if neither boot
+	// revocations nor debug logging need it
+	secureBoot bool
+}
+
+// verifyEvidence verifies everything in the attestation that doesn't depend on
+// reference values: the AK certificate, its revocation and public area, the
+// quote, the SEV-SNP report and TDX quote, the TPM clock, the quoted PCRs and
+// the verity, boot, IMA and container event logs, and boot revocations. Both
+// verify and ref-values --from-attestation run it. It records the claim being
+// appraised in appraising and affirms the instance identity in result.
+func verifyEvidence(attestation *internal.Attestation, opts evidenceOptions, result *internal.AttestationResult, appraising *internal.TrustClaim) (*evidence, error) {
+	// Extract AK cert from attestation
+	*appraising = internal.TrustClaimInstanceIdentity
+	if len(attestation.AkCert) == 0 {
+		return nil, fmt.Errorf("attestation has no AK certificate, certify the AK with activate-credential")
+	}
+	akCert, err := x509.ParseCertificate(attestation.AkCert)
 	if err != nil {
-		return fmt.Errorf("couldn't verify AK certificate: %w", err)
+		return nil, fmt.Errorf("couldn't parse AK certificate: %w", err)
 	}
 
-	buf := bytes.NewBuffer(attestation.QuoteSignature)
-	sig, err := tpm2.DecodeSignature(buf)
+	// Validate the AK certificate from the VM vs the vTPM CA chain
+	akChains, akCertOpts, err := verifyAKCertChain(akCert)
 	if err != nil {
-		return fmt.Errorf("couldn't parse quote signature: %w", err)
+		return nil, err
 	}
 
-	if sig.Alg != tpm2.AlgRSASSA {
-		return fmt.Errorf("only RSASSA is supported")
+	if debugLogging {
+		for _, cert := range akChains[0] {
+			log.Printf("AK chain: %s", cert.Subject)
+		}
 	}
 
-	hash, err := sig.RSA.HashAlg.Hash()
-	if err != nil {
-		return fmt.Errorf("couldn't get hash algorithm: %w", err)
+	if checkRevocation || len(crlPaths) > 0 || crlCacheDir != "" {
+		crls, err := internal.LoadCRLs(crlPaths)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load CRLs: %w", err)
+		}
+
+		revocationChecker := internal.RevocationChecker{
+			CRLs:        crls,
+			CacheDir:    crlCacheDir,
+			Offline:     offline,
+			CurrentTime: akCertOpts.CurrentTime,
+		}
+		err = revocationChecker.CheckChain(akChains[0])
+		if err != nil {
+			return nil, fmt.Errorf("AK certificate revocation check failed: %w", err)
+		}
 	}
 
-	hasher := hash.New()
-	hasher.Write(attestation.QuoteData)
+	// Check that the certified key is a restricted signing key that can't leave
+	// the TPM
+	err = checkAKPublic(attestation, akCert)
+	if err != nil {
+		return nil, err
+	}
 
 	// Verify that the quote signature is valid and matches the pubkey in the AK certificate
-	err = rsa.VerifyPKCS1v15(akCert.PublicKey.(*rsa.PublicKey), hash, hasher.Sum(nil), sig.RSA.Signature)
+	quote, err := verifyQuoteSignature(akCert.PublicKey, attestation.QuoteData, attestation.QuoteSignature)
 	if err != nil {
-		return fmt.Errorf("quote signature verification failed: %w", err)
+		return nil, err
 	}
 
-	quote, err := tpm2.DecodeAttestationData(attestation.QuoteData)
-	if err != nil {
-		return fmt.Errorf("couldn't parse quote: %w", err)
+	result.Nonce = quote.ExtraData
+
+	// Verify the SEV-SNP report that binds the AK to the confidential VM
+	var snpReport *internal.SNPReport
+	if snpCertChainPath != "" {
+		snpReport, err = verifySNPReport(attestation.HCLReport, akCert.PublicKey, akCertOpts.CurrentTime)
+		if err != nil {
+			return nil, fmt.Errorf("SEV-SNP report verification failed: %w", err)
+		}
+
+		if debugLogging {
+			log.Printf("SNP measurement: %x", snpReport.Measurement)
+			log.Printf("SNP reported TCB: %s", snpReport.ReportedTCB)
+		}
 	}
 
-	if quote.Type != tpm2.TagAttestQuote {
-		return fmt.Errorf("attested data type is not a quote")
+	// Verify the TDX quote that binds the AK to the trust domain
+	var tdxQuote *internal.TDXQuote
+	if tdxQuotePath != "" {
+		tdxQuote, err = verifyTDXQuote(attestation.HCLReport, akCert.PublicKey, akCertOpts.CurrentTime)
+		if err != nil {
+			return nil, fmt.Errorf("TDX quote verification failed: %w", err)
+		}
+
+		if debugLogging {
+			log.Printf("TDX MRTD: %x", tdxQuote.MRTD)
+		}
+	}
+
+	if snpReport == nil && tdxQuote == nil && len(attestation.HCLReport) > 0 {
+		log.Printf("WARNING: HCL report not verified, set --snp-cert-chain-path or --tdx-quote-path to verify it")
 	}
 
 	if debugLogging {
 		log.Printf("Nonce: %x", quote.ExtraData)
+		log.Printf("Clock: %+v, firmware version: %x", quote.ClockInfo, quote.FirmwareVersion)
+	}
+
+	// Compare the TPM clock and counters with earlier quotes from the same AK
+	clockObservation := internal.NewClockObservation(quote)
+	clockOpts := internal.ClockCheckOptions{
+		FailOnReset: failOnReset,
+		AllowUnsafe: allowUnsafeClock,
+	}
+
+	if referenceAttestation != "" {
+		referenceBytes, err := os.ReadFile(referenceAttestation)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read reference attestation: %w", err)
+		}
+
+		reference, err := internal.ParseAttestation(referenceBytes, true)
+		if err != nil {
+			return nil, fmt.Errorf("reference attestation: %w", err)
+		}
+
+		if !bytes.Equal(reference.AkCert, attestation.AkCert) {
+			return nil, fmt.Errorf("reference attestation is from a different AK")
+		}
+
+		referenceQuote, err := verifyQuoteSignature(akCert.PublicKey, reference.QuoteData, reference.QuoteSignature)
+		if err != nil {
+			return nil, fmt.Errorf("reference attestation: %w", err)
+		}
+
+		warnings, err := internal.CheckClock(internal.NewClockObservation(referenceQuote), clockObservation, clockOpts)
+		if err != nil {
+			return nil, fmt.Errorf("TPM clock check against reference attestation failed: %w", err)
+		}
+		for _, warning := range warnings {
+			log.Printf("WARNING: %s since the reference attestation", warning)
+		}
 	}
 
+	var clockState *internal.ClockState
+	akKeyID := internal.AKKeyID(akCert)
+	if clockStatePath != "" {
+		clockState, err = internal.LoadClockState(clockStatePath)
+		if err != nil {
+			return nil, err
+		}
+
+		if previous, ok := clockState.AKs[akKeyID]; ok {
+			warnings, err := internal.CheckClock(previous, clockObservation, clockOpts)
+			if err != nil {
+				return nil, fmt.Errorf("TPM clock check against observation at %s failed: %w", previous.ObservedAt.Format(time.RFC3339), err)
+			}
+			for _, warning := range warnings {
+				log.Printf("WARNING: %s since %s", warning, previous.ObservedAt.Format(time.RFC3339))
+			}
+		} else if !clockObservation.Safe && !allowUnsafeClock {
+			return nil, fmt.Errorf("TPM clock check failed: TPM clock is not safe")
+		}
+	}
+
+	result.Affirm(internal.TrustClaimInstanceIdentity)
+
 	// Validate that the PCRs in the quote match our expected PCRs of 0-9, 11
+	*appraising = internal.TrustClaimExecutables
 	PCRsCopy := make([]int, len(quote.AttestedQuoteInfo.PCRSelection.PCRs))
 	copy(PCRsCopy, quote.AttestedQuoteInfo.PCRSelection.PCRs)
 	sort.Slice(PCRsCopy, func(i, j int) bool {
 		return PCRsCopy[i] < PCRsCopy[j]
 	})
 
-	if !reflect.DeepEqual(PCRsCopy, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11}) {
-		return fmt.Errorf("unexpected PCRs (expected 0-9, 11): %w", PCRsCopy)
+	expectedQuotedPCRs := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11}
+	if len(attestation.IMAEventLog) > 0 {
+		expectedQuotedPCRs = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, internal.IMAPCR, 11}
+	}
+	// The container PCR is quoted even before the first container starts
+	containersQuoted := len(attestation.ContainerEventLog) > 0 || slices.Contains(PCRsCopy, internal.ContainerPCR)
+	if containersQuoted {
+		expectedQuotedPCRs = append(expectedQuotedPCRs, internal.ContainerPCR)
+	} else if opts.requireContainers {
+		// Otherwise an attester could hide unknown containers by not quoting
+		// their PCR
+		return nil, fmt.Errorf("attestation doesn't quote the container PCR %d, quote with --include-containers", internal.ContainerPCR)
+	}
+	if opts.checkQuotedPCRs && !reflect.DeepEqual(PCRsCopy, expectedQuotedPCRs) {
+		return nil, fmt.Errorf("unexpected PCRs (expected %v): %v", expectedQuotedPCRs, PCRsCopy)
 	}
 
 	// Validate that the PCR values in the quote match the attestation document
-	PCRValuesCopy := make([]internal.PCRValue, len(attestation.PCRs))
-	copy(PCRValuesCopy, attestation.PCRs)
+	hash, err := verifyPCRDigest(quote, attestation.PCRs)
+	if err != nil {
+		return nil, err
+	}
+
+	// At this point we know that:
+	//    - The AK certificate is valid
+	//    - The AK key was used to sign the quote
+	//    - The quote is a valid TPM quote
+	//    - The PCRs in the quote match the attestation document
+	//    - The PCR indices in the quote and attestation match our expectations
+	//      (or are left to the policy)
+	//
+	// All the crypto shenanigans are now done, and we can start to validate the
+	// contents of the event logs.
+
+	idx := slices.IndexFunc(attestation.PCRs, func(pcr internal.PCRValue) bool {
+		return pcr.Index == 11
+	})
+	if idx == -1 {
+		return nil, fmt.Errorf("no PCR 11 value found")
+	}
+
+	*appraising = internal.TrustClaimFileSystem
+	verityHash, err := validateVerityEventLog(attestation.VerityEventLog, attestation.PCRs[idx], hash)
+	if err != nil {
+		return nil, fmt.Errorf("verity event log validation failed: %w", err)
+	}
+
+	if debugLogging {
+		log.Printf("verity hash: %x", verityHash)
+	}
+
+	*appraising = internal.TrustClaimExecutables
+	bootEventLog, err := internal.ParseEventLog(attestation.BootEventLog)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse boot event log: %w", err)
+	}
+
+	err = bootEventLog.Verify(quote.AttestedQuoteInfo.PCRSelection.Hash, attestation.PCRs)
+	if err != nil {
+		return nil, fmt.Errorf("boot event log validation failed: %w", err)
+	}
+
+	// Decode the Secure Boot state from the verified PCR 7 events
+	var secureBoot *internal.SecureBootState
+	if opts.secureBoot || bootRevocationsPath != "" || debugLogging {
+		secureBoot, err = bootEventLog.SecureBoot()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode Secure Boot state: %w", err)
+		}
+
+		if debugLogging {
+			logSecureBoot(secureBoot)
+		}
+	}
+
+	// Reject boot chains revoked by dbx or SBAT
+	if bootRevocationsPath != "" {
+		revocations, err := internal.LoadBootRevocationList(bootRevocationsPath)
+		if err != nil {
+			return nil, err
+		}
+
+		err = revocations.Check(secureBoot)
+		if err != nil {
+			return nil, fmt.Errorf("boot revocation check failed: %w", err)
+		}
+	}
+
+	// Replay the IMA log up to the quoted PCR 10 value and check the measured
+	// files
+	var imaEntries []internal.IMAEntry
+	if len(attestation.IMAEventLog) > 0 {
+		imaEntries, err = verifyIMAEventLog(attestation.IMAEventLog, attestation.PCRs, hash)
+		if err != nil {
+			return nil, fmt.Errorf("IMA event log validation failed: %w", err)
+		}
+
+		if debugLogging {
+			log.Printf("IMA entries: %d", len(imaEntries))
+		}
+	}
+
+	// Replay the container event log up to the quoted PCR 13 value
+	var containerEntries []internal.ContainerLogEntry
+	if containersQuoted {
+		containerEntries, err = verifyContainerEventLog(attestation.ContainerEventLog, attestation.PCRs, hash)
+		if err != nil {
+			return nil, fmt.Errorf("container event log validation failed: %w", err)
+		}
+
+		if debugLogging {
+			for _, entry := range containerEntries {
+				log.Printf("Container event %d: %s", entry.Sequence, entry.Data)
+			}
+		}
+	}
+
+	return &evidence{
+		akCert:           akCert,
+		currentTime:      akCertOpts.CurrentTime,
+		quote:            quote,
+		quotedPCRs:       PCRsCopy,
+		hash:             hash,
+		clock:            clockObservation,
+		clockState:       clockState,
+		akKeyID:          akKeyID,
+		verityHash:       verityHash,
+		bootEventLog:     bootEventLog,
+		secureBoot:       secureBoot,
+		imaEntries:       imaEntries,
+		containerEntries: containerEntries,
+		snpReport:        snpReport,
+		tdxQuote:         tdxQuote,
+	}, nil
+}
+
+// verifyAKCertChain validates the AK certificate against the trusted roots and
+// intermediates, and returns its chains and the options it was checked with
+func verifyAKCertChain(akCert *x509.Certificate) ([][]*x509.Certificate, internal.AKCertOptions, error) {
+	akCertOpts := internal.AKCertOptions{}
+
+	// Get the trusted roots and intermediates
+	trustStore, err := internal.LoadTrustStore(rootCAPemPaths, intermediateCAPemPaths)
+	if err != nil {
+		return nil, akCertOpts, fmt.Errorf("couldn't load trust store: %w", err)
+	}
+
+	if verificationTime != "" {
+		akCertOpts.CurrentTime, err = time.Parse(time.RFC3339, verificationTime)
+		if err != nil {
+			return nil, akCertOpts, fmt.Errorf("couldn't parse verification time: %w", err)
+		}
+	}
+
+	for _, eku := range akEKUs {
+		oid, err := internal.ParseOID(eku)
+		if err != nil {
+			return nil, akCertOpts, fmt.Errorf("couldn't parse AK EKU: %w", err)
+		}
+		akCertOpts.RequiredEKUs = append(akCertOpts.RequiredEKUs, oid)
+	}
+
+	akChains, err := trustStore.VerifyAKCert(akCert, akCertOpts)
+	if err != nil {
+		return nil, akCertOpts, fmt.Errorf("couldn't verify AK certificate: %w", err)
+	}
+
+	return akChains, akCertOpts, nil
+}
+
+// checkAKPublic checks the AK public area of the attestation against the AK
+// certificate, unless it's missing and --allow-missing-ak-public is set
+func checkAKPublic(attestation *internal.Attestation, akCert *x509.Certificate) error {
+	if len(attestation.AkPublic) == 0 {
+		if !allowMissingAKPublic {
+			return fmt.Errorf("attestation has no AK public area, set --allow-missing-ak-public to accept it")
+		}
+		log.Printf("WARNING: the attestation has no AK public area, the AK attributes weren't checked")
+		return nil
+	}
+
+	akName, err := internal.CheckAKPublic(attestation.AkPublic, akCert.PublicKey)
+	if err != nil {
+		return fmt.Errorf("AK public area check failed: %w", err)
+	}
+
+	if debugLogging {
+		log.Printf("AK name: %x", akName)
+	}
+	return nil
+}
+
+// verifyPCRDigest checks that the PCR values of the attestation are labeled
+// with the quoted PCR selection and hash to the quoted PCR digest, and returns
+// the hash of the quoted PCR bank
+func verifyPCRDigest(quote *tpm2.AttestationData, pcrs []internal.PCRValue) (crypto.Hash, error) {
+	err := internal.CheckPCRSelection(quote.AttestedQuoteInfo.PCRSelection.PCRs, pcrs)
+	if err != nil {
+		return 0, err
+	}
+
+	PCRValuesCopy := make([]internal.PCRValue, len(pcrs))
+	copy(PCRValuesCopy, pcrs)
 	sort.Slice(PCRValuesCopy, func(i, j int) bool {
 		return PCRValuesCopy[i].Index < PCRValuesCopy[j].Index
 	})
 
-	hash, err = quote.AttestedQuoteInfo.PCRSelection.Hash.Hash()
+	hash, err := quote.AttestedQuoteInfo.PCRSelection.Hash.Hash()
 	if err != nil {
-		return fmt.Errorf("couldn't get PCR hash algorithm: %w", err)
+		return 0, fmt.Errorf("couldn't get PCR hash algorithm: %w", err)
 	}
-	hasher = hash.New()
+	hasher := hash.New()
 	for _, pcr := range PCRValuesCopy {
 		hasher.Write(pcr.Value)
 	}
@@ -225,73 +1114,311 @@ func verifyQuote(_ *cobra.Command, args []string) error {
 	if !reflect.DeepEqual(pcrHash, []byte(quote.AttestedQuoteInfo.PCRDigest)) {
 		log.Printf("PCR digest mismatch!")
 		log.Printf("\tcalculated: %x", pcrHash)
-		return fmt.Errorf("\tquoted:     %x", quote.AttestedQuoteInfo.PCRDigest)
+		return 0, fmt.Errorf("\tquoted:     %x", quote.AttestedQuoteInfo.PCRDigest)
 	}
 
 	if debugLogging {
 		log.Printf("PCR digest: %x", pcrHash)
 	}
 
-	// At this point we know that:
-	//    - The AK certificate is valid
-	//    - The AK key was used to sign the quote
-	//    - The quote is a valid TPM quote
-	//    - The PCRs in the quote match the attestation document
-	//    - The PCR indices in the quote and attestation match our expectations
-	//
-	// All the crypto shenanigans are now done, and we can start to validate the
-	// contents of the event logs.
+	return hash, nil
+}
 
-	idx := slices.IndexFunc(attestation.PCRs, func(pcr internal.PCRValue) bool {
-		return pcr.Index == 11
-	})
-	if idx == -1 {
-		return fmt.Errorf("no PCR 11 value found")
+// verifySNPReport validates the SEV-SNP report in an HCL report and checks
+// that it binds the AK
+func verifySNPReport(hclReportBytes []byte, akPub crypto.PublicKey, currentTime time.Time) (*internal.SNPReport, error) {
+	if len(hclReportBytes) == 0 {
+		return nil, fmt.Errorf("attestation has no HCL report")
 	}
 
-	verityHash, err := validateVerityEventLog(attestation.VerityEventLog, attestation.PCRs[idx], hash)
+	hclReport, err := internal.ParseHCLReport(hclReportBytes)
 	if err != nil {
-		return fmt.Errorf("verity event log validation failed: %w", err)
+		return nil, err
+	}
+	if hclReport.Type != internal.HCLReportTypeSNP {
+		return nil, fmt.Errorf("HCL report type %d is not an SEV-SNP report", hclReport.Type)
 	}
 
-	if !bytes.Equal(verityHash, verityRootHash) {
-		return fmt.Errorf("verity hash mismatch, expected %x, got %x", verityRootHash, verityHash)
+	snpReport, err := internal.ParseSNPReport(hclReport.HWReport)
+	if err != nil {
+		return nil, err
 	}
 
-	if debugLogging {
-		log.Printf("verity hash: %x", verityHash)
+	certs, err := internal.LoadSNPCertificates(snpCertChainPath, snpVCEKPath)
+	if err != nil {
+		return nil, err
 	}
 
-	attestationPcrs := make(map[int][]byte)
-	for _, pcr := range attestation.PCRs {
-		attestationPcrs[pcr.Index] = pcr.Value
+	opts := internal.SNPCheckOptions{
+		AllowDebug:      snpAllowDebug,
+		ARKFingerprints: snpARKFingerprints,
+		CurrentTime:     currentTime,
+	}
+	if snpMeasurementHex != "" {
+		opts.Measurement, err = hex.DecodeString(snpMeasurementHex)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode SNP measurement: %w", err)
+		}
 	}
 
-	for _, expectedPcr := range expectedPcrs.PCRs {
-		if attestedPcr, ok := attestationPcrs[expectedPcr.Index]; !ok {
-			return fmt.Errorf("PCR %d missing from attestation", expectedPcr.Index)
-		} else if !bytes.Equal(expectedPcr.Value, attestedPcr) {
-			return fmt.Errorf("PCR %d value mismatch", expectedPcr.Index)
+	err = snpReport.Verify(certs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hclReport.CheckReportData(snpReport.ReportData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hclReport.CheckAKBinding(akPub)
+	if err != nil {
+		return nil, err
+	}
+
+	return snpReport, nil
+}
+
+// verifyTDXQuote validates a TDX quote and checks that its report data binds
+// the HCL report, and that the HCL report carries the AK
+func verifyTDXQuote(hclReportBytes []byte, akPub crypto.PublicKey, currentTime time.Time) (*internal.TDXQuote, error) {
+	if len(hclReportBytes) == 0 {
+		return nil, fmt.Errorf("attestation has no HCL report")
+	}
+
+	hclReport, err := internal.ParseHCLReport(hclReportBytes)
+	if err != nil {
+		return nil, err
+	}
+	if hclReport.Type != internal.HCLReportTypeTDX {
+		return nil, fmt.Errorf("HCL report type %d is not a TDX report", hclReport.Type)
+	}
+
+	quoteBytes, err := os.ReadFile(tdxQuotePath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read TDX quote: %w", err)
+	}
+
+	tdxQuote, err := internal.ParseTDXQuote(quoteBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := internal.LoadTrustStore(tdxRootCAPaths, nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load Intel root CAs: %w", err)
+	}
+
+	if tdxQEIdentityPath == "" || tdxQEIdentityChainPath == "" {
+		return nil, fmt.Errorf("--tdx-qe-identity and --tdx-qe-identity-issuer-chain are required with --tdx-quote-path")
+	}
+	qeIdentity, err := internal.LoadTDXQEIdentity(tdxQEIdentityPath, tdxQEIdentityChainPath, roots.Roots, currentTime)
+	if err != nil {
+		return nil, err
+	}
+
+	pckCRLs, err := internal.LoadCRLs(tdxPCKCRLPaths)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load PCK CRLs: %w", err)
+	}
+
+	opts := internal.TDXCheckOptions{
+		Roots: roots.Roots,
+		PCKRevocation: &internal.RevocationChecker{
+			CRLs:        pckCRLs,
+			CacheDir:    crlCacheDir,
+			Offline:     offline,
+			CurrentTime: currentTime,
+		},
+		QEIdentity:  qeIdentity,
+		AllowDebug:  tdxAllowDebug,
+		CurrentTime: currentTime,
+		RTMRs:       make(map[int][]byte),
+	}
+	if tdxMRTDHex != "" {
+		opts.MRTD, err = hex.DecodeString(tdxMRTDHex)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode MRTD: %w", err)
+		}
+	}
+	for _, rtmr := range tdxRTMRs {
+		indexStr, valueHex, ok := strings.Cut(rtmr, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed RTMR %q, expected index=hex", rtmr)
+		}
+		index, err := strconv.Atoi(indexStr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed RTMR index %q: %w", indexStr, err)
+		}
+		opts.RTMRs[index], err = hex.DecodeString(valueHex)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode RTMR%d: %w", index, err)
 		}
 	}
 
-	log.Printf("Attestation verified successfully")
+	err = tdxQuote.Verify(opts)
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO:
-	//   - Validate grub, kernel, initramfs hashes from boot event log
-	//   - Validate kernel command line to make sure it's not using break=
-	// ^-- These are optional since we are validating the PCRs exactly, but
-	//     they are good to have for extra validation.
+	err = hclReport.CheckReportData(tdxQuote.ReportData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hclReport.CheckAKBinding(akPub)
+	if err != nil {
+		return nil, err
+	}
+
+	return tdxQuote, nil
+}
+
+// writeEAR signs the attestation result and writes it to --result-output or
+// stdout
+func writeEAR(result *internal.AttestationResult, key crypto.Signer) error {
+	ear, err := result.SignEAR(key, "image-attestation verify", time.Now())
+	if err != nil {
+		return err
+	}
+
+	if resultOutputPath == "" {
+		fmt.Println(ear)
+		return nil
+	}
+
+	err = os.WriteFile(resultOutputPath, []byte(ear+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't write EAR: %w", err)
+	}
 
 	return nil
 }
 
-func validateVerityEventLog(verityLog []byte, pcrValue internal.PCRValue, hash crypto.Hash) ([]byte, error) {
-	verityString := string(verityLog[:])
-	verityLogs := strings.Split(verityString, "\n")
-	verityLogs = slices.DeleteFunc(verityLogs, func(s string) bool {
-		return s == ""
+// verifyQuoteSignature checks the TPMT_SIGNATURE over the TPMS_ATTEST with
+// the AK public key and decodes the quote
+func verifyQuoteSignature(akPub crypto.PublicKey, quoteData []byte, quoteSignature []byte) (*tpm2.AttestationData, error) {
+	buf := bytes.NewBuffer(quoteSignature)
+	sig, err := tpm2.DecodeSignature(buf)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse quote signature: %w", err)
+	}
+
+	if sig.Alg != tpm2.AlgRSASSA {
+		return nil, fmt.Errorf("only RSASSA is supported")
+	}
+
+	rsaPub, ok := akPub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("AK public key is not an RSA key")
+	}
+
+	hash, err := sig.RSA.HashAlg.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get hash algorithm: %w", err)
+	}
+
+	hasher := hash.New()
+	hasher.Write(quoteData)
+
+	err = rsa.VerifyPKCS1v15(rsaPub, hash, hasher.Sum(nil), sig.RSA.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("quote signature verification failed: %w", err)
+	}
+
+	quote, err := tpm2.DecodeAttestationData(quoteData)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse quote: %w", err)
+	}
+
+	if quote.Type != tpm2.TagAttestQuote {
+		return nil, fmt.Errorf("attested data type is not a quote")
+	}
+
+	return quote, nil
+}
+
+func logSecureBoot(state *internal.SecureBootState) {
+	log.Printf("Secure Boot enabled: %t", state.Enabled)
+	databases := []struct {
+		name       string
+		signatures []internal.EFISignature
+	}{
+		{"PK", state.PK},
+		{"KEK", state.KEK},
+		{"db", state.DB},
+		{"dbx", state.DBX},
+	}
+	for _, db := range databases {
+		log.Printf("%s: %d entries", db.name, len(db.signatures))
+		for _, signature := range db.signatures {
+			if signature.Certificate != nil {
+				log.Printf("\t%s", signature.Subject())
+			}
+		}
+	}
+
+	for _, component := range state.Components {
+		authority := "authority logged earlier"
+		if component.Authority != nil {
+			authority = fmt.Sprintf("%s (%s)", component.Authority.Signature.Subject(), component.Authority.Variable)
+		}
+		log.Printf("Boot component %x: %s", component.Digest, authority)
+	}
+
+	if state.SbatLevel != "" {
+		log.Printf("SBAT level: %q", state.SbatLevel)
+	}
+}
+
+// verifyIMAEventLog replays the IMA log against the quoted PCR 10 and returns
+// the entries the quote covers
+func verifyIMAEventLog(imaLog []byte, pcrs []internal.PCRValue, hash crypto.Hash) ([]internal.IMAEntry, error) {
+	idx := slices.IndexFunc(pcrs, func(pcr internal.PCRValue) bool {
+		return pcr.Index == internal.IMAPCR
+	})
+	if idx == -1 {
+		return nil, fmt.Errorf("no PCR %d value found", internal.IMAPCR)
+	}
+
+	parsed, err := internal.ParseIMALog(imaLog)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse IMA event log: %w", err)
+	}
+
+	count, err := parsed.Verify(hash, pcrs[idx].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed.Entries[:count], nil
+}
+
+// verifyContainerEventLog replays the container event log against the quoted
+// PCR 13 and returns the events the quote covers
+func verifyContainerEventLog(containerLog []byte, pcrs []internal.PCRValue, hash crypto.Hash) ([]internal.ContainerLogEntry, error) {
+	idx := slices.IndexFunc(pcrs, func(pcr internal.PCRValue) bool {
+		return pcr.Index == internal.ContainerPCR
 	})
+	if idx == -1 {
+		return nil, fmt.Errorf("no PCR %d value found", internal.ContainerPCR)
+	}
+
+	parsed, err := internal.ParseContainerLog(containerLog)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := parsed.Verify(hash, pcrs[idx].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed.Entries[:count], nil
+}
+
+func validateVerityEventLog(verityLog []byte, pcrValue internal.PCRValue, hash crypto.Hash) ([]byte, error) {
+	verityLogs := internal.VerityEvents(verityLog)
 
 	if len(verityLogs) != 4 {
 		return nil, fmt.Errorf("unexpected number of verity logs: %d", len(verityLogs))
@@ -1,12 +1,97 @@
 package internal
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// AttestationAPIVersion is the version of the attestation document format
+	// written by quote. Documents without an apiVersion are the original,
+	// unversioned format and are upgraded when decoded.
+	AttestationAPIVersion = "image-attestation.chkimes.github.com/v1"
+	AttestationKind       = "TPMAttestation"
+)
+
+// Evidence types and the media types of their contents
+const (
+	EvidenceAKCert            = "akCert"
+	EvidenceAKPublic          = "akPublic"
+	EvidenceEKCert            = "ekCert"
+	EvidenceQuote             = "quote"
+	EvidenceBootEventLog      = "bootEventLog"
+	EvidenceVerityEventLog    = "verityEventLog"
+	EvidenceIMAEventLog       = "imaEventLog"
+	EvidenceHCLReport         = "hclReport"
+	EvidenceAKCreationData    = "akCreationData"
+	EvidenceAKCreationTicket  = "akCreationTicket"
+	EvidenceContainerEventLog = "containerEventLog"
+)
+
+var evidenceMediaTypes = map[string]string{
+	EvidenceAKCert:            "application/pkix-cert",
+	EvidenceAKPublic:          "application/vnd.tcg.tpmt-public",
+	EvidenceEKCert:            "application/pkix-cert",
+	EvidenceQuote:             "application/vnd.tcg.tpms-attest",
+	EvidenceBootEventLog:      "application/vnd.tcg.pc-client-eventlog",
+	EvidenceVerityEventLog:    "text/plain",
+	EvidenceIMAEventLog:       "application/vnd.linux.ima-binary-runtime-measurements",
+	EvidenceHCLReport:         "application/vnd.microsoft.hcl-report",
+	EvidenceAKCreationData:    "application/vnd.tcg.tpms-creation-data",
+	EvidenceAKCreationTicket:  "application/vnd.tcg.tpmt-tk-creation",
+	EvidenceContainerEventLog: "application/x-ndjson",
+}
+
 type Attestation struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	TPM        *TPMInfo             `json:"tpm,omitempty"`
+	Platform   *PlatformInfo        `json:"platform,omitempty"`
+	HashBanks  []string             `json:"hashBanks"`
+	Evidence   []EvidenceDescriptor `json:"evidence"`
+
 	AkCert         []byte     `json:"akCert"` // DER
 	BootEventLog   []byte     `json:"bootEventLog"`
 	VerityEventLog []byte     `json:"verityEventLog"`
+	IMAEventLog    []byte     `json:"imaEventLog,omitempty"`
 	QuoteData      []byte     `json:"quoteData"`      // TPMS_ATTEST
 	QuoteSignature []byte     `json:"quoteSignature"` // TPMT_SIGNATURE
 	PCRs           []PCRValue `json:"pcrs"`
+	EkCert         []byte     `json:"ekCert,omitempty"`   // DER
+	AkPublic       []byte     `json:"akPublic,omitempty"` // TPMT_PUBLIC
+	HCLReport      []byte     `json:"hclReport,omitempty"`
+
+	// Creation data and ticket of an AK created by quote --create-ak
+	AkCreationData   []byte `json:"akCreationData,omitempty"`   // TPMS_CREATION_DATA
+	AkCreationTicket []byte `json:"akCreationTicket,omitempty"` // TPMT_TK_CREATION
+
+	// Container start events measured by quote, one JSON event per line
+	ContainerEventLog []byte `json:"containerEventLog,omitempty"`
+}
+
+// TPMInfo is the vendor metadata reported by the TPM's properties
+type TPMInfo struct {
+	Manufacturer    string `json:"manufacturer"`
+	VendorString    string `json:"vendorString,omitempty"`
+	FirmwareVersion string `json:"firmwareVersion,omitempty"`
+	SpecFamily      string `json:"specFamily,omitempty"`
+	SpecLevel       uint32 `json:"specLevel,omitempty"`
+	SpecRevision    uint32 `json:"specRevision,omitempty"`
+}
+
+// PlatformInfo describes the machine the TPM is attached to, e.g. from SMBIOS
+type PlatformInfo struct {
+	Vendor  string `json:"vendor,omitempty"`
+	Product string `json:"product,omitempty"`
+}
+
+// EvidenceDescriptor names a piece of evidence included in the attestation
+type EvidenceDescriptor struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType"`
 }
 
 type PCRValue struct {
@@ -14,6 +99,189 @@ type PCRValue struct {
 	Value []byte `json:"value"`
 }
 
+// CheckPCRSelection checks that the PCR values are labeled with exactly the
+// PCRs selected by the quote. The PCR digest only covers the values in order,
+// so a value labeled with another index would otherwise still verify.
+func CheckPCRSelection(selection []int, pcrs []PCRValue) error {
+	selected := slices.Clone(selection)
+	slices.Sort(selected)
+
+	var indices []int
+	for _, pcr := range pcrs {
+		indices = append(indices, pcr.Index)
+	}
+	slices.Sort(indices)
+
+	if !slices.Equal(indices, selected) {
+		return fmt.Errorf("attestation PCRs %v don't match the quoted PCR selection %v", indices, selected)
+	}
+	return nil
+}
+
 type ExpectedPCRs struct {
 	PCRs []PCRValue `json:"pcrs"`
 }
+
+// legacyAttestation is the unversioned format written before apiVersion was
+// introduced
+type legacyAttestation struct {
+	AkCert         []byte     `json:"akCert"`
+	BootEventLog   []byte     `json:"bootEventLog"`
+	VerityEventLog []byte     `json:"verityEventLog"`
+	QuoteData      []byte     `json:"quoteData"`
+	QuoteSignature []byte     `json:"quoteSignature"`
+	PCRs           []PCRValue `json:"pcrs"`
+	EkCert         []byte     `json:"ekCert,omitempty"`
+	AkPublic       []byte     `json:"akPublic,omitempty"`
+}
+
+// NewAttestation returns an attestation document of the current version with
+// the SHA-256 PCR bank
+func NewAttestation() *Attestation {
+	return &Attestation{
+		APIVersion: AttestationAPIVersion,
+		Kind:       AttestationKind,
+		HashBanks:  []string{"sha256"},
+	}
+}
+
+// evidence returns the evidence types and contents present in the
+// attestation, in a stable order
+func (a *Attestation) evidence() []evidenceData {
+	all := []evidenceData{
+		{EvidenceAKCert, a.AkCert},
+		{EvidenceAKPublic, a.AkPublic},
+		{EvidenceEKCert, a.EkCert},
+		{EvidenceQuote, a.QuoteData},
+		{EvidenceBootEventLog, a.BootEventLog},
+		{EvidenceVerityEventLog, a.VerityEventLog},
+		{EvidenceIMAEventLog, a.IMAEventLog},
+		{EvidenceHCLReport, a.HCLReport},
+		{EvidenceAKCreationData, a.AkCreationData},
+		{EvidenceAKCreationTicket, a.AkCreationTicket},
+		{EvidenceContainerEventLog, a.ContainerEventLog},
+	}
+
+	var present []evidenceData
+	for _, evidence := range all {
+		if len(evidence.data) > 0 {
+			present = append(present, evidence)
+		}
+	}
+	return present
+}
+
+// setEvidence stores evidence contents by type. It returns false for unknown
+// types.
+func (a *Attestation) setEvidence(evidenceType string, data []byte) bool {
+	switch evidenceType {
+	case EvidenceAKCert:
+		a.AkCert = data
+	case EvidenceAKPublic:
+		a.AkPublic = data
+	case EvidenceEKCert:
+		a.EkCert = data
+	case EvidenceQuote:
+		a.QuoteData = data
+	case EvidenceBootEventLog:
+		a.BootEventLog = data
+	case EvidenceVerityEventLog:
+		a.VerityEventLog = data
+	case EvidenceIMAEventLog:
+		a.IMAEventLog = data
+	case EvidenceHCLReport:
+		a.HCLReport = data
+	case EvidenceAKCreationData:
+		a.AkCreationData = data
+	case EvidenceAKCreationTicket:
+		a.AkCreationTicket = data
+	case EvidenceContainerEventLog:
+		a.ContainerEventLog = data
+	default:
+		return false
+	}
+	return true
+}
+
+type evidenceData struct {
+	evidenceType string
+	data         []byte
+}
+
+// DescribeEvidence sets the evidence descriptors from the evidence present in
+// the attestation
+func (a *Attestation) DescribeEvidence() {
+	a.Evidence = nil
+	for _, evidence := range a.evidence() {
+		a.Evidence = append(a.Evidence, EvidenceDescriptor{
+			Type:      evidence.evidenceType,
+			MediaType: evidenceMediaTypes[evidence.evidenceType],
+		})
+	}
+}
+
+// DecodeAttestation deserializes an attestation document. Unversioned
+// documents are upgraded to the current version. With strict, unknown fields
+// and evidence types are rejected rather than ignored.
+func DecodeAttestation(data []byte, strict bool) (*Attestation, error) {
+	var header struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+	}
+	err := json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize attestation: %w", err)
+	}
+
+	switch header.APIVersion {
+	case "":
+		var legacy legacyAttestation
+		err = decodeJSON(data, &legacy, strict)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't deserialize unversioned attestation: %w", err)
+		}
+
+		attestation := NewAttestation()
+		attestation.AkCert = legacy.AkCert
+		attestation.BootEventLog = legacy.BootEventLog
+		attestation.VerityEventLog = legacy.VerityEventLog
+		attestation.QuoteData = legacy.QuoteData
+		attestation.QuoteSignature = legacy.QuoteSignature
+		attestation.PCRs = legacy.PCRs
+		attestation.EkCert = legacy.EkCert
+		attestation.AkPublic = legacy.AkPublic
+		attestation.DescribeEvidence()
+		return attestation, nil
+
+	case AttestationAPIVersion:
+		if header.Kind != AttestationKind {
+			return nil, fmt.Errorf("unsupported attestation kind %q", header.Kind)
+		}
+
+		var attestation Attestation
+		err = decodeJSON(data, &attestation, strict)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't deserialize attestation: %w", err)
+		}
+
+		if strict {
+			for _, evidence := range attestation.Evidence {
+				if _, ok := evidenceMediaTypes[evidence.Type]; !ok {
+					return nil, fmt.Errorf("unsupported evidence type %q", evidence.Type)
+				}
+			}
+		}
+		return &attestation, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported attestation apiVersion %q", header.APIVersion)
+	}
+}
+
+func decodeJSON(data []byte, v any, strict bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(v)
+}
@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BootRevocationList is a locally maintained list of revoked boot components
+// and signing certificates, and the minimum SBAT level shim must enforce
+type BootRevocationList struct {
+	// DBX are revoked Authenticode image hashes that the measured dbx must
+	// contain
+	DBX []RevokedDigest `yaml:"dbx"`
+
+	// DBXUpdate is the path of a dbx update as published by the UEFI forum
+	// (an authenticated EFI variable of signature lists), relative to the
+	// list. Its hashes are added to DBX.
+	DBXUpdate string `yaml:"dbxUpdate,omitempty"`
+
+	// RevokedCertificates are the SHA-256 digests of revoked signing
+	// certificates
+	RevokedCertificates []RevokedDigest `yaml:"revokedCertificates"`
+
+	// SbatLevel is the minimum SbatLevel, in the SBAT CSV format
+	SbatLevel string `yaml:"sbatLevel"`
+}
+
+// RevokedDigest is a revoked hash and the advisory that revoked it
+type RevokedDigest struct {
+	SHA256      string `yaml:"sha256"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// LoadBootRevocationList reads a YAML boot revocation list
+func LoadBootRevocationList(path string) (*BootRevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read boot revocation list: %w", err)
+	}
+
+	var list BootRevocationList
+	err = yaml.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize boot revocation list: %w", err)
+	}
+
+	for _, digests := range [][]RevokedDigest{list.DBX, list.RevokedCertificates} {
+		for i, digest := range digests {
+			decoded, err := hex.DecodeString(digest.SHA256)
+			if err != nil || len(decoded) != 32 {
+				return nil, fmt.Errorf("invalid SHA-256 digest %q in boot revocation list", digest.SHA256)
+			}
+			digests[i].SHA256 = strings.ToLower(digest.SHA256)
+		}
+	}
+
+	if list.DBXUpdate != "" {
+		updatePath := list.DBXUpdate
+		if !filepath.IsAbs(updatePath) {
+			updatePath = filepath.Join(filepath.Dir(path), updatePath)
+		}
+
+		signatures, err := loadDBXUpdate(updatePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, signature := range signatures {
+			if signature.Type == "sha256" {
+				list.DBX = append(list.DBX, RevokedDigest{SHA256: hex.EncodeToString(signature.Hash), Description: list.DBXUpdate})
+			}
+		}
+	}
+
+	if list.SbatLevel != "" {
+		_, err = parseSbatLevel(list.SbatLevel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SBAT level in boot revocation list: %w", err)
+		}
+	}
+
+	return &list, nil
+}
+
+// loadDBXUpdate reads the signature lists of a dbx update, skipping the
+// EFI_VARIABLE_AUTHENTICATION_2 header
+func loadDBXUpdate(path string) ([]EFISignature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read dbx update: %w", err)
+	}
+
+	// EFI_TIME followed by a WIN_CERTIFICATE_UEFI_GUID whose first field is
+	// its length
+	const efiTimeSize = 16
+	if len(data) < efiTimeSize+4 {
+		return nil, fmt.Errorf("dbx update %s is too short", path)
+	}
+	certLength := int(binary.LittleEndian.Uint32(data[efiTimeSize:]))
+	if efiTimeSize+certLength > len(data) {
+		return nil, fmt.Errorf("dbx update %s has a truncated authentication header", path)
+	}
+
+	signatures, err := ParseEFISignatureLists(data[efiTimeSize+certLength:])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse dbx update %s: %w", path, err)
+	}
+	return signatures, nil
+}
+
+// Check rejects boot chains booted without Secure Boot, since the firmware
+// then doesn't enforce db and dbx, boot chains that are revoked by the list or
+// by the measured dbx, a measured dbx that lacks revocations of the list, and
+// an SBAT level older than the list's
+func (l *BootRevocationList) Check(state *SecureBootState) error {
+	if !state.Enabled {
+		return fmt.Errorf("Secure Boot is disabled, so revoked boot components can still boot")
+	}
+
+	measuredDBX := make(map[string]bool)
+	for _, signature := range state.DBX {
+		measuredDBX[hex.EncodeToString(signature.Hash)] = true
+	}
+
+	revokedImages := make(map[string]string)
+	for _, digest := range l.DBX {
+		revokedImages[digest.SHA256] = digest.Description
+	}
+	revokedCerts := make(map[string]string)
+	for _, digest := range l.RevokedCertificates {
+		revokedCerts[digest.SHA256] = digest.Description
+	}
+
+	for _, component := range state.Components {
+		digest := hex.EncodeToString(component.Digest)
+		if description, ok := revokedImages[digest]; ok {
+			return fmt.Errorf("boot component %s is revoked: %s", digest, description)
+		}
+		if measuredDBX[digest] {
+			return fmt.Errorf("boot component %s is revoked by the measured dbx", digest)
+		}
+	}
+
+	for _, authority := range state.Authorities {
+		digest := hex.EncodeToString(authority.Signature.Hash)
+		if description, ok := revokedCerts[digest]; ok {
+			return fmt.Errorf("boot component signer %s is revoked: %s", authority.Signature.Subject(), description)
+		}
+		if measuredDBX[digest] {
+			return fmt.Errorf("boot component signer %s is revoked by the measured dbx", authority.Signature.Subject())
+		}
+	}
+
+	var missing []string
+	for _, digest := range l.DBX {
+		if !measuredDBX[digest.SHA256] {
+			missing = append(missing, digest.SHA256)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("measured dbx is out of date, %d revocations are missing, e.g. %s", len(missing), missing[0])
+	}
+
+	if l.SbatLevel != "" {
+		return checkSbatLevel(state.SbatLevel, l.SbatLevel)
+	}
+
+	return nil
+}
+
+// sbatLevel is a parsed SbatLevel, the minimum generation of each component
+type sbatLevel struct {
+	date        string
+	components  []string
+	generations map[string]int
+}
+
+// parseSbatLevel parses an SbatLevel such as
+//
+//	sbat,1,2023012900
+//	shim,2
+//	grub,3
+func parseSbatLevel(level string) (*sbatLevel, error) {
+	lines := strings.Split(strings.TrimSpace(strings.TrimRight(level, "\x00")), "\n")
+
+	header := strings.Split(strings.TrimSpace(lines[0]), ",")
+	if len(header) < 2 || header[0] != "sbat" {
+		return nil, fmt.Errorf("SBAT level doesn't start with an sbat entry")
+	}
+
+	parsed := &sbatLevel{generations: make(map[string]int)}
+	if len(header) > 2 {
+		parsed.date = header[2]
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 2 {
+			continue
+		}
+
+		generation, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid generation %q for %s", fields[1], fields[0])
+		}
+		parsed.components = append(parsed.components, fields[0])
+		parsed.generations[fields[0]] = generation
+	}
+
+	return parsed, nil
+}
+
+func checkSbatLevel(measured string, required string) error {
+	if measured == "" {
+		return fmt.Errorf("boot event log has no SBAT level, shim may not enforce SBAT")
+	}
+
+	measuredLevel, err := parseSbatLevel(measured)
+	if err != nil {
+		return fmt.Errorf("couldn't parse measured SBAT level: %w", err)
+	}
+	requiredLevel, err := parseSbatLevel(required)
+	if err != nil {
+		return err
+	}
+
+	// Components absent from the measured level aren't revoked at all, i.e.
+	// generation 1 is accepted
+	for _, component := range requiredLevel.components {
+		generation := requiredLevel.generations[component]
+		measuredGeneration, ok := measuredLevel.generations[component]
+		if !ok {
+			measuredGeneration = 1
+		}
+		if measuredGeneration < generation {
+			return fmt.Errorf("SBAT level %s accepts %s generation %d, but generations below %d are revoked", measuredLevel.date, component, measuredGeneration, generation)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// ClockObservation is the TPMS_CLOCK_INFO and firmware version of a quote.
+//
+// For keys outside the endorsement and platform hierarchies, the TPM
+// obfuscates the reset and restart counts and the firmware version with a
+// per-key value. They stay stable for a given AK, so changes are meaningful,
+// but they can't be compared for ordering.
+type ClockObservation struct {
+	Clock           uint64    `json:"clock"`
+	ResetCount      uint32    `json:"resetCount"`
+	RestartCount    uint32    `json:"restartCount"`
+	Safe            bool      `json:"safe"`
+	FirmwareVersion uint64    `json:"firmwareVersion"`
+	ObservedAt      time.Time `json:"observedAt"`
+}
+
+// ClockState records the latest observation for each AK, keyed by the SHA-256
+// of the AK's SubjectPublicKeyInfo
+type ClockState struct {
+	AKs map[string]ClockObservation `json:"aks"`
+}
+
+// ClockCheckOptions configures how changes between observations are treated
+type ClockCheckOptions struct {
+	// FailOnReset rejects observations where the TPM was reset or restarted
+	// since the previous observation, e.g. because the VM rebooted
+	FailOnReset bool
+
+	// AllowUnsafe accepts quotes whose clock may have been rolled back after
+	// an unorderly shutdown
+	AllowUnsafe bool
+}
+
+// NewClockObservation extracts the clock info of a decoded quote
+func NewClockObservation(quote *tpm2.AttestationData) ClockObservation {
+	return ClockObservation{
+		Clock:           quote.ClockInfo.Clock,
+		ResetCount:      quote.ClockInfo.ResetCount,
+		RestartCount:    quote.ClockInfo.RestartCount,
+		Safe:            quote.ClockInfo.Safe != 0,
+		FirmwareVersion: quote.FirmwareVersion,
+		ObservedAt:      time.Now().UTC(),
+	}
+}
+
+// AKKeyID identifies an AK by the SHA-256 of its SubjectPublicKeyInfo
+func AKKeyID(akCert *x509.Certificate) string {
+	sum := sha256.Sum256(akCert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadClockState reads a clock state file. A missing file is an empty state.
+func LoadClockState(path string) (*ClockState, error) {
+	state := &ClockState{AKs: make(map[string]ClockObservation)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't read clock state: %w", err)
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize clock state: %w", err)
+	}
+	if state.AKs == nil {
+		state.AKs = make(map[string]ClockObservation)
+	}
+
+	return state, nil
+}
+
+// Save writes the clock state file
+func (s *ClockState) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't serialize clock state: %w", err)
+	}
+
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't write clock state: %w", err)
+	}
+
+	return nil
+}
+
+// CheckClock compares an observation with a previous one for the same AK. It
+// returns warnings for changes that are only suspicious, and an error for
+// changes that indicate a replayed quote or, with FailOnReset, a reboot.
+func CheckClock(previous ClockObservation, current ClockObservation, opts ClockCheckOptions) ([]string, error) {
+	var warnings []string
+
+	if !current.Safe && !opts.AllowUnsafe {
+		return nil, fmt.Errorf("TPM clock is not safe, it may have been rolled back after an unorderly shutdown")
+	}
+
+	if current.FirmwareVersion != previous.FirmwareVersion {
+		warnings = append(warnings, fmt.Sprintf("TPM firmware version changed from %x to %x", previous.FirmwareVersion, current.FirmwareVersion))
+	}
+
+	reset := ""
+	if current.ResetCount != previous.ResetCount {
+		reset = "TPM was reset (e.g. the VM rebooted)"
+	} else if current.RestartCount != previous.RestartCount {
+		reset = "TPM was restarted (e.g. the VM hibernated)"
+	}
+
+	if reset != "" {
+		if opts.FailOnReset {
+			return nil, fmt.Errorf("%s since the previous observation", reset)
+		}
+		warnings = append(warnings, reset)
+	}
+
+	// Within the same boot, the clock only moves forward
+	if reset == "" && current.Clock <= previous.Clock {
+		return nil, fmt.Errorf("TPM clock didn't advance since the previous observation (%d <= %d), the quote may be replayed",
+			current.Clock, previous.Clock)
+	}
+
+	return warnings, nil
+}
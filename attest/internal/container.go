@@ -0,0 +1,434 @@
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Media types of OCI and Docker image manifests and indexes
+const (
+	ociIndexMediaType      = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType   = "application/vnd.oci.image.manifest.v1+json"
+	dockerListMediaType    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestV2Schema = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Annotations naming the images of an OCI layout
+const (
+	ociRefNameAnnotation          = "org.opencontainers.image.ref.name"
+	containerdImageNameAnnotation = "io.containerd.image.name"
+)
+
+// containerMetadataMaxSize bounds the tarball entries kept in memory, which
+// only need to include the index, manifests and configs
+const containerMetadataMaxSize = 4 << 20
+
+// ContainerImage is an OCI container image as recorded in its manifest and
+// config
+type ContainerImage struct {
+	Name string
+
+	// ManifestDigest is the "sha256:" digest of the image manifest, i.e. the
+	// digest the image is pulled by. Docker archives without an OCI index
+	// have no manifest, so it is empty.
+	ManifestDigest    string
+	ManifestMediaType string
+
+	// ConfigDigest is the "sha256:" digest of the image config, i.e. the
+	// image ID
+	ConfigDigest string
+
+	Layers []ContainerLayer
+
+	Entrypoint []string
+	Cmd        []string
+}
+
+// ContainerLayer is a layer of a container image
+type ContainerLayer struct {
+	Digest    string // "sha256:" digest
+	MediaType string
+
+	// DiffID is set if Digest is the digest of the uncompressed layer, as in
+	// docker save archives, instead of the digest of the layer blob
+	DiffID bool
+}
+
+// Digest is the digest identifying the image: its manifest digest, or its
+// config digest if it has no manifest
+func (i *ContainerImage) Digest() string {
+	if i.ManifestDigest != "" {
+		return i.ManifestDigest
+	}
+	return i.ConfigDigest
+}
+
+// ContainerEntrypoint is the process a container image runs by default
+type ContainerEntrypoint struct {
+	Entrypoint []string `json:"entrypoint"`
+	Cmd        []string `json:"cmd"`
+}
+
+// EntrypointJSON serializes the entrypoint and command of the image
+func (i *ContainerImage) EntrypointJSON() ([]byte, error) {
+	return json.Marshal(ContainerEntrypoint{Entrypoint: i.Entrypoint, Cmd: i.Cmd})
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform,omitempty"`
+}
+
+type ociIndex struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+type ociConfig struct {
+	Config struct {
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd"`
+	} `json:"config"`
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+type dockerArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// LoadContainerImage reads a container image from an OCI layout directory, or
+// from a tarball (optionally gzipped) of an OCI layout or of a docker save
+// archive. If the layout or archive has several images, name selects one by
+// its reference name or tag. platform (os/arch[/variant]) selects the image of
+// multi-platform indexes.
+func LoadContainerImage(imagePath string, name string, platform string) (*ContainerImage, error) {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read container image: %w", err)
+	}
+
+	var readFile containerFileReader
+	if info.IsDir() {
+		readFile = func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(imagePath, filepath.FromSlash(name)))
+		}
+	} else {
+		files, err := readTarball(imagePath)
+		if err != nil {
+			return nil, err
+		}
+		readFile = func(name string) ([]byte, error) {
+			data, ok := files[name]
+			if !ok {
+				return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+			}
+			return data, nil
+		}
+	}
+
+	indexBytes, err := readFile("index.json")
+	if err == nil {
+		return loadOCILayout(readFile, indexBytes, name, platform)
+	}
+	manifestBytes, err := readFile("manifest.json")
+	if err == nil {
+		return loadDockerArchive(readFile, manifestBytes, name)
+	}
+	return nil, fmt.Errorf("%s is neither an OCI layout nor a docker archive", imagePath)
+}
+
+// containerFileReader reads a file of an OCI layout or docker archive by its
+// slash-separated path
+type containerFileReader func(name string) ([]byte, error)
+
+// readTarball reads the small files of a tarball into memory
+func readTarball(tarballPath string) (map[string][]byte, error) {
+	file, err := os.Open(tarballPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read container image: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var tarReader *tar.Reader
+	if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decompress container image: %w", err)
+		}
+		defer gzipReader.Close()
+		tarReader = tar.NewReader(gzipReader)
+	} else {
+		tarReader = tar.NewReader(reader)
+	}
+
+	files := make(map[string][]byte)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read container image tarball: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg || header.Size > containerMetadataMaxSize {
+			continue
+		}
+
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read container image tarball: %w", err)
+		}
+		files[path.Clean(header.Name)] = data
+	}
+
+	return files, nil
+}
+
+// readBlob reads a blob of an OCI layout and checks its digest
+func readBlob(readFile containerFileReader, digest string) ([]byte, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" {
+		return nil, fmt.Errorf("unsupported digest %q", digest)
+	}
+
+	data, err := readFile(path.Join("blobs", algorithm, encoded))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read blob %s: %w", digest, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(encoded) {
+		return nil, fmt.Errorf("blob %s doesn't match its digest", digest)
+	}
+
+	return data, nil
+}
+
+func loadOCILayout(readFile containerFileReader, indexBytes []byte, name string, platform string) (*ContainerImage, error) {
+	var index ociIndex
+	err := json.Unmarshal(indexBytes, &index)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize OCI index: %w", err)
+	}
+
+	// The top-level index lists the images of the layout by name
+	descriptor, err := selectImage(index.Manifests, name)
+	if err != nil {
+		return nil, err
+	}
+	imageName := descriptor.Annotations[containerdImageNameAnnotation]
+	if imageName == "" {
+		imageName = descriptor.Annotations[ociRefNameAnnotation]
+	}
+	if imageName == "" {
+		imageName = name
+	}
+
+	// Nested indexes list the images of each platform
+	for descriptor.MediaType == ociIndexMediaType || descriptor.MediaType == dockerListMediaType {
+		nestedBytes, err := readBlob(readFile, descriptor.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var nested ociIndex
+		err = json.Unmarshal(nestedBytes, &nested)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't deserialize OCI index %s: %w", descriptor.Digest, err)
+		}
+
+		platformDescriptor, err := selectPlatform(nested.Manifests, platform)
+		if err != nil {
+			return nil, fmt.Errorf("OCI index %s: %w", descriptor.Digest, err)
+		}
+		descriptor = platformDescriptor
+	}
+
+	if descriptor.MediaType != ociManifestMediaType && descriptor.MediaType != dockerManifestV2Schema {
+		return nil, fmt.Errorf("unsupported manifest media type %s", descriptor.MediaType)
+	}
+
+	manifestBytes, err := readBlob(readFile, descriptor.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ociManifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize image manifest %s: %w", descriptor.Digest, err)
+	}
+
+	configBytes, err := readBlob(readFile, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var config ociConfig
+	err = json.Unmarshal(configBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize image config %s: %w", manifest.Config.Digest, err)
+	}
+
+	image := &ContainerImage{
+		Name:              imageName,
+		ManifestDigest:    descriptor.Digest,
+		ManifestMediaType: descriptor.MediaType,
+		ConfigDigest:      manifest.Config.Digest,
+		Entrypoint:        config.Config.Entrypoint,
+		Cmd:               config.Config.Cmd,
+	}
+	for _, layer := range manifest.Layers {
+		image.Layers = append(image.Layers, ContainerLayer{Digest: layer.Digest, MediaType: layer.MediaType})
+	}
+
+	return image, nil
+}
+
+// selectImage picks the image of an OCI layout named name, or its only image
+func selectImage(descriptors []ociDescriptor, name string) (ociDescriptor, error) {
+	if name == "" {
+		if len(descriptors) != 1 {
+			return ociDescriptor{}, fmt.Errorf("OCI layout has %d images, select one by name", len(descriptors))
+		}
+		return descriptors[0], nil
+	}
+
+	for _, descriptor := range descriptors {
+		// Reference names are either full references or just tags, which
+		// only match the same tag
+		imageName := descriptor.Annotations[containerdImageNameAnnotation]
+		refName := descriptor.Annotations[ociRefNameAnnotation]
+		if sameImageReference(imageName, name) || sameImageReference(refName, name) {
+			return descriptor, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("no image named %s in the OCI layout", name)
+}
+
+// sameImageReference reports whether two image references name the same
+// image, after expanding the default registry, namespace and tag
+func sameImageReference(a string, b string) bool {
+	return a != "" && normalizeImageReference(a) == normalizeImageReference(b)
+}
+
+// normalizeImageReference expands a reference like redis to
+// docker.io/library/redis:latest
+func normalizeImageReference(ref string) string {
+	name, digest, hasDigest := strings.Cut(ref, "@")
+
+	domain, remainder, found := strings.Cut(name, "/")
+	if !found || (!strings.ContainsAny(domain, ".:") && domain != "localhost") {
+		domain, remainder = "docker.io", name
+	}
+	if domain == "docker.io" && !strings.Contains(remainder, "/") {
+		remainder = "library/" + remainder
+	}
+	if !strings.Contains(remainder, ":") && !hasDigest {
+		remainder += ":latest"
+	}
+
+	if hasDigest {
+		return domain + "/" + remainder + "@" + digest
+	}
+	return domain + "/" + remainder
+}
+
+// selectPlatform picks the image of a platform from a multi-platform index
+func selectPlatform(descriptors []ociDescriptor, platform string) (ociDescriptor, error) {
+	for _, descriptor := range descriptors {
+		if descriptor.Platform == nil {
+			continue
+		}
+		descriptorPlatform := descriptor.Platform.OS + "/" + descriptor.Platform.Architecture
+		if descriptorPlatform == platform || descriptorPlatform+"/"+descriptor.Platform.Variant == platform {
+			return descriptor, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("no image for platform %s", platform)
+}
+
+// loadDockerArchive reads a docker save archive without an OCI index. It has
+// no manifest, and its layers are identified by their uncompressed diff IDs.
+func loadDockerArchive(readFile containerFileReader, manifestBytes []byte, name string) (*ContainerImage, error) {
+	var manifests []dockerArchiveManifest
+	err := json.Unmarshal(manifestBytes, &manifests)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize docker archive manifest: %w", err)
+	}
+
+	var manifest *dockerArchiveManifest
+	switch {
+	case name != "":
+		for i := range manifests {
+			if slices.ContainsFunc(manifests[i].RepoTags, func(tag string) bool { return sameImageReference(tag, name) }) {
+				manifest = &manifests[i]
+			}
+		}
+		if manifest == nil {
+			return nil, fmt.Errorf("no image tagged %s in the docker archive", name)
+		}
+	case len(manifests) == 1:
+		manifest = &manifests[0]
+		if len(manifest.RepoTags) > 0 {
+			name = manifest.RepoTags[0]
+		}
+	default:
+		return nil, fmt.Errorf("docker archive has %d images, select one by tag", len(manifests))
+	}
+
+	configBytes, err := readFile(path.Clean(manifest.Config))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read image config: %w", err)
+	}
+	var config ociConfig
+	err = json.Unmarshal(configBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize image config: %w", err)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image config has %d layer diff IDs, the archive has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	configDigest := sha256.Sum256(configBytes)
+	image := &ContainerImage{
+		Name:         name,
+		ConfigDigest: "sha256:" + hex.EncodeToString(configDigest[:]),
+		Entrypoint:   config.Config.Entrypoint,
+		Cmd:          config.Config.Cmd,
+	}
+	for _, diffID := range config.RootFS.DiffIDs {
+		image.Layers = append(image.Layers, ContainerLayer{Digest: diffID, MediaType: "application/vnd.docker.image.rootfs.diff.tar", DiffID: true})
+	}
+
+	return image, nil
+}
@@ -0,0 +1,53 @@
+package internal
+
+import "testing"
+
+func TestSelectImage(t *testing.T) {
+	descriptors := []ociDescriptor{
+		{Digest: "sha256:redis", Annotations: map[string]string{
+			containerdImageNameAnnotation: "docker.io/library/redis:7",
+			ociRefNameAnnotation:          "7",
+		}},
+		{Digest: "sha256:app", Annotations: map[string]string{
+			ociRefNameAnnotation: "ghcr.io/example/app:latest",
+		}},
+		{Digest: "sha256:tagged", Annotations: map[string]string{
+			ociRefNameAnnotation: "latest",
+		}},
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"redis:7", "sha256:redis"},
+		{"library/redis:7", "sha256:redis"},
+		{"docker.io/library/redis:7", "sha256:redis"},
+		{"7", "sha256:redis"},
+		{"ghcr.io/example/app", "sha256:app"},
+		{"ghcr.io/example/app:latest", "sha256:app"},
+		{"latest", "sha256:tagged"},
+		// A tag only matches reference names that are the same tag
+		{"redis:latest", ""},
+		{"busybox:7", ""},
+		{"example/app", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			descriptor, err := selectImage(descriptors, test.name)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("selectImage(%s) = %s, want no image", test.name, descriptor.Digest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if descriptor.Digest != test.want {
+				t.Fatalf("selectImage(%s) = %s, want %s", test.name, descriptor.Digest, test.want)
+			}
+		})
+	}
+}
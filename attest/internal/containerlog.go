@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// ContainerPCR is the PCR quote extends with container start events
+const ContainerPCR = 13
+
+// ContainerMeasurementsPath is where quote records container start events, one
+// JSON event per line
+const ContainerMeasurementsPath = "/var/lib/image-attestation/container-measurements"
+
+// ContainerEvent records the start of a container: the image it runs, the
+// process arguments it was started with and the host paths it mounts
+type ContainerEvent struct {
+	ImageName   string           `json:"imageName,omitempty"`
+	ImageDigest string           `json:"imageDigest"`    // "sha256:" manifest or config digest
+	Args        []string         `json:"args,omitempty"` // process arguments, from the runtime config
+	Mounts      []ContainerMount `json:"mounts,omitempty"`
+}
+
+// ContainerMount is a bind mount of a host path into a container
+type ContainerMount struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// ParseContainerMount parses a mount given as source:destination[:option,...]
+func ParseContainerMount(mount string) (ContainerMount, error) {
+	parts := strings.SplitN(mount, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return ContainerMount{}, fmt.Errorf("malformed container mount %q, expected source:destination[:options]", mount)
+	}
+	containerMount := ContainerMount{Source: parts[0], Destination: parts[1]}
+	if len(parts) == 3 && parts[2] != "" {
+		containerMount.Options = strings.Split(parts[2], ",")
+	}
+	return containerMount, nil
+}
+
+// Equal reports whether two mounts have the same source, destination and
+// options, in any order
+func (m ContainerMount) Equal(other ContainerMount) bool {
+	if m.Source != other.Source || m.Destination != other.Destination || len(m.Options) != len(other.Options) {
+		return false
+	}
+	options := slices.Clone(m.Options)
+	otherOptions := slices.Clone(other.Options)
+	slices.Sort(options)
+	slices.Sort(otherOptions)
+	return slices.Equal(options, otherOptions)
+}
+
+func (m ContainerMount) String() string {
+	if len(m.Options) == 0 {
+		return m.Source + ":" + m.Destination
+	}
+	return m.Source + ":" + m.Destination + ":" + strings.Join(m.Options, ",")
+}
+
+// ociRuntimeConfig is the part of an OCI runtime config.json that is
+// recorded in container events
+type ociRuntimeConfig struct {
+	Process *struct {
+		Args []string `json:"args"`
+	} `json:"process"`
+	Mounts []struct {
+		Destination string   `json:"destination"`
+		Type        string   `json:"type"`
+		Source      string   `json:"source"`
+		Options     []string `json:"options"`
+	} `json:"mounts"`
+}
+
+// NewContainerEvent describes a container start. The runtime config, if set,
+// is an OCI runtime config.json whose process arguments and bind mounts are
+// recorded. Further mounts are given as source:destination[:option,...].
+func NewContainerEvent(imageName string, imageDigest string, runtimeConfigPath string, mounts []string) (*ContainerEvent, error) {
+	digest := ociDigestMap(imageDigest)["sha256"]
+	if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("invalid container image digest %q, expected sha256:<hex>", imageDigest)
+	}
+
+	event := &ContainerEvent{
+		ImageName:   imageName,
+		ImageDigest: "sha256:" + digest,
+	}
+
+	if runtimeConfigPath != "" {
+		runtimeConfigBytes, err := os.ReadFile(runtimeConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read container runtime config: %w", err)
+		}
+		var runtimeConfig ociRuntimeConfig
+		err = json.Unmarshal(runtimeConfigBytes, &runtimeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't deserialize container runtime config: %w", err)
+		}
+		if runtimeConfig.Process == nil || len(runtimeConfig.Process.Args) == 0 {
+			return nil, fmt.Errorf("container runtime config has no process arguments")
+		}
+		event.Args = runtimeConfig.Process.Args
+
+		// Other mounts, e.g. proc or tmpfs, don't expose host paths
+		for _, mount := range runtimeConfig.Mounts {
+			if mount.Type == "bind" || slices.Contains(mount.Options, "bind") || slices.Contains(mount.Options, "rbind") {
+				event.Mounts = append(event.Mounts, ContainerMount{Source: mount.Source, Destination: mount.Destination, Options: mount.Options})
+			}
+		}
+	}
+
+	for _, mount := range mounts {
+		containerMount, err := ParseContainerMount(mount)
+		if err != nil {
+			return nil, err
+		}
+		event.Mounts = append(event.Mounts, containerMount)
+	}
+
+	return event, nil
+}
+
+// Marshal serializes the event as a line of the container event log. The
+// digest of the line, without the newline, is extended into ContainerPCR.
+func (e *ContainerEvent) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// ContainerLogEntry is an event of the container event log
+type ContainerLogEntry struct {
+	Sequence int
+	Event    ContainerEvent
+	Data     []byte // the measured line
+}
+
+// ContainerLog is a parsed container event log
+type ContainerLog struct {
+	Entries []ContainerLogEntry
+}
+
+// ParseContainerLog parses a container event log of JSON lines
+func ParseContainerLog(data []byte) (*ContainerLog, error) {
+	log := &ContainerLog{}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		entry := ContainerLogEntry{Sequence: len(log.Entries) + 1, Data: line}
+		err := decodeJSON(line, &entry.Event, true)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't deserialize container event %d: %w", entry.Sequence, err)
+		}
+		log.Entries = append(log.Entries, entry)
+	}
+
+	return log, nil
+}
+
+// Verify replays the log into a PCR bank of the given hash and returns the
+// number of entries whose replay matches the quoted PCR value. An event is
+// recorded in the log before its PCR is extended, so the trailing entries
+// after the first match are ignored.
+func (l *ContainerLog) Verify(hash crypto.Hash, pcrValue []byte) (int, error) {
+	value := make([]byte, hash.Size())
+	if bytes.Equal(value, pcrValue) {
+		return 0, nil
+	}
+
+	for i, entry := range l.Entries {
+		hasher := hash.New()
+		hasher.Write(entry.Data)
+		value = extendDigest(hash, value, hasher.Sum(nil))
+		if bytes.Equal(value, pcrValue) {
+			return i + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("PCR %d replay mismatch, expected %x, got %x", ContainerPCR, pcrValue, value)
+}
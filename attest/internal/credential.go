@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/legacy/tpm2/credactivation"
+)
+
+// AKCertRequest is sent by the attested machine to a privacy CA to obtain a
+// certificate for its AK
+type AKCertRequest struct {
+	EkCert   []byte `json:"ekCert,omitempty"` // DER
+	EkPublic []byte `json:"ekPublic"`         // TPMT_PUBLIC
+	AkPublic []byte `json:"akPublic"`         // TPMT_PUBLIC
+}
+
+// AKCertChallenge is returned by the privacy CA. The issued AK certificate is
+// encrypted with a credential that the TPM only releases through
+// TPM2_ActivateCredential if the AK is resident on the same TPM as the EK.
+type AKCertChallenge struct {
+	Credential      []byte `json:"credential"`      // TPM2B_ID_OBJECT
+	EncryptedSecret []byte `json:"encryptedSecret"` // TPM2B_ENCRYPTED_SECRET
+	EncryptedAkCert []byte `json:"encryptedAkCert"` // AES-256-GCM, nonce prepended
+}
+
+const credentialSecretSize = 32
+
+// DecodeEKPublic decodes the EK public area of a request and, if the request
+// carries an EK certificate, checks that both hold the same key
+func (r *AKCertRequest) DecodeEKPublic() (crypto.PublicKey, error) {
+	ekPub, err := tpm2.DecodePublic(r.EkPublic)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode EK public area: %w", err)
+	}
+
+	ekKey, err := ekPub.Key()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get EK public key: %w", err)
+	}
+
+	if len(r.EkCert) > 0 {
+		ekCert, err := ParseEKCertificate(r.EkCert)
+		if err != nil {
+			return nil, err
+		}
+
+		if !publicKeysEqual(ekKey, ekCert.PublicKey) {
+			return nil, fmt.Errorf("EK public area doesn't match the EK certificate")
+		}
+	}
+
+	return ekKey, nil
+}
+
+// ParseEKCertificate parses a DER EK certificate
+func ParseEKCertificate(der []byte) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse EK certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// NewAKCertChallenge wraps an issued AK certificate so that only the TPM that
+// holds both the EK and the AK of the request can recover it
+func NewAKCertChallenge(req *AKCertRequest, akCert []byte) (*AKCertChallenge, error) {
+	ekKey, err := req.DecodeEKPublic()
+	if err != nil {
+		return nil, err
+	}
+
+	akPub, err := tpm2.DecodePublic(req.AkPublic)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode AK public area: %w", err)
+	}
+
+	akName, err := akPub.Name()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't compute AK name: %w", err)
+	}
+
+	secret := make([]byte, credentialSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("couldn't generate credential secret: %w", err)
+	}
+
+	credential, encryptedSecret, err := credactivation.Generate(akName.Digest, ekKey, 16, secret)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate credential: %w", err)
+	}
+
+	encryptedAkCert, err := sealWithSecret(secret, akCert)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encrypt AK certificate: %w", err)
+	}
+
+	return &AKCertChallenge{
+		Credential:      credential,
+		EncryptedSecret: encryptedSecret,
+		EncryptedAkCert: encryptedAkCert,
+	}, nil
+}
+
+// DecryptAKCert recovers the AK certificate with the secret released by
+// TPM2_ActivateCredential
+func (c *AKCertChallenge) DecryptAKCert(secret []byte) ([]byte, error) {
+	gcm, err := newSecretGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.EncryptedAkCert) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted AK certificate is too short")
+	}
+
+	nonce, ciphertext := c.EncryptedAkCert[:gcm.NonceSize()], c.EncryptedAkCert[gcm.NonceSize():]
+	akCert, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decrypt AK certificate: %w", err)
+	}
+
+	return akCert, nil
+}
+
+func sealWithSecret(secret []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newSecretGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func newSecretGCM(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// IssueAKCert signs a certificate for the key in the AK public area. The
+// template provides the subject and any extra extensions; the public key,
+// serial number, key usages and validity (if unset) are filled in.
+func IssueAKCert(akPublic []byte, template x509.Certificate, validity time.Duration, caCert *x509.Certificate, caKey crypto.Signer) ([]byte, error) {
+	akPub, err := tpm2.DecodePublic(akPublic)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode AK public area: %w", err)
+	}
+
+	akKey, err := akPub.Key()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get AK public key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template.SerialNumber = serial
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.UnknownExtKeyUsage = append(template.UnknownExtKeyUsage, OIDTCGKpAIKCertificate)
+	template.BasicConstraintsValid = true
+	template.IsCA = false
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-5 * time.Minute)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = template.NotBefore.Add(validity)
+	}
+
+	akCert, err := x509.CreateCertificate(rand.Reader, &template, caCert, akKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create AK certificate: %w", err)
+	}
+
+	return akCert, nil
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	switch a := a.(type) {
+	case *rsa.PublicKey:
+		return a.Equal(b)
+	case *ecdsa.PublicKey:
+		return a.Equal(b)
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RevocationChecker checks the certificates of a chain against the CRLs of
+// their issuers. CRLs are taken from pre-fetched files first, then from the
+// cache directory, and finally downloaded from the certificate's CRL
+// distribution points unless running offline.
+type RevocationChecker struct {
+	// CRLs are pre-fetched revocation lists, e.g. loaded with LoadCRLs
+	CRLs []*x509.RevocationList
+
+	// CacheDir stores downloaded CRLs. Caching is disabled if empty.
+	CacheDir string
+
+	// Offline disables downloading CRLs
+	Offline bool
+
+	// CurrentTime is used to check CRL freshness. If zero, the current
+	// system time is used.
+	CurrentTime time.Time
+
+	Client *http.Client
+}
+
+// LoadCRLs reads DER or PEM-encoded CRL files
+func LoadCRLs(paths []string) ([]*x509.RevocationList, error) {
+	var crls []*x509.RevocationList
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CRL %s: %w", path, err)
+		}
+
+		crl, err := ParseCRL(data)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse CRL %s: %w", path, err)
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// ParseCRL parses a DER or PEM-encoded CRL
+func ParseCRL(data []byte) (*x509.RevocationList, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+		}
+		data = block.Bytes
+	}
+	return x509.ParseRevocationList(data)
+}
+
+// maxCRLSize bounds the size of downloaded CRLs
+const maxCRLSize = 32 << 20
+
+// CheckChain checks every non-root certificate of the chain against the CRL
+// of the next certificate in the chain. Certificates without CRL distribution
+// points are only checked against pre-fetched CRLs from their issuer, and fail
+// the check if there is none.
+func (r *RevocationChecker) CheckChain(chain []*x509.Certificate) error {
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+
+		crls, err := r.crlsFor(cert, issuer)
+		if err != nil {
+			return fmt.Errorf("couldn't get CRL for %s: %w", cert.Subject, err)
+		}
+
+		for _, crl := range crls {
+			for _, revoked := range crl.RevokedCertificateEntries {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("certificate %s (serial %s) was revoked at %s",
+						cert.Subject, cert.SerialNumber.Text(16), revoked.RevocationTime.Format(time.RFC3339))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *RevocationChecker) crlsFor(cert *x509.Certificate, issuer *x509.Certificate) ([]*x509.RevocationList, error) {
+	var crls []*x509.RevocationList
+	for _, crl := range r.CRLs {
+		if crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if err := r.checkFresh(crl); err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+
+	if len(crls) > 0 {
+		return crls, nil
+	}
+	if len(cert.CRLDistributionPoints) == 0 {
+		return nil, fmt.Errorf("no CRL distribution point and no pre-fetched CRL from %s", issuer.Subject)
+	}
+
+	var errs []error
+	for _, url := range cert.CRLDistributionPoints {
+		crl, err := r.fetch(url, issuer)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+			continue
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+
+	return nil, fmt.Errorf("no usable CRL: %v", errs)
+}
+
+func (r *RevocationChecker) fetch(url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	cachePath := ""
+	if r.CacheDir != "" {
+		sum := sha256.Sum256([]byte(url))
+		cachePath = filepath.Join(r.CacheDir, hex.EncodeToString(sum[:])+".crl")
+
+		if data, err := os.ReadFile(cachePath); err == nil {
+			crl, err := r.parseAndCheck(data, issuer)
+			if err == nil {
+				return crl, nil
+			}
+			// fall through and refresh a stale or corrupt cache entry
+		}
+	}
+
+	if r.Offline {
+		return nil, fmt.Errorf("CRL not available offline")
+	}
+
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't download CRL: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("couldn't download CRL: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCRLSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't download CRL: %w", err)
+	}
+	if len(data) > maxCRLSize {
+		return nil, fmt.Errorf("CRL exceeds %d bytes", maxCRLSize)
+	}
+
+	crl, err := r.parseAndCheck(data, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if cachePath != "" {
+		err = os.MkdirAll(r.CacheDir, 0755)
+		if err == nil {
+			err = os.WriteFile(cachePath, data, 0644)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't cache CRL: %w", err)
+		}
+	}
+
+	return crl, nil
+}
+
+func (r *RevocationChecker) parseAndCheck(data []byte, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	crl, err := ParseCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse CRL: %w", err)
+	}
+
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("CRL signature verification failed: %w", err)
+	}
+
+	if err := r.checkFresh(crl); err != nil {
+		return nil, err
+	}
+
+	return crl, nil
+}
+
+func (r *RevocationChecker) checkFresh(crl *x509.RevocationList) error {
+	currentTime := r.CurrentTime
+	if currentTime.IsZero() {
+		currentTime = time.Now()
+	}
+
+	if !crl.NextUpdate.IsZero() && currentTime.After(crl.NextUpdate) {
+		return fmt.Errorf("CRL from %s expired at %s", crl.Issuer, crl.NextUpdate.Format(time.RFC3339))
+	}
+
+	return nil
+}
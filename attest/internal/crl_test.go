@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCert(t *testing.T, name string, serial int64, issuer *testCA, crlURLs []string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             testNow.Add(-24 * time.Hour),
+		NotAfter:              testNow.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  issuer == nil || strings.HasSuffix(name, "CA"),
+		CRLDistributionPoints: crlURLs,
+	}
+
+	parent, signer := template, crypto.Signer(key)
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+func newTestCRL(t *testing.T, issuer *testCA, nextUpdate time.Time, revoked ...int64) []byte {
+	t.Helper()
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: testNow.Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, serial := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: testNow.Add(-2 * time.Hour),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, issuer.cert, issuer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func parseTestCRL(t *testing.T, der []byte) *x509.RevocationList {
+	t.Helper()
+
+	crl, err := ParseCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl
+}
+
+func TestCheckChainPrefetchedCRLs(t *testing.T) {
+	root := newTestCert(t, "Root CA", 1, nil, nil)
+	other := newTestCert(t, "Other CA", 2, nil, nil)
+	leaf := newTestCert(t, "AK", 42, root, nil)
+	chain := []*x509.Certificate{leaf.cert, root.cert}
+
+	tests := []struct {
+		name    string
+		crls    [][]byte
+		wantErr string
+	}{
+		{"revoked", [][]byte{newTestCRL(t, root, testNow.Add(time.Hour), 7, 42)}, "was revoked"},
+		{"not revoked", [][]byte{newTestCRL(t, root, testNow.Add(time.Hour), 7)}, ""},
+		{"expired", [][]byte{newTestCRL(t, root, testNow.Add(-time.Minute))}, "expired"},
+		{"no CRL", nil, "no pre-fetched CRL"},
+		{"CRL of another issuer", [][]byte{newTestCRL(t, other, testNow.Add(time.Hour), 42)}, "no pre-fetched CRL"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checker := RevocationChecker{Offline: true, CurrentTime: testNow}
+			for _, der := range test.crls {
+				checker.CRLs = append(checker.CRLs, parseTestCRL(t, der))
+			}
+
+			err := checker.CheckChain(chain)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("CheckChain() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("CheckChain() = %v, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckChainDownloadedCRL(t *testing.T) {
+	root := newTestCert(t, "Root CA", 1, nil, nil)
+	crl := newTestCRL(t, root, testNow.Add(time.Hour), 42)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(crl)
+	}))
+	defer server.Close()
+
+	revoked := newTestCert(t, "AK", 42, root, []string{server.URL + "/root.crl"})
+	valid := newTestCert(t, "AK", 43, root, []string{server.URL + "/root.crl"})
+	cacheDir := t.TempDir()
+
+	checker := RevocationChecker{CacheDir: cacheDir, CurrentTime: testNow}
+	err := checker.CheckChain([]*x509.Certificate{revoked.cert, root.cert})
+	if err == nil || !strings.Contains(err.Error(), "was revoked") {
+		t.Fatalf("CheckChain() = %v, want revocation error", err)
+	}
+
+	err = checker.CheckChain([]*x509.Certificate{valid.cert, root.cert})
+	if err != nil {
+		t.Fatalf("CheckChain() = %v, want nil", err)
+	}
+	if requests != 1 {
+		t.Fatalf("downloaded the CRL %d times, want it cached after the first", requests)
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("cache directory has %d entries (%v), want 1", len(entries), err)
+	}
+
+	// Offline, only the cached CRL is available
+	checker.Offline = true
+	err = checker.CheckChain([]*x509.Certificate{revoked.cert, root.cert})
+	if err == nil || !strings.Contains(err.Error(), "was revoked") {
+		t.Fatalf("offline CheckChain() = %v, want revocation error", err)
+	}
+
+	checker.CacheDir = t.TempDir()
+	err = checker.CheckChain([]*x509.Certificate{valid.cert, root.cert})
+	if err == nil || !strings.Contains(err.Error(), "not available offline") {
+		t.Fatalf("offline CheckChain() without cache = %v, want error", err)
+	}
+}
+
+func TestCheckChainDownloadTooLarge(t *testing.T) {
+	root := newTestCert(t, "Root CA", 1, nil, nil)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte{0}, maxCRLSize+1))
+	}))
+	defer server.Close()
+
+	leaf := newTestCert(t, "AK", 42, root, []string{server.URL})
+	checker := RevocationChecker{CurrentTime: testNow}
+	err := checker.CheckChain([]*x509.Certificate{leaf.cert, root.cert})
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("CheckChain() = %v, want size error", err)
+	}
+}
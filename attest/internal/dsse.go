@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	ita "github.com/in-toto/attestation/go/v1"
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+	"golang.org/x/exp/slices"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// InTotoPayloadType is the DSSE payload type of in-toto statements
+const InTotoPayloadType = "application/vnd.in-toto+json"
+
+// legacyInTotoPayloadType is the payload type of envelopes signed by earlier
+// versions of scai-gen
+const legacyInTotoPayloadType = "application/vnd.in-toto"
+
+// dsseSigner signs DSSE envelopes with a local private key: ECDSA with the
+// curve's hash and an ASN.1 signature, RSA-PSS with SHA-256, or Ed25519
+type dsseSigner struct {
+	key crypto.Signer
+}
+
+func (s *dsseSigner) Sign(_ context.Context, data []byte) ([]byte, error) {
+	switch pub := s.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		hash, err := ecdsaHash(pub.Curve)
+		if err != nil {
+			return nil, err
+		}
+		hasher := hash.New()
+		hasher.Write(data)
+		return s.key.Sign(rand.Reader, hasher.Sum(nil), hash)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return s.key.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	case ed25519.PublicKey:
+		return s.key.Sign(rand.Reader, data, crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("unsupported DSSE signing key type %T", pub)
+	}
+}
+
+// KeyID is the hex SHA-256 of the signing key's SubjectPublicKeyInfo
+func (s *dsseSigner) KeyID() (string, error) {
+	return publicKeyID(s.key.Public())
+}
+
+// dsseVerifier verifies the signatures of dsseSigner
+type dsseVerifier struct {
+	key crypto.PublicKey
+}
+
+func (v *dsseVerifier) Verify(_ context.Context, data, sig []byte) error {
+	switch pub := v.key.(type) {
+	case *ecdsa.PublicKey:
+		hash, err := ecdsaHash(pub.Curve)
+		if err != nil {
+			return err
+		}
+		hasher := hash.New()
+		hasher.Write(data)
+		if !ecdsa.VerifyASN1(pub, hasher.Sum(nil), sig) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, sig) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported DSSE verification key type %T", pub)
+	}
+}
+
+func (v *dsseVerifier) KeyID() (string, error) {
+	return publicKeyID(v.key)
+}
+
+func (v *dsseVerifier) Public() crypto.PublicKey {
+	return v.key
+}
+
+func publicKeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode public key: %w", err)
+	}
+	digest := sha256.Sum256(der)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+func ecdsaHash(curve elliptic.Curve) (crypto.Hash, error) {
+	switch curve {
+	case elliptic.P256():
+		return crypto.SHA256, nil
+	case elliptic.P384():
+		return crypto.SHA384, nil
+	case elliptic.P521():
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported ECDSA curve %s", curve.Params().Name)
+}
+
+// SignStatement serializes an in-toto statement and signs it into a DSSE
+// envelope
+func SignStatement(statement *ita.Statement, key crypto.Signer) ([]byte, error) {
+	payload, err := protojson.Marshal(statement)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't serialize statement: %w", err)
+	}
+
+	return signEnvelope(InTotoPayloadType, payload, key)
+}
+
+// VerifyStatement checks that a DSSE envelope is signed by one of the keys and
+// returns the in-toto statement it carries
+func VerifyStatement(envelopeBytes []byte, keys []crypto.PublicKey) (*ita.Statement, error) {
+	payload, err := verifyEnvelope(envelopeBytes, keys, InTotoPayloadType, legacyInTotoPayloadType)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &ita.Statement{}
+	err = protojson.Unmarshal(payload, statement)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse in-toto statement: %w", err)
+	}
+
+	return statement, nil
+}
+
+func signEnvelope(payloadType string, payload []byte, key crypto.Signer) ([]byte, error) {
+	signer, err := dsse.NewEnvelopeSigner(&dsseSigner{key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	envelope, err := signer.SignPayload(context.Background(), payloadType, payload)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sign DSSE envelope: %w", err)
+	}
+
+	return json.Marshal(envelope)
+}
+
+// verifyEnvelope checks the payload type and the signature of a DSSE envelope
+// and returns its payload
+func verifyEnvelope(envelopeBytes []byte, keys []crypto.PublicKey, payloadTypes ...string) ([]byte, error) {
+	envelope := &dsse.Envelope{}
+	err := json.Unmarshal(envelopeBytes, envelope)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse DSSE envelope: %w", err)
+	}
+
+	if !slices.Contains(payloadTypes, envelope.PayloadType) {
+		return nil, fmt.Errorf("unexpected DSSE payload type %s", envelope.PayloadType)
+	}
+
+	var verifiers []dsse.Verifier
+	for _, key := range keys {
+		verifiers = append(verifiers, &dsseVerifier{key: key})
+	}
+	verifier, err := dsse.NewEnvelopeVerifier(verifiers...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = verifier.Verify(context.Background(), envelope)
+	if err != nil {
+		return nil, fmt.Errorf("DSSE signature verification failed: %w", err)
+	}
+
+	return envelope.DecodeB64Payload()
+}
+
+// LoadPublicKeys reads PEM public keys, or the keys of PEM certificates
+func LoadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read public key: %w", err)
+		}
+
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("couldn't parse public key %s: %w", path, err)
+				}
+				keys = append(keys, key)
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("couldn't parse certificate %s: %w", path, err)
+				}
+				keys = append(keys, cert.PublicKey)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no PEM public keys found")
+	}
+
+	return keys, nil
+}
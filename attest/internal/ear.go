@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// EARProfile is the eat_profile of EAT Attestation Results
+const EARProfile = "tag:github.com/veraison/ear"
+
+// EARVerifierDeveloper identifies this verifier in ear.verifier-id
+const EARVerifierDeveloper = "https://github.com/chkimes/image-attestation"
+
+// earSubmodule is the name of the attester in the EAR submods
+const earSubmodule = "tpm"
+
+// TrustClaim is a claim of the AR4SI trustworthiness vector
+type TrustClaim string
+
+const (
+	TrustClaimInstanceIdentity TrustClaim = "instance-identity"
+	TrustClaimConfiguration    TrustClaim = "configuration"
+	TrustClaimExecutables      TrustClaim = "executables"
+	TrustClaimFileSystem       TrustClaim = "file-system"
+)
+
+var trustClaims = []TrustClaim{
+	TrustClaimInstanceIdentity,
+	TrustClaimConfiguration,
+	TrustClaimExecutables,
+	TrustClaimFileSystem,
+}
+
+// ParseTrustClaim checks that name is a trust claim appraised by verify
+func ParseTrustClaim(name string) (TrustClaim, error) {
+	for _, claim := range trustClaims {
+		if string(claim) == name {
+			return claim, nil
+		}
+	}
+	return "", fmt.Errorf("unknown trust claim %q", name)
+}
+
+// AR4SI trustworthiness claim values. The tier of a value is given by its
+// range: 0-1 none, 2-31 affirming, 32-95 warning, 96-127 contraindicated.
+const (
+	TrustNoClaim         int8 = 0
+	TrustAffirming       int8 = 2
+	TrustWarning         int8 = 32
+	TrustContraindicated int8 = 96
+)
+
+// AttestationResult collects the appraisal of each trust claim while an
+// attestation is verified
+type AttestationResult struct {
+	Vector   map[TrustClaim]int8
+	Nonce    []byte
+	PolicyID string
+}
+
+func NewAttestationResult() *AttestationResult {
+	return &AttestationResult{Vector: make(map[TrustClaim]int8)}
+}
+
+// Affirm marks a claim as appraised successfully, unless it was already
+// contraindicated
+func (r *AttestationResult) Affirm(claim TrustClaim) {
+	if r.Vector[claim] < TrustAffirming {
+		r.Vector[claim] = TrustAffirming
+	}
+}
+
+// Contraindicate marks a claim as failing appraisal
+func (r *AttestationResult) Contraindicate(claim TrustClaim) {
+	r.Vector[claim] = TrustContraindicated
+}
+
+// Status is the tier of the worst claim in the vector
+func (r *AttestationResult) Status() string {
+	worst := TrustNoClaim
+	for _, value := range r.Vector {
+		if value > worst {
+			worst = value
+		}
+	}
+
+	switch {
+	case worst >= TrustContraindicated:
+		return "contraindicated"
+	case worst >= TrustWarning:
+		return "warning"
+	case worst >= TrustAffirming:
+		return "affirming"
+	default:
+		return "none"
+	}
+}
+
+type earClaims struct {
+	Profile    string                  `json:"eat_profile"`
+	IssuedAt   int64                   `json:"iat"`
+	VerifierID earVerifierID           `json:"ear.verifier-id"`
+	Nonce      string                  `json:"eat_nonce,omitempty"`
+	Submods    map[string]earAppraisal `json:"submods"`
+}
+
+type earVerifierID struct {
+	Developer string `json:"developer"`
+	Build     string `json:"build"`
+}
+
+type earAppraisal struct {
+	Status   string              `json:"ear.status"`
+	Vector   map[TrustClaim]int8 `json:"ear.trustworthiness-vector,omitempty"`
+	PolicyID string              `json:"ear.appraisal-policy-id,omitempty"`
+}
+
+// SignEAR serializes the result as an EAR and signs it as a JWT. The JWS
+// algorithm follows the key: ES256/ES384/ES512 for ECDSA, PS256 for RSA and
+// EdDSA for Ed25519.
+func (r *AttestationResult) SignEAR(key crypto.Signer, build string, issuedAt time.Time) (string, error) {
+	claims := earClaims{
+		Profile:  EARProfile,
+		IssuedAt: issuedAt.Unix(),
+		VerifierID: earVerifierID{
+			Developer: EARVerifierDeveloper,
+			Build:     build,
+		},
+		Submods: map[string]earAppraisal{
+			earSubmodule: {
+				Status:   r.Status(),
+				Vector:   r.Vector,
+				PolicyID: r.PolicyID,
+			},
+		},
+	}
+	if len(r.Nonce) > 0 {
+		claims.Nonce = base64.RawURLEncoding.EncodeToString(r.Nonce)
+	}
+
+	alg, hash, err := jwsAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("couldn't serialize EAR: %w", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	signature, err := jwsSign(key, hash, []byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("couldn't sign EAR: %w", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func jwsAlgorithm(key crypto.Signer) (string, crypto.Hash, error) {
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return "ES256", crypto.SHA256, nil
+		case elliptic.P384():
+			return "ES384", crypto.SHA384, nil
+		case elliptic.P521():
+			return "ES512", crypto.SHA512, nil
+		}
+		return "", 0, fmt.Errorf("unsupported ECDSA curve %s", pub.Curve.Params().Name)
+	case *rsa.PublicKey:
+		return "PS256", crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return "EdDSA", 0, nil
+	default:
+		return "", 0, fmt.Errorf("unsupported EAR signing key type %T", pub)
+	}
+}
+
+func jwsSign(key crypto.Signer, hash crypto.Hash, signingInput []byte) ([]byte, error) {
+	if hash == 0 {
+		return key.Sign(rand.Reader, signingInput, crypto.Hash(0))
+	}
+
+	hasher := hash.New()
+	hasher.Write(signingInput)
+	digest := hasher.Sum(nil)
+
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return key.Sign(rand.Reader, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash})
+	case *ecdsa.PublicKey:
+		der, err := key.Sign(rand.Reader, digest, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		// JWS uses the fixed-size r || s encoding rather than ASN.1
+		var sig struct{ R, S *big.Int }
+		_, err = asn1.Unmarshal(der, &sig)
+		if err != nil {
+			return nil, err
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		out := make([]byte, 2*size)
+		sig.R.FillBytes(out[:size])
+		sig.S.FillBytes(out[size:])
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported EAR signing key type %T", pub)
+	}
+}
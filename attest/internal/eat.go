@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// EATProfile identifies the claims of the EATs written by quote --format eat
+const EATProfile = "tag:github.com/chkimes/image-attestation,2024:tpm"
+
+// The evidence is already signed by the AK through the TPM quote, so the EAT
+// is an unprotected CWT claims set (UCCS) rather than a COSE_Sign1
+const uccsTag = 601
+
+const evidenceQuoteSignature = "quoteSignature"
+
+const quoteSignatureMediaType = "application/vnd.tcg.tpmt-signature"
+
+// eatClaims is the EAT claims set. Standard claims use their registered CWT
+// keys, the TPM evidence is a CMW collection of [media type, contents] records.
+type eatClaims struct {
+	Nonce     []byte         `cbor:"10,keyasint,omitempty"` // eat_nonce
+	Profile   string         `cbor:"265,keyasint"`          // eat_profile
+	TPM       *TPMInfo       `cbor:"tpm,omitempty"`
+	Platform  *PlatformInfo  `cbor:"platform,omitempty"`
+	HashBanks []string       `cbor:"hashBanks,omitempty"`
+	PCRs      map[int][]byte `cbor:"pcrs"`
+	Evidence  map[string]cmw `cbor:"cmw"`
+}
+
+// cmw is a CBOR conceptual message wrapper record
+type cmw struct {
+	_         struct{} `cbor:",toarray"`
+	MediaType string
+	Value     []byte
+}
+
+// EncodeEAT serializes an attestation as a CBOR Entity Attestation Token
+func EncodeEAT(a *Attestation) ([]byte, error) {
+	claims := eatClaims{
+		Profile:   EATProfile,
+		TPM:       a.TPM,
+		Platform:  a.Platform,
+		HashBanks: a.HashBanks,
+		PCRs:      make(map[int][]byte),
+		Evidence:  make(map[string]cmw),
+	}
+
+	if len(a.QuoteData) > 0 {
+		quote, err := tpm2.DecodeAttestationData(a.QuoteData)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode quote: %w", err)
+		}
+		claims.Nonce = quote.ExtraData
+	}
+
+	for _, pcr := range a.PCRs {
+		claims.PCRs[pcr.Index] = pcr.Value
+	}
+
+	for _, evidence := range a.evidence() {
+		claims.Evidence[evidence.evidenceType] = cmw{
+			MediaType: evidenceMediaTypes[evidence.evidenceType],
+			Value:     evidence.data,
+		}
+	}
+	if len(a.QuoteSignature) > 0 {
+		claims.Evidence[evidenceQuoteSignature] = cmw{
+			MediaType: quoteSignatureMediaType,
+			Value:     a.QuoteSignature,
+		}
+	}
+
+	encMode, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := encMode.Marshal(cbor.Tag{Number: uccsTag, Content: claims})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't serialize EAT: %w", err)
+	}
+
+	return token, nil
+}
+
+// DecodeEAT deserializes an EAT written by EncodeEAT. With strict, unknown
+// claims and evidence types are rejected rather than ignored.
+func DecodeEAT(data []byte, strict bool) (*Attestation, error) {
+	decOpts := cbor.DecOptions{}
+	if strict {
+		decOpts.ExtraReturnErrors = cbor.ExtraDecErrorUnknownField
+	}
+	decMode, err := decOpts.DecMode()
+	if err != nil {
+		return nil, err
+	}
+
+	var tag cbor.RawTag
+	err = decMode.Unmarshal(data, &tag)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize EAT: %w", err)
+	}
+	if tag.Number != uccsTag {
+		return nil, fmt.Errorf("unsupported EAT CBOR tag %d, only unprotected claims sets (%d) are supported", tag.Number, uccsTag)
+	}
+
+	var claims eatClaims
+	err = decMode.Unmarshal(tag.Content, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize EAT claims: %w", err)
+	}
+	if claims.Profile != EATProfile {
+		return nil, fmt.Errorf("unsupported EAT profile %q", claims.Profile)
+	}
+
+	attestation := NewAttestation()
+	attestation.TPM = claims.TPM
+	attestation.Platform = claims.Platform
+	if len(claims.HashBanks) > 0 {
+		attestation.HashBanks = claims.HashBanks
+	}
+
+	for index, value := range claims.PCRs {
+		attestation.PCRs = append(attestation.PCRs, PCRValue{Index: index, Value: value})
+	}
+	sort.Slice(attestation.PCRs, func(i, j int) bool {
+		return attestation.PCRs[i].Index < attestation.PCRs[j].Index
+	})
+
+	for evidenceType, record := range claims.Evidence {
+		if evidenceType == evidenceQuoteSignature {
+			attestation.QuoteSignature = record.Value
+			continue
+		}
+		if !attestation.setEvidence(evidenceType, record.Value) && strict {
+			return nil, fmt.Errorf("unsupported evidence type %q", evidenceType)
+		}
+	}
+	attestation.DescribeEvidence()
+
+	// The nonce claim is informational, but it must not contradict the quote
+	if len(claims.Nonce) > 0 {
+		quote, err := tpm2.DecodeAttestationData(attestation.QuoteData)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode quote: %w", err)
+		}
+		if !bytes.Equal(quote.ExtraData, claims.Nonce) {
+			return nil, fmt.Errorf("EAT nonce %x doesn't match the quote nonce %x", claims.Nonce, []byte(quote.ExtraData))
+		}
+	}
+
+	return attestation, nil
+}
+
+// ParseAttestation deserializes an attestation either as a JSON document or
+// as a CBOR EAT
+func ParseAttestation(data []byte, strict bool) (*Attestation, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return DecodeAttestation(data, strict)
+	}
+	return DecodeEAT(data, strict)
+}
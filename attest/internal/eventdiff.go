@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// DiffEvent is an event of a boot or verity event log in a form that can be
+// compared across attestations
+type DiffEvent struct {
+	Sequence    int
+	PCR         int
+	Type        string
+	Digest      []byte
+	Description string
+}
+
+// ChangeKind is how an event differs between two event logs
+type ChangeKind string
+
+const (
+	EventAdded   ChangeKind = "added"
+	EventRemoved ChangeKind = "removed"
+	EventChanged ChangeKind = "changed"
+)
+
+// EventChange is an event that was added, removed or changed. Old is nil for
+// added events and New is nil for removed events.
+type EventChange struct {
+	Kind ChangeKind
+	Old  *DiffEvent
+	New  *DiffEvent
+}
+
+// DiffEvents returns the events of the given boot event log, with their
+// SHA-256 digests
+func DiffEvents(l *EventLog) []DiffEvent {
+	var events []DiffEvent
+	for _, event := range l.Events {
+		if event.Type == EvNoAction {
+			continue
+		}
+
+		events = append(events, DiffEvent{
+			Sequence:    event.Sequence,
+			PCR:         event.PCR,
+			Type:        event.Type.String(),
+			Digest:      event.Digest(tpm2.AlgSHA256),
+			Description: event.Description(),
+		})
+	}
+	return events
+}
+
+// DiffEventLogs aligns the events of each PCR of two event logs and returns
+// the changes per PCR. Events are matched by type and digest. A removed and
+// an added event of the same type at the same position are reported as
+// changed.
+func DiffEventLogs(old []DiffEvent, new []DiffEvent) map[int][]EventChange {
+	oldByPCR := groupByPCR(old)
+	newByPCR := groupByPCR(new)
+
+	var pcrs []int
+	for pcr := range oldByPCR {
+		pcrs = append(pcrs, pcr)
+	}
+	for pcr := range newByPCR {
+		if _, ok := oldByPCR[pcr]; !ok {
+			pcrs = append(pcrs, pcr)
+		}
+	}
+	sort.Ints(pcrs)
+
+	changes := make(map[int][]EventChange)
+	for _, pcr := range pcrs {
+		if pcrChanges := diffSequences(oldByPCR[pcr], newByPCR[pcr]); len(pcrChanges) > 0 {
+			changes[pcr] = pcrChanges
+		}
+	}
+	return changes
+}
+
+func groupByPCR(events []DiffEvent) map[int][]DiffEvent {
+	grouped := make(map[int][]DiffEvent)
+	for _, event := range events {
+		grouped[event.PCR] = append(grouped[event.PCR], event)
+	}
+	return grouped
+}
+
+func sameEvent(a *DiffEvent, b *DiffEvent) bool {
+	return a.Type == b.Type && bytes.Equal(a.Digest, b.Digest)
+}
+
+// diffSequences computes the longest common subsequence of the two event
+// sequences and reports the events outside of it
+func diffSequences(old []DiffEvent, new []DiffEvent) []EventChange {
+	// lcs[i][j] is the LCS length of old[i:] and new[j:]
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if sameEvent(&old[i], &new[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var changes []EventChange
+	var removed, added []*DiffEvent
+	flush := func() {
+		changes = append(changes, pairChanges(removed, added)...)
+		removed, added = nil, nil
+	}
+
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case i < len(old) && j < len(new) && sameEvent(&old[i], &new[j]):
+			flush()
+			i++
+			j++
+		case j == len(new) || (i < len(old) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, &old[i])
+			i++
+		default:
+			added = append(added, &new[j])
+			j++
+		}
+	}
+	flush()
+
+	return changes
+}
+
+// pairChanges reports removed and added events between the same matching
+// events, pairing them up as changes when their types match
+func pairChanges(removed []*DiffEvent, added []*DiffEvent) []EventChange {
+	var changes []EventChange
+	for len(removed) > 0 && len(added) > 0 && removed[0].Type == added[0].Type {
+		changes = append(changes, EventChange{Kind: EventChanged, Old: removed[0], New: added[0]})
+		removed, added = removed[1:], added[1:]
+	}
+	for _, event := range removed {
+		changes = append(changes, EventChange{Kind: EventRemoved, Old: event})
+	}
+	for _, event := range added {
+		changes = append(changes, EventChange{Kind: EventAdded, New: event})
+	}
+	return changes
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testDiffEvent returns an event of the given type whose digest is derived
+// from the data
+func testDiffEvent(sequence int, pcr int, eventType string, data string) DiffEvent {
+	return DiffEvent{Sequence: sequence, PCR: pcr, Type: eventType, Digest: []byte(data), Description: data}
+}
+
+// formatChanges renders changes as e.g. "~1>2" for event 1 changed to 2, "-1"
+// for event 1 removed and "+2" for event 2 added
+func formatChanges(changes []EventChange) string {
+	var formatted []string
+	for _, change := range changes {
+		switch change.Kind {
+		case EventChanged:
+			formatted = append(formatted, fmt.Sprintf("~%d>%d", change.Old.Sequence, change.New.Sequence))
+		case EventRemoved:
+			formatted = append(formatted, fmt.Sprintf("-%d", change.Old.Sequence))
+		case EventAdded:
+			formatted = append(formatted, fmt.Sprintf("+%d", change.New.Sequence))
+		}
+	}
+	return strings.Join(formatted, " ")
+}
+
+func TestDiffSequences(t *testing.T) {
+	separator := testDiffEvent(1, 4, "EV_SEPARATOR", "separator")
+	shim := testDiffEvent(2, 4, "EV_EFI_BOOT_SERVICES_APPLICATION", "shim")
+	grub := testDiffEvent(3, 4, "EV_EFI_BOOT_SERVICES_APPLICATION", "grub")
+	kernel := testDiffEvent(4, 4, "EV_EFI_BOOT_SERVICES_APPLICATION", "kernel")
+	action := testDiffEvent(5, 4, "EV_EFI_ACTION", "action")
+
+	renumbered := func(event DiffEvent, sequence int) DiffEvent {
+		event.Sequence = sequence
+		return event
+	}
+	updated := func(event DiffEvent, sequence int) DiffEvent {
+		event.Sequence = sequence
+		event.Digest = append([]byte("updated "), event.Digest...)
+		return event
+	}
+
+	tests := []struct {
+		name string
+		old  []DiffEvent
+		new  []DiffEvent
+		want string
+	}{
+		{"same", []DiffEvent{separator, shim, grub}, []DiffEvent{separator, shim, grub}, ""},
+		{"both empty", nil, nil, ""},
+		{"insert", []DiffEvent{separator, grub}, []DiffEvent{separator, renumbered(shim, 12), renumbered(grub, 13)}, "+12"},
+		{"insert at end", []DiffEvent{separator, shim}, []DiffEvent{separator, shim, renumbered(grub, 13)}, "+13"},
+		{"remove", []DiffEvent{separator, shim, grub}, []DiffEvent{renumbered(separator, 11), renumbered(grub, 12)}, "-2"},
+		{"remove at start", []DiffEvent{separator, shim, grub}, []DiffEvent{renumbered(shim, 12), renumbered(grub, 13)}, "-1"},
+		// The same type at the same position is a change of the event data
+		{"same-type change", []DiffEvent{separator, shim, grub}, []DiffEvent{separator, updated(shim, 12), grub}, "~2>12"},
+		{"consecutive changes", []DiffEvent{shim, grub, kernel}, []DiffEvent{updated(shim, 12), updated(grub, 13), kernel}, "~2>12 ~3>13"},
+		{"other-type replacement", []DiffEvent{separator, action, grub}, []DiffEvent{separator, renumbered(shim, 12), grub}, "-5 +12"},
+		{"change and insert", []DiffEvent{separator, shim}, []DiffEvent{separator, updated(shim, 12), renumbered(action, 13)}, "~2>12 +13"},
+		{"reordered", []DiffEvent{shim, grub}, []DiffEvent{renumbered(grub, 12), renumbered(shim, 13)}, "-2 +13"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := formatChanges(diffSequences(test.old, test.new))
+			if got != test.want {
+				t.Fatalf("diffSequences() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPairChanges(t *testing.T) {
+	shim := testDiffEvent(1, 4, "EV_EFI_BOOT_SERVICES_APPLICATION", "shim")
+	grub := testDiffEvent(2, 4, "EV_EFI_BOOT_SERVICES_APPLICATION", "grub")
+	action := testDiffEvent(3, 4, "EV_EFI_ACTION", "action")
+
+	tests := []struct {
+		name    string
+		removed []*DiffEvent
+		added   []*DiffEvent
+		want    string
+	}{
+		{"nothing", nil, nil, ""},
+		{"same type", []*DiffEvent{&shim}, []*DiffEvent{&grub}, "~1>2"},
+		{"other type", []*DiffEvent{&shim}, []*DiffEvent{&action}, "-1 +3"},
+		// Pairing stops at the first events whose types differ
+		{"same then other type", []*DiffEvent{&shim, &action}, []*DiffEvent{&grub, &shim}, "~1>2 -3 +1"},
+		{"more removed", []*DiffEvent{&shim, &grub}, []*DiffEvent{&grub}, "~1>2 -2"},
+		{"only added", nil, []*DiffEvent{&grub}, "+2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := formatChanges(pairChanges(test.removed, test.added))
+			if got != test.want {
+				t.Fatalf("pairChanges() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDiffEventLogs(t *testing.T) {
+	old := []DiffEvent{
+		testDiffEvent(1, 4, "EV_SEPARATOR", "separator"),
+		testDiffEvent(2, 7, "EV_EFI_VARIABLE_DRIVER_CONFIG", "SecureBoot"),
+		testDiffEvent(3, 9, "EV_IPL", "grub.cfg"),
+	}
+	new := []DiffEvent{
+		testDiffEvent(11, 4, "EV_SEPARATOR", "separator"),
+		testDiffEvent(12, 8, "EV_IPL", "grub_cmd"),
+		testDiffEvent(13, 9, "EV_IPL", "grub.cfg"),
+	}
+
+	changes := DiffEventLogs(old, new)
+	// PCRs whose events only appear in one of the logs are fully removed or
+	// added, unchanged PCRs are left out
+	want := map[int]string{7: "-2", 8: "+12"}
+	if len(changes) != len(want) {
+		t.Fatalf("DiffEventLogs() changed PCRs %v, want %v", changes, want)
+	}
+	for pcr, wantChanges := range want {
+		if got := formatChanges(changes[pcr]); got != wantChanges {
+			t.Fatalf("DiffEventLogs() PCR %d = %q, want %q", pcr, got, wantChanges)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"golang.org/x/exp/slices"
+)
+
+// EventType is the TCG PC Client event type of a boot event log entry
+type EventType uint32
+
+const (
+	EvPrebootCert             EventType = 0x0
+	EvPostCode                EventType = 0x1
+	EvNoAction                EventType = 0x3
+	EvSeparator               EventType = 0x4
+	EvAction                  EventType = 0x5
+	EvEventTag                EventType = 0x6
+	EvSCRTMContents           EventType = 0x7
+	EvSCRTMVersion            EventType = 0x8
+	EvCPUMicrocode            EventType = 0x9
+	EvPlatformConfigFlags     EventType = 0xa
+	EvTableOfDevices          EventType = 0xb
+	EvCompactHash             EventType = 0xc
+	EvIPL                     EventType = 0xd
+	EvIPLPartitionData        EventType = 0xe
+	EvNonhostCode             EventType = 0xf
+	EvNonhostConfig           EventType = 0x10
+	EvNonhostInfo             EventType = 0x11
+	EvOmitBootDeviceEvents    EventType = 0x12
+	EvEFIVariableDriverConfig EventType = 0x80000001
+	EvEFIVariableBoot         EventType = 0x80000002
+	EvEFIBootServicesApp      EventType = 0x80000003
+	EvEFIBootServicesDriver   EventType = 0x80000004
+	EvEFIRuntimeServicesDrv   EventType = 0x80000005
+	EvEFIGPTEvent             EventType = 0x80000006
+	EvEFIAction               EventType = 0x80000007
+	EvEFIPlatformFirmwareBlob EventType = 0x80000008
+	EvEFIHandoffTables        EventType = 0x80000009
+	EvEFIPlatformFirmwareBlb2 EventType = 0x8000000a
+	EvEFIHandoffTables2       EventType = 0x8000000b
+	EvEFIVariableBoot2        EventType = 0x8000000c
+	EvEFIHCRTMEvent           EventType = 0x80000010
+	EvEFIVariableAuthority    EventType = 0x800000e0
+)
+
+var eventTypeNames = map[EventType]string{
+	EvPrebootCert:             "EV_PREBOOT_CERT",
+	EvPostCode:                "EV_POST_CODE",
+	EvNoAction:                "EV_NO_ACTION",
+	EvSeparator:               "EV_SEPARATOR",
+	EvAction:                  "EV_ACTION",
+	EvEventTag:                "EV_EVENT_TAG",
+	EvSCRTMContents:           "EV_S_CRTM_CONTENTS",
+	EvSCRTMVersion:            "EV_S_CRTM_VERSION",
+	EvCPUMicrocode:            "EV_CPU_MICROCODE",
+	EvPlatformConfigFlags:     "EV_PLATFORM_CONFIG_FLAGS",
+	EvTableOfDevices:          "EV_TABLE_OF_DEVICES",
+	EvCompactHash:             "EV_COMPACT_HASH",
+	EvIPL:                     "EV_IPL",
+	EvIPLPartitionData:        "EV_IPL_PARTITION_DATA",
+	EvNonhostCode:             "EV_NONHOST_CODE",
+	EvNonhostConfig:           "EV_NONHOST_CONFIG",
+	EvNonhostInfo:             "EV_NONHOST_INFO",
+	EvOmitBootDeviceEvents:    "EV_OMIT_BOOT_DEVICE_EVENTS",
+	EvEFIVariableDriverConfig: "EV_EFI_VARIABLE_DRIVER_CONFIG",
+	EvEFIVariableBoot:         "EV_EFI_VARIABLE_BOOT",
+	EvEFIBootServicesApp:      "EV_EFI_BOOT_SERVICES_APPLICATION",
+	EvEFIBootServicesDriver:   "EV_EFI_BOOT_SERVICES_DRIVER",
+	EvEFIRuntimeServicesDrv:   "EV_EFI_RUNTIME_SERVICES_DRIVER",
+	EvEFIGPTEvent:             "EV_EFI_GPT_EVENT",
+	EvEFIAction:               "EV_EFI_ACTION",
+	EvEFIPlatformFirmwareBlob: "EV_EFI_PLATFORM_FIRMWARE_BLOB",
+	EvEFIHandoffTables:        "EV_EFI_HANDOFF_TABLES",
+	EvEFIPlatformFirmwareBlb2: "EV_EFI_PLATFORM_FIRMWARE_BLOB2",
+	EvEFIHandoffTables2:       "EV_EFI_HANDOFF_TABLES2",
+	EvEFIVariableBoot2:        "EV_EFI_VARIABLE_BOOT2",
+	EvEFIHCRTMEvent:           "EV_EFI_HCRTM_EVENT",
+	EvEFIVariableAuthority:    "EV_EFI_VARIABLE_AUTHORITY",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EV_UNKNOWN(0x%x)", uint32(t))
+}
+
+// Event is a single entry of a TCG crypto-agile boot event log
+type Event struct {
+	Sequence int
+	PCR      int
+	Type     EventType
+	Digests  map[tpm2.Algorithm][]byte
+	Data     []byte
+}
+
+// Digest returns the event digest for the given hash algorithm, or nil if the
+// event log doesn't carry that bank
+func (e *Event) Digest(alg tpm2.Algorithm) []byte {
+	return e.Digests[alg]
+}
+
+// String returns the event data as a NUL-trimmed string, which is how GRUB
+// and the initramfs scripts record their measurements
+func (e *Event) String() string {
+	return strings.TrimRight(string(e.Data), "\x00")
+}
+
+// Description decodes the event data of common event types into a short
+// human-readable description
+func (e *Event) Description() string {
+	switch e.Type {
+	case EvEFIVariableDriverConfig, EvEFIVariableBoot, EvEFIVariableBoot2, EvEFIVariableAuthority:
+		variable, err := ParseEFIVariable(e.Data)
+		if err != nil {
+			break
+		}
+
+		switch {
+		case e.Type == EvEFIVariableAuthority && variable.Name != sbatLevelVariable:
+			signature := parseAuthoritySignature(variable.Data)
+			return fmt.Sprintf("%s: %s", variable.Name, signature.Subject())
+		case variable.Name == "SecureBoot" && len(variable.Data) == 1:
+			return fmt.Sprintf("SecureBoot: %d", variable.Data[0])
+		case isPrintable(variable.Data):
+			return fmt.Sprintf("%s: %q", variable.Name, strings.TrimRight(string(variable.Data), "\x00"))
+		}
+		return fmt.Sprintf("%s (%d bytes)", variable.Name, len(variable.Data))
+
+	case EvEFIBootServicesApp, EvEFIBootServicesDriver, EvEFIRuntimeServicesDrv:
+		if path := imageLoadPath(e.Data); path != "" {
+			return path
+		}
+
+	case EvSeparator:
+		return fmt.Sprintf("%x", e.Data)
+
+	case EvSCRTMVersion:
+		if len(e.Data)%2 == 0 {
+			version := make([]uint16, len(e.Data)/2)
+			binary.Read(bytes.NewReader(e.Data), binary.LittleEndian, version)
+			if s := strings.TrimRight(string(utf16.Decode(version)), "\x00"); s != "" {
+				return s
+			}
+		}
+	}
+
+	if isPrintable(e.Data) {
+		return e.String()
+	}
+	return fmt.Sprintf("%d bytes", len(e.Data))
+}
+
+// isPrintable reports whether data is non-empty, NUL-terminated or not, text
+func isPrintable(data []byte) bool {
+	text := strings.TrimRight(string(data), "\x00")
+	if text == "" || !utf8.ValidString(text) {
+		return false
+	}
+	for _, r := range text {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// imageLoadPath returns the file path of the device path in a
+// UEFI_IMAGE_LOAD_EVENT, or an empty string if it has none
+func imageLoadPath(data []byte) string {
+	const headerSize = 32
+	if len(data) < headerSize {
+		return ""
+	}
+	devicePathLength := binary.LittleEndian.Uint64(data[24:])
+	if devicePathLength > uint64(len(data)-headerSize) {
+		return ""
+	}
+	devicePath := data[headerSize : headerSize+int(devicePathLength)]
+
+	// Device path nodes are a type, subtype and length. Media file path nodes
+	// (type 4, subtype 4) carry a UTF-16 path.
+	var path string
+	for len(devicePath) >= 4 {
+		nodeType, subType := devicePath[0], devicePath[1]
+		length := int(binary.LittleEndian.Uint16(devicePath[2:]))
+		if length < 4 || length > len(devicePath) {
+			break
+		}
+
+		if nodeType == 4 && subType == 4 {
+			name := make([]uint16, (length-4)/2)
+			binary.Read(bytes.NewReader(devicePath[4:length]), binary.LittleEndian, name)
+			path += strings.TrimRight(string(utf16.Decode(name)), "\x00")
+		}
+		if nodeType == 0x7f {
+			break
+		}
+		devicePath = devicePath[length:]
+	}
+
+	return path
+}
+
+// EventLog is a parsed TCG crypto-agile boot event log
+type EventLog struct {
+	Algorithms map[tpm2.Algorithm]uint16
+	Events     []Event
+}
+
+const specIDSignature = "Spec ID Event03\x00"
+const startupLocalitySignature = "StartupLocality\x00"
+
+// ParseEventLog parses a TCG PC Client crypto-agile event log as exposed at
+// /sys/kernel/security/tpm0/binary_bios_measurements
+func ParseEventLog(data []byte) (*EventLog, error) {
+	r := bytes.NewReader(data)
+
+	// The first event is always in the legacy SHA1 format and contains the
+	// Spec ID event describing the digest sizes of the following events
+	var header struct {
+		PCR       uint32
+		Type      uint32
+		Digest    [20]byte
+		EventSize uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("couldn't read event log header: %w", err)
+	}
+
+	if int64(header.EventSize) > int64(r.Len()) {
+		return nil, fmt.Errorf("Spec ID event size %d exceeds remaining log length %d", header.EventSize, r.Len())
+	}
+	specID := make([]byte, header.EventSize)
+	if _, err := io.ReadFull(r, specID); err != nil {
+		return nil, fmt.Errorf("couldn't read Spec ID event: %w", err)
+	}
+
+	if EventType(header.Type) != EvNoAction || !bytes.HasPrefix(specID, []byte(specIDSignature)) {
+		return nil, fmt.Errorf("event log is not in the crypto-agile format")
+	}
+
+	algorithms, err := parseSpecIDEvent(specID)
+	if err != nil {
+		return nil, err
+	}
+
+	log := &EventLog{Algorithms: algorithms}
+	for seq := 1; r.Len() > 0; seq++ {
+		event, err := readEvent(r, algorithms)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read event %d: %w", seq, err)
+		}
+		event.Sequence = seq
+		log.Events = append(log.Events, *event)
+	}
+
+	return log, nil
+}
+
+func parseSpecIDEvent(specID []byte) (map[tpm2.Algorithm]uint16, error) {
+	r := bytes.NewReader(specID[len(specIDSignature):])
+
+	var spec struct {
+		PlatformClass    uint32
+		VersionMinor     uint8
+		VersionMajor     uint8
+		Errata           uint8
+		UintnSize        uint8
+		NumberAlgorithms uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &spec); err != nil {
+		return nil, fmt.Errorf("couldn't read Spec ID event: %w", err)
+	}
+
+	algorithms := make(map[tpm2.Algorithm]uint16)
+	for i := uint32(0); i < spec.NumberAlgorithms; i++ {
+		var alg struct {
+			ID   uint16
+			Size uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &alg); err != nil {
+			return nil, fmt.Errorf("couldn't read Spec ID digest sizes: %w", err)
+		}
+		algorithms[tpm2.Algorithm(alg.ID)] = alg.Size
+	}
+
+	return algorithms, nil
+}
+
+func readEvent(r *bytes.Reader, algorithms map[tpm2.Algorithm]uint16) (*Event, error) {
+	var header struct {
+		PCR         uint32
+		Type        uint32
+		DigestCount uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("couldn't read event header: %w", err)
+	}
+
+	event := &Event{
+		PCR:     int(header.PCR),
+		Type:    EventType(header.Type),
+		Digests: make(map[tpm2.Algorithm][]byte),
+	}
+
+	for i := uint32(0); i < header.DigestCount; i++ {
+		var algID uint16
+		if err := binary.Read(r, binary.LittleEndian, &algID); err != nil {
+			return nil, fmt.Errorf("couldn't read digest algorithm: %w", err)
+		}
+
+		size, ok := algorithms[tpm2.Algorithm(algID)]
+		if !ok {
+			return nil, fmt.Errorf("digest algorithm 0x%x not declared in Spec ID event", algID)
+		}
+
+		digest := make([]byte, size)
+		if _, err := io.ReadFull(r, digest); err != nil {
+			return nil, fmt.Errorf("couldn't read digest: %w", err)
+		}
+		event.Digests[tpm2.Algorithm(algID)] = digest
+	}
+
+	var eventSize uint32
+	if err := binary.Read(r, binary.LittleEndian, &eventSize); err != nil {
+		return nil, fmt.Errorf("couldn't read event size: %w", err)
+	}
+	if int64(eventSize) > int64(r.Len()) {
+		return nil, fmt.Errorf("event size %d exceeds remaining log length %d", eventSize, r.Len())
+	}
+
+	event.Data = make([]byte, eventSize)
+	if _, err := io.ReadFull(r, event.Data); err != nil {
+		return nil, fmt.Errorf("couldn't read event data: %w", err)
+	}
+
+	return event, nil
+}
+
+// Replay recomputes the PCR values in the given bank by extending each
+// event digest in order
+func (l *EventLog) Replay(alg tpm2.Algorithm) (map[int][]byte, error) {
+	hash, err := alg.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get hash algorithm: %w", err)
+	}
+
+	pcrs := make(map[int][]byte)
+	for _, event := range l.Events {
+		if _, ok := pcrs[event.PCR]; !ok {
+			pcrs[event.PCR] = make([]byte, hash.Size())
+		}
+
+		if event.Type == EvNoAction {
+			// The startup locality is reflected in the initial value of PCR 0
+			if event.PCR == 0 && bytes.HasPrefix(event.Data, []byte(startupLocalitySignature)) && len(event.Data) > len(startupLocalitySignature) {
+				pcrs[0][hash.Size()-1] = event.Data[len(startupLocalitySignature)]
+			}
+			continue
+		}
+
+		digest := event.Digest(alg)
+		if digest == nil {
+			return nil, fmt.Errorf("event %d has no %s digest", event.Sequence, alg)
+		}
+
+		pcrs[event.PCR] = extendDigest(hash, pcrs[event.PCR], digest)
+	}
+
+	return pcrs, nil
+}
+
+// Verify replays the event log and checks the result against the given PCR
+// values. PCRs absent from the log are not checked. The events of PCRs that
+// aren't given can't be verified, so they are removed from the log.
+func (l *EventLog) Verify(alg tpm2.Algorithm, pcrs []PCRValue) error {
+	replayed, err := l.Replay(alg)
+	if err != nil {
+		return err
+	}
+
+	verified := make(map[int]bool)
+	for _, pcr := range pcrs {
+		verified[pcr.Index] = true
+		value, ok := replayed[pcr.Index]
+		if !ok {
+			continue
+		}
+		if !bytes.Equal(value, pcr.Value) {
+			return fmt.Errorf("PCR %d replay mismatch, expected %x, got %x", pcr.Index, pcr.Value, value)
+		}
+	}
+
+	l.Events = slices.DeleteFunc(l.Events, func(event Event) bool {
+		return !verified[event.PCR]
+	})
+
+	return nil
+}
+
+// Filter returns the events extended into the given PCR with the given type
+func (l *EventLog) Filter(pcr int, eventType EventType) []Event {
+	var events []Event
+	for _, event := range l.Events {
+		if event.PCR == pcr && event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+const grubKernelCmdlinePrefix = "kernel_cmdline: "
+
+// KernelCmdlinePCR is the PCR GRUB measures the kernel command line into
+const KernelCmdlinePCR = 8
+
+// KernelCmdline returns the kernel command line measured by GRUB into PCR 8,
+// or an empty string if none was measured
+func (l *EventLog) KernelCmdline() string {
+	for _, event := range l.Filter(KernelCmdlinePCR, EvIPL) {
+		if s := event.String(); strings.HasPrefix(s, grubKernelCmdlinePrefix) {
+			return s[len(grubKernelCmdlinePrefix):]
+		}
+	}
+	return ""
+}
+
+const grubCommandPrefix = "grub_cmd: "
+
+// GrubLoadedFile returns the path and SHA-256 digest of the file loaded by the
+// last GRUB command of the given name, e.g. linux or initrd. GRUB measures the
+// command into PCR 8, then the file it loads into PCR 9.
+func (l *EventLog) GrubLoadedFile(command string) (string, []byte, error) {
+	prefix := grubCommandPrefix + command + " "
+
+	var path string
+	var digest []byte
+	for _, event := range l.Events {
+		s := event.String()
+		switch {
+		case event.PCR == 8 && event.Type == EvIPL && strings.HasPrefix(s, prefix):
+			path, _, _ = strings.Cut(s[len(prefix):], " ")
+			digest = nil
+		case event.PCR == 9 && event.Type == EvIPL && path != "" && digest == nil && strings.HasSuffix(s, path):
+			digest = event.Digest(tpm2.AlgSHA256)
+		}
+	}
+
+	if path == "" {
+		return "", nil, fmt.Errorf("no GRUB %s command in the boot event log", command)
+	}
+	if digest == nil {
+		return "", nil, fmt.Errorf("no measurement of %s in the boot event log", path)
+	}
+	return path, digest, nil
+}
+
+func extendDigest(hash crypto.Hash, value []byte, digest []byte) []byte {
+	hasher := hash.New()
+	hasher.Write(value)
+	hasher.Write(digest)
+	return hasher.Sum(nil)
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"golang.org/x/exp/slices"
+)
+
+// loadExampleAttestation reads the recorded Azure attestation of the examples,
+// which quotes PCRs 0-9 and 11 and whose boot log also has PCR 14 events
+func loadExampleAttestation(t *testing.T) (*Attestation, *tpm2.AttestationData) {
+	t.Helper()
+
+	data, err := os.ReadFile("../../examples/attest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestation, err := ParseAttestation(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quote, err := tpm2.DecodeAttestationData(attestation.QuoteData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attestation, quote
+}
+
+// relabelPCR returns a copy of the PCR values with from labeled as to
+func relabelPCR(pcrs []PCRValue, from int, to int) []PCRValue {
+	relabeled := slices.Clone(pcrs)
+	for i := range relabeled {
+		if relabeled[i].Index == from {
+			relabeled[i].Index = to
+		}
+	}
+	return relabeled
+}
+
+func TestCheckPCRSelection(t *testing.T) {
+	attestation, quote := loadExampleAttestation(t)
+	selection := quote.AttestedQuoteInfo.PCRSelection.PCRs
+
+	tests := []struct {
+		name    string
+		pcrs    []PCRValue
+		wantErr string
+	}{
+		{"recorded", attestation.PCRs, ""},
+		// Still in digest order, so the PCR digest would verify
+		{"relabeled", relabelPCR(attestation.PCRs, 9, 10), "don't match the quoted PCR selection"},
+		{"missing", attestation.PCRs[1:], "don't match the quoted PCR selection"},
+		{"duplicate", append(slices.Clone(attestation.PCRs), attestation.PCRs[0]), "don't match the quoted PCR selection"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkError(t, CheckPCRSelection(selection, test.pcrs), test.wantErr)
+		})
+	}
+}
+
+func TestEventLogVerify(t *testing.T) {
+	attestation, quote := loadExampleAttestation(t)
+	alg := quote.AttestedQuoteInfo.PCRSelection.Hash
+	isPCR14 := func(event Event) bool { return event.PCR == 14 }
+
+	t.Run("drops unquoted PCRs", func(t *testing.T) {
+		log, err := ParseEventLog(attestation.BootEventLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.ContainsFunc(log.Events, isPCR14) {
+			t.Fatal("recorded boot log has no PCR 14 events")
+		}
+
+		err = log.Verify(alg, attestation.PCRs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.ContainsFunc(log.Events, isPCR14) {
+			t.Fatal("Verify() kept the events of the unquoted PCR 14")
+		}
+		if _, _, err := log.GrubLoadedFile("linux"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// A PCR 9 value relabeled as PCR 10 leaves the PCR 9 events, including
+	// the kernel measurement, unverified
+	t.Run("relabeled PCR", func(t *testing.T) {
+		log, err := ParseEventLog(attestation.BootEventLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = log.Verify(alg, relabelPCR(attestation.PCRs, 9, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = log.GrubLoadedFile("linux")
+		if err == nil || !strings.Contains(err.Error(), "no measurement") {
+			t.Fatalf("GrubLoadedFile() = %v, want no kernel measurement", err)
+		}
+	})
+}
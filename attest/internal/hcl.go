@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// HCLReportNVIndex is the NV index where Azure confidential VMs expose the
+// HCL report
+const HCLReportNVIndex = 0x01400001
+
+// HCL report types, i.e. the kind of hardware report it wraps
+const (
+	HCLReportTypeSNP = 2
+	HCLReportTypeTDX = 4
+)
+
+const (
+	hclHeaderSize     = 32
+	hclHWReportSize   = 1184
+	hclDataHeaderSize = 20
+	hclAKPubKeyID     = "HCLAkPub"
+	hclSignatureMagic = "HCLA"
+	hclHashTypeSHA256 = 1
+	hclHashTypeSHA384 = 2
+	hclHashTypeSHA512 = 3
+)
+
+// HCLReport is the report generated by the Azure paravisor (HCL) at boot. It
+// binds the vTPM keys, carried in the runtime data, to a hardware report whose
+// report data is the hash of the runtime data.
+type HCLReport struct {
+	Type        uint32
+	HWReport    []byte
+	RuntimeData []byte
+	hashType    uint32
+}
+
+// ParseHCLReport parses an HCL report as read from HCLReportNVIndex. The NV
+// index is usually larger than the report, trailing bytes are ignored.
+func ParseHCLReport(data []byte) (*HCLReport, error) {
+	if len(data) < hclHeaderSize+hclHWReportSize+hclDataHeaderSize {
+		return nil, fmt.Errorf("HCL report too short (%d bytes)", len(data))
+	}
+	if string(data[:4]) != hclSignatureMagic {
+		return nil, fmt.Errorf("missing HCL report signature")
+	}
+
+	dataHeader := data[hclHeaderSize+hclHWReportSize:]
+	report := &HCLReport{
+		Type:     binary.LittleEndian.Uint32(dataHeader[8:12]),
+		HWReport: data[hclHeaderSize : hclHeaderSize+hclHWReportSize],
+		hashType: binary.LittleEndian.Uint32(dataHeader[12:16]),
+	}
+
+	runtimeDataSize := binary.LittleEndian.Uint32(dataHeader[16:20])
+	runtimeData := dataHeader[hclDataHeaderSize:]
+	if uint32(len(runtimeData)) < runtimeDataSize {
+		return nil, fmt.Errorf("HCL report runtime data truncated")
+	}
+	report.RuntimeData = runtimeData[:runtimeDataSize]
+
+	return report, nil
+}
+
+// RuntimeDataHash is the hash of the runtime data that the hardware report
+// must carry in its report data
+func (r *HCLReport) RuntimeDataHash() ([]byte, error) {
+	switch r.hashType {
+	case hclHashTypeSHA256:
+		sum := sha256.Sum256(r.RuntimeData)
+		return sum[:], nil
+	case hclHashTypeSHA384:
+		sum := sha512.Sum384(r.RuntimeData)
+		return sum[:], nil
+	case hclHashTypeSHA512:
+		sum := sha512.Sum512(r.RuntimeData)
+		return sum[:], nil
+	default:
+		return nil, fmt.Errorf("unknown HCL runtime data hash type %d", r.hashType)
+	}
+}
+
+// CheckReportData checks that the report data of the hardware report is the
+// hash of the runtime data, zero padded
+func (r *HCLReport) CheckReportData(reportData []byte) error {
+	hash, err := r.RuntimeDataHash()
+	if err != nil {
+		return err
+	}
+
+	expected := make([]byte, len(reportData))
+	copy(expected, hash)
+	if !bytes.Equal(reportData, expected) {
+		return fmt.Errorf("hardware report data %x doesn't match the HCL runtime data hash %x", reportData, hash)
+	}
+
+	return nil
+}
+
+// AKPublicKey returns the vTPM AK public key from the runtime data
+func (r *HCLReport) AKPublicKey() (crypto.PublicKey, error) {
+	var claims struct {
+		Keys []struct {
+			KeyID   string `json:"kid"`
+			KeyType string `json:"kty"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	err := json.Unmarshal(bytes.TrimRight(r.RuntimeData, "\x00"), &claims)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize HCL runtime data: %w", err)
+	}
+
+	for _, key := range claims.Keys {
+		if key.KeyID != hclAKPubKeyID {
+			continue
+		}
+		if key.KeyType != "RSA" {
+			return nil, fmt.Errorf("unsupported %s key type %s", hclAKPubKeyID, key.KeyType)
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode %s modulus: %w", hclAKPubKeyID, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode %s exponent: %w", hclAKPubKeyID, err)
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no %s key in HCL runtime data", hclAKPubKeyID)
+}
+
+// CheckAKBinding checks that the runtime data carries the given AK public key
+func (r *HCLReport) CheckAKBinding(akPub crypto.PublicKey) error {
+	boundAK, err := r.AKPublicKey()
+	if err != nil {
+		return err
+	}
+
+	if !publicKeysEqual(boundAK, akPub) {
+		return fmt.Errorf("AK public key isn't bound in the HCL report")
+	}
+
+	return nil
+}
@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// IMAPCR is the PCR the Linux Integrity Measurement Architecture extends
+const IMAPCR = 10
+
+// IMABinaryMeasurementsPath is where the kernel exposes the IMA log in the
+// binary format that ParseIMALog reads
+const IMABinaryMeasurementsPath = "/sys/kernel/security/ima/binary_runtime_measurements"
+
+const (
+	imaTemplateNG  = "ima-ng"
+	imaTemplateSig = "ima-sig"
+
+	// The first entry measures the boot aggregate rather than a file
+	imaBootAggregate = "boot_aggregate"
+)
+
+// IMAEntry is an entry of the IMA runtime measurement log, decoded from the
+// ima-ng or ima-sig template data
+type IMAEntry struct {
+	Sequence     int
+	PCR          int
+	TemplateHash []byte // SHA1 of the template data, zero for violations
+	Template     string
+	TemplateData []byte
+
+	Algorithm string // hash algorithm of the file digest, e.g. sha256
+	Digest    []byte
+	Path      string
+	Signature []byte // ima-sig only
+}
+
+// Violation reports whether the entry records a measurement violation, e.g.
+// a file opened for write while being measured. Violations extend the PCR
+// with all ones instead of the template hash.
+func (e *IMAEntry) Violation() bool {
+	return bytes.Equal(e.TemplateHash, make([]byte, len(e.TemplateHash)))
+}
+
+// IMALog is a parsed IMA runtime measurement log
+type IMALog struct {
+	Entries []IMAEntry
+}
+
+// ParseIMALog parses an IMA log as exposed at IMABinaryMeasurementsPath.
+// Only the ima-ng and ima-sig templates are supported.
+func ParseIMALog(data []byte) (*IMALog, error) {
+	r := bytes.NewReader(data)
+
+	log := &IMALog{}
+	for seq := 1; r.Len() > 0; seq++ {
+		entry, err := readIMAEntry(r)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read IMA entry %d: %w", seq, err)
+		}
+		entry.Sequence = seq
+		log.Entries = append(log.Entries, *entry)
+	}
+
+	return log, nil
+}
+
+func readIMAEntry(r *bytes.Reader) (*IMAEntry, error) {
+	var header struct {
+		PCR          uint32
+		TemplateHash [20]byte
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("couldn't read entry header: %w", err)
+	}
+
+	name, err := readIMAField(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read template name: %w", err)
+	}
+
+	entry := &IMAEntry{
+		PCR:          int(header.PCR),
+		TemplateHash: header.TemplateHash[:],
+		Template:     string(name),
+	}
+
+	entry.TemplateData, err = readIMAField(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read template data: %w", err)
+	}
+
+	if entry.Template != imaTemplateNG && entry.Template != imaTemplateSig {
+		return nil, fmt.Errorf("unsupported IMA template %s", entry.Template)
+	}
+
+	fields := bytes.NewReader(entry.TemplateData)
+
+	// d-ng: "<algorithm>:\0" followed by the file digest
+	digest, err := readIMAField(fields)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file digest: %w", err)
+	}
+	algorithm, fileDigest, found := bytes.Cut(digest, []byte(":\x00"))
+	if !found {
+		return nil, fmt.Errorf("malformed file digest field")
+	}
+	entry.Algorithm = string(algorithm)
+	entry.Digest = fileDigest
+
+	// n-ng: NUL-terminated path
+	path, err := readIMAField(fields)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file path: %w", err)
+	}
+	entry.Path = strings.TrimRight(string(path), "\x00")
+
+	if entry.Template == imaTemplateSig {
+		entry.Signature, err = readIMAField(fields)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read file signature: %w", err)
+		}
+	}
+
+	return entry, nil
+}
+
+func readIMAField(r *bytes.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if int64(size) > int64(r.Len()) {
+		return nil, fmt.Errorf("field size %d exceeds remaining length %d", size, r.Len())
+	}
+
+	field := make([]byte, size)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// Verify replays the log into a PCR bank of the given hash and returns the
+// number of entries whose replay matches the quoted PCR value. Entries may be
+// appended to the log between the quote and reading the log, so the trailing
+// entries after the first match are ignored.
+func (l *IMALog) Verify(hash crypto.Hash, pcrValue []byte) (int, error) {
+	value := make([]byte, hash.Size())
+	if bytes.Equal(value, pcrValue) {
+		return 0, nil
+	}
+
+	violation := bytes.Repeat([]byte{0xff}, hash.Size())
+	for i, entry := range l.Entries {
+		if entry.PCR != IMAPCR {
+			return 0, fmt.Errorf("IMA entry %d extends PCR %d, expected %d", entry.Sequence, entry.PCR, IMAPCR)
+		}
+
+		digest := violation
+		if !entry.Violation() {
+			hasher := hash.New()
+			hasher.Write(entry.TemplateData)
+			digest = hasher.Sum(nil)
+		}
+
+		value = extendDigest(hash, value, digest)
+		if bytes.Equal(value, pcrValue) {
+			return i + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("PCR %d replay mismatch, expected %x, got %x", IMAPCR, pcrValue, value)
+}
+
+// imaHashes maps the IMA names of the file digest algorithms to their hashes
+var imaHashes = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// IMAAllowlist maps the "<algorithm>:<hex digest>" of the files allowed to be
+// measured by IMA to their allowed paths. An empty path allows the digest for
+// any file.
+type IMAAllowlist map[string][]string
+
+// LoadIMAAllowlist reads an allowlist in the sha256sum output format, one
+// "<hex digest>  <path>" line per file. The digest may be prefixed with its
+// algorithm, e.g. sha512:<hex>, otherwise the algorithm follows from its
+// length. Lines without a path allow the digest for any file. Empty lines and
+// lines starting with # are ignored.
+func LoadIMAAllowlist(path string) (IMAAllowlist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read IMA allowlist: %w", err)
+	}
+	defer file.Close()
+
+	allowlist := make(IMAAllowlist)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		digestField, filePath, _ := strings.Cut(text, " ")
+		algorithm, digestHex, found := strings.Cut(digestField, ":")
+		if !found {
+			digestHex = digestField
+			algorithm = ""
+		}
+
+		digest, err := hex.DecodeString(digestHex)
+		if err != nil {
+			return nil, fmt.Errorf("IMA allowlist line %d: invalid digest %s", line, digestField)
+		}
+
+		if algorithm == "" {
+			for name, hash := range imaHashes {
+				if hash.Size() == len(digest) {
+					algorithm = name
+				}
+			}
+		}
+		hash, ok := imaHashes[strings.ToLower(algorithm)]
+		if !ok || hash.Size() != len(digest) {
+			return nil, fmt.Errorf("IMA allowlist line %d: unsupported digest %s", line, digestField)
+		}
+
+		key := imaAllowlistKey(strings.ToLower(algorithm), digest)
+		allowlist[key] = append(allowlist[key], strings.TrimLeft(strings.TrimSpace(filePath), "*"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read IMA allowlist: %w", err)
+	}
+
+	return allowlist, nil
+}
+
+func imaAllowlistKey(algorithm string, digest []byte) string {
+	return algorithm + ":" + hex.EncodeToString(digest)
+}
+
+// IMACheckOptions are the options of IMAAllowlist.Check
+type IMACheckOptions struct {
+	// PCRs are the quoted PCR values of the bank of Hash, which the boot
+	// aggregate must match
+	PCRs []PCRValue
+	Hash crypto.Hash
+
+	// AllowViolations accepts measurement violations, whose file contents
+	// weren't measured
+	AllowViolations bool
+}
+
+// Check checks that the digest of every measured file is in the allowlist,
+// for the file's path and digest algorithm, and that the boot aggregate
+// matches the quoted PCRs. Violations fail the check unless allowed.
+func (a IMAAllowlist) Check(entries []IMAEntry, opts IMACheckOptions) error {
+	for i, entry := range entries {
+		if entry.Violation() {
+			if !opts.AllowViolations {
+				return fmt.Errorf("IMA entry %d: measurement violation for %s", entry.Sequence, entry.Path)
+			}
+			continue
+		}
+
+		if i == 0 && entry.Path == imaBootAggregate {
+			err := CheckIMABootAggregate(&entry, opts.PCRs, opts.Hash)
+			if err != nil {
+				return fmt.Errorf("IMA entry %d: %w", entry.Sequence, err)
+			}
+			continue
+		}
+
+		paths, ok := a[imaAllowlistKey(entry.Algorithm, entry.Digest)]
+		if !ok {
+			return fmt.Errorf("IMA entry %d: %s with %s digest %x is not in the allowlist", entry.Sequence, entry.Path, entry.Algorithm, entry.Digest)
+		}
+		if !slices.Contains(paths, "") && !slices.Contains(paths, entry.Path) {
+			return fmt.Errorf("IMA entry %d: %s digest %x is not allowed for %s", entry.Sequence, entry.Algorithm, entry.Digest, entry.Path)
+		}
+	}
+
+	return nil
+}
+
+// CheckIMABootAggregate checks the boot aggregate entry against the quoted
+// PCRs of the bank of the given hash. The boot aggregate hashes PCRs 0-7, and
+// PCRs 8-9 for digests other than SHA1, as IMA read them at initialization.
+func CheckIMABootAggregate(entry *IMAEntry, pcrs []PCRValue, hash crypto.Hash) error {
+	if entry.Path != imaBootAggregate {
+		return fmt.Errorf("entry %s is not the boot aggregate", entry.Path)
+	}
+	if imaHashes[entry.Algorithm] != hash {
+		return fmt.Errorf("boot aggregate is a %s digest, but the quoted PCRs are of the %s bank", entry.Algorithm, hash)
+	}
+
+	last := 9
+	if hash == crypto.SHA1 {
+		last = 7
+	}
+
+	hasher := hash.New()
+	for index := 0; index <= last; index++ {
+		idx := slices.IndexFunc(pcrs, func(pcr PCRValue) bool {
+			return pcr.Index == index
+		})
+		if idx == -1 {
+			return fmt.Errorf("no PCR %d value found for the boot aggregate", index)
+		}
+		hasher.Write(pcrs[idx].Value)
+	}
+
+	if aggregate := hasher.Sum(nil); !bytes.Equal(aggregate, entry.Digest) {
+		return fmt.Errorf("boot aggregate mismatch, expected %x, got %x", aggregate, entry.Digest)
+	}
+
+	return nil
+}
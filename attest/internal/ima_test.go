@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+// imaField encodes a length-prefixed IMA template field
+func imaField(data []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...)
+}
+
+// newTestIMAEntry encodes an ima-ng entry of the binary log. Violations have a
+// zero template hash.
+func newTestIMAEntry(pcr uint32, algorithm string, digest []byte, path string, violation bool) []byte {
+	var templateData []byte
+	templateData = append(templateData, imaField(append([]byte(algorithm+":\x00"), digest...))...)
+	templateData = append(templateData, imaField([]byte(path+"\x00"))...)
+
+	templateHash := make([]byte, sha1.Size)
+	if !violation {
+		sum := sha1.Sum(templateData)
+		templateHash = sum[:]
+	}
+
+	entry := binary.LittleEndian.AppendUint32(nil, pcr)
+	entry = append(entry, templateHash...)
+	entry = append(entry, imaField([]byte(imaTemplateNG))...)
+	return append(entry, imaField(templateData)...)
+}
+
+// replayIMA extends the SHA-256 template data digests of the entries, or all
+// ones for violations, as the TPM does
+func replayIMA(t *testing.T, log []byte) []byte {
+	t.Helper()
+
+	parsed, err := ParseIMALog(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := make([]byte, sha256.Size)
+	for _, entry := range parsed.Entries {
+		digest := bytes.Repeat([]byte{0xff}, sha256.Size)
+		if !entry.Violation() {
+			sum := sha256.Sum256(entry.TemplateData)
+			digest = sum[:]
+		}
+		value = extendDigest(crypto.SHA256, value, digest)
+	}
+	return value
+}
+
+// testBootPCRs returns distinct values of PCRs 0-9 in the bank of hash
+func testBootPCRs(hash crypto.Hash) []PCRValue {
+	var pcrs []PCRValue
+	for index := 0; index <= 9; index++ {
+		pcrs = append(pcrs, PCRValue{Index: index, Value: bytes.Repeat([]byte{byte(index + 1)}, hash.Size())})
+	}
+	return pcrs
+}
+
+// testBootAggregate hashes the values of PCRs 0 to last
+func testBootAggregate(hash crypto.Hash, pcrs []PCRValue, last int) []byte {
+	hasher := hash.New()
+	for _, pcr := range pcrs[:last+1] {
+		hasher.Write(pcr.Value)
+	}
+	return hasher.Sum(nil)
+}
+
+func TestIMALogVerify(t *testing.T) {
+	file := bytes.Repeat([]byte{0xaa}, sha256.Size)
+	first := newTestIMAEntry(IMAPCR, "sha256", file, "/usr/bin/first", false)
+	violation := newTestIMAEntry(IMAPCR, "sha256", make([]byte, sha256.Size), "/var/log/written", true)
+	trailing := newTestIMAEntry(IMAPCR, "sha256", file, "/usr/bin/trailing", false)
+
+	quoted := bytes.Join([][]byte{first, violation}, nil)
+	quotedValue := replayIMA(t, quoted)
+
+	tests := []struct {
+		name      string
+		log       []byte
+		pcrValue  []byte
+		wantCount int
+		wantErr   string
+	}{
+		{"replayed", quoted, quotedValue, 2, ""},
+		// A violation extends all ones, not the digest of its template data
+		{"violation", quoted, replayIMA(t, first), 1, ""},
+		{"trailing entry after the quote", bytes.Join([][]byte{first, violation, trailing}, nil), quotedValue, 2, ""},
+		{"nothing measured", quoted, make([]byte, sha256.Size), 0, ""},
+		{"mismatch", quoted, bytes.Repeat([]byte{1}, sha256.Size), 0, "replay mismatch"},
+		{"other PCR", newTestIMAEntry(11, "sha256", file, "/usr/bin/first", false), quotedValue, 0, "extends PCR 11"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log, err := ParseIMALog(test.log)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			count, err := log.Verify(crypto.SHA256, test.pcrValue)
+			checkError(t, err, test.wantErr)
+			if count != test.wantCount {
+				t.Fatalf("Verify() = %d entries, want %d", count, test.wantCount)
+			}
+		})
+	}
+}
+
+func TestIMAAllowlistCheck(t *testing.T) {
+	file := bytes.Repeat([]byte{0xaa}, sha256.Size)
+	allowlist := IMAAllowlist{
+		imaAllowlistKey("sha256", file): {"/usr/bin/allowed"},
+	}
+
+	sha256PCRs := testBootPCRs(crypto.SHA256)
+	sha1PCRs := testBootPCRs(crypto.SHA1)
+
+	entry := func(log []byte) IMAEntry {
+		parsed, err := ParseIMALog(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Entries[0]
+	}
+	allowed := entry(newTestIMAEntry(IMAPCR, "sha256", file, "/usr/bin/allowed", false))
+	violation := entry(newTestIMAEntry(IMAPCR, "sha256", make([]byte, sha256.Size), "/var/log/written", true))
+
+	tests := []struct {
+		name    string
+		entries []IMAEntry
+		opts    IMACheckOptions
+		wantErr string
+	}{
+		{"allowed", []IMAEntry{allowed}, IMACheckOptions{}, ""},
+		{"path mismatch", []IMAEntry{entry(newTestIMAEntry(IMAPCR, "sha256", file, "/usr/bin/renamed", false))}, IMACheckOptions{}, "not allowed for /usr/bin/renamed"},
+		{"not in the allowlist", []IMAEntry{entry(newTestIMAEntry(IMAPCR, "sha256", make([]byte, sha256.Size), "/usr/bin/allowed", false))}, IMACheckOptions{}, "not in the allowlist"},
+		{"violation", []IMAEntry{allowed, violation}, IMACheckOptions{}, "measurement violation for /var/log/written"},
+		{"violation allowed", []IMAEntry{allowed, violation}, IMACheckOptions{AllowViolations: true}, ""},
+
+		// SHA-256 boot aggregates hash PCRs 0-9, SHA-1 ones PCRs 0-7
+		{"SHA-256 boot aggregate",
+			[]IMAEntry{entry(newTestIMAEntry(IMAPCR, "sha256", testBootAggregate(crypto.SHA256, sha256PCRs, 9), imaBootAggregate, false)), allowed},
+			IMACheckOptions{PCRs: sha256PCRs, Hash: crypto.SHA256}, ""},
+		{"SHA-1 boot aggregate",
+			[]IMAEntry{entry(newTestIMAEntry(IMAPCR, "sha1", testBootAggregate(crypto.SHA1, sha1PCRs, 7), imaBootAggregate, false)), allowed},
+			IMACheckOptions{PCRs: sha1PCRs, Hash: crypto.SHA1}, ""},
+		{"SHA-256 boot aggregate of PCRs 0-7",
+			[]IMAEntry{entry(newTestIMAEntry(IMAPCR, "sha256", testBootAggregate(crypto.SHA256, sha256PCRs, 7), imaBootAggregate, false))},
+			IMACheckOptions{PCRs: sha256PCRs, Hash: crypto.SHA256}, "boot aggregate mismatch"},
+		{"SHA-1 boot aggregate of the SHA-256 bank",
+			[]IMAEntry{entry(newTestIMAEntry(IMAPCR, "sha1", testBootAggregate(crypto.SHA1, sha1PCRs, 7), imaBootAggregate, false))},
+			IMACheckOptions{PCRs: sha256PCRs, Hash: crypto.SHA256}, "quoted PCRs are of the SHA-256 bank"},
+		{"boot aggregate without PCR 9",
+			[]IMAEntry{entry(newTestIMAEntry(IMAPCR, "sha256", testBootAggregate(crypto.SHA256, sha256PCRs, 9), imaBootAggregate, false))},
+			IMACheckOptions{PCRs: sha256PCRs[:9], Hash: crypto.SHA256}, "no PCR 9 value"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkError(t, allowlist.Check(test.entries, test.opts), test.wantErr)
+		})
+	}
+}
+
+func TestParseIMALogTruncated(t *testing.T) {
+	entry := newTestIMAEntry(IMAPCR, "sha256", bytes.Repeat([]byte{0xaa}, sha256.Size), "/usr/bin/allowed", false)
+
+	// The template data field claims more bytes than the log has left
+	truncatedData := bytes.Clone(entry[:len(entry)-8])
+
+	// The path field claims more bytes than the template data has left
+	templateDataOffset := 4 + sha1.Size + len(imaField([]byte(imaTemplateNG)))
+	truncatedPath := bytes.Clone(entry)
+	pathSizeOffset := templateDataOffset + 4 + len(imaField(append([]byte("sha256:\x00"), make([]byte, sha256.Size)...)))
+	binary.LittleEndian.PutUint32(truncatedPath[pathSizeOffset:], 1000)
+
+	tests := []struct {
+		name    string
+		log     []byte
+		wantErr string
+	}{
+		{"truncated header", entry[:10], "couldn't read entry header"},
+		{"truncated template data", truncatedData, "exceeds remaining length"},
+		{"truncated path", truncatedPath, "couldn't read file path: field size 1000 exceeds remaining length"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseIMALog(test.log)
+			checkError(t, err, test.wantErr)
+		})
+	}
+
+	field, err := readIMAField(bytes.NewReader(imaField([]byte("boot_aggregate"))))
+	if err != nil || string(field) != "boot_aggregate" {
+		t.Fatalf("readIMAField() = %q, %v, want boot_aggregate", field, err)
+	}
+	_, err = readIMAField(bytes.NewReader([]byte{1, 0}))
+	if err == nil {
+		t.Fatal("readIMAField() of a truncated size succeeded")
+	}
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"golang.org/x/exp/slices"
+)
+
+// AttestationSummary is the decoded, human-readable content of an
+// attestation. It is not verified.
+type AttestationSummary struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	TPM        *TPMInfo      `json:"tpm,omitempty"`
+	Platform   *PlatformInfo `json:"platform,omitempty"`
+	Evidence   []string      `json:"evidence"`
+
+	AKCert    *CertificateSummary `json:"akCert,omitempty"`
+	EKCert    *CertificateSummary `json:"ekCert,omitempty"`
+	AKName    string              `json:"akName,omitempty"`
+	Quote     *QuoteSummary       `json:"quote,omitempty"`
+	Signature string              `json:"signature,omitempty"`
+
+	PCRs         []PCRSummary   `json:"pcrs"`
+	BootEvents   []EventSummary `json:"bootEvents"`
+	VerityEvents []string       `json:"verityEvents"`
+	IMAEvents    []EventSummary `json:"imaEvents,omitempty"`
+
+	ContainerEvents []ContainerEvent `json:"containerEvents,omitempty"`
+}
+
+// CertificateSummary describes an AK or EK certificate
+type CertificateSummary struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serialNumber"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+	PublicKey    string    `json:"publicKey"`
+}
+
+// QuoteSummary is the decoded TPMS_ATTEST of the quote
+type QuoteSummary struct {
+	QualifiedSigner string `json:"qualifiedSigner"`
+	Nonce           string `json:"nonce"`
+	Clock           uint64 `json:"clock"`
+	ResetCount      uint32 `json:"resetCount"`
+	RestartCount    uint32 `json:"restartCount"`
+	Safe            bool   `json:"safe"`
+	FirmwareVersion string `json:"firmwareVersion"`
+	PCRBank         string `json:"pcrBank"`
+	PCRs            []int  `json:"pcrs"`
+	PCRDigest       string `json:"pcrDigest"`
+}
+
+// PCRSummary is a PCR value of the attestation
+type PCRSummary struct {
+	Index int    `json:"index"`
+	Value string `json:"value"`
+}
+
+// EventSummary is a decoded boot or IMA event
+type EventSummary struct {
+	Sequence    int    `json:"sequence"`
+	PCR         int    `json:"pcr"`
+	Type        string `json:"type"`
+	Digest      string `json:"digest"`
+	Description string `json:"description"`
+}
+
+// InspectAttestation decodes the evidence of an attestation without
+// verifying it
+func InspectAttestation(a *Attestation) (*AttestationSummary, error) {
+	summary := &AttestationSummary{
+		APIVersion:   a.APIVersion,
+		Kind:         a.Kind,
+		TPM:          a.TPM,
+		Platform:     a.Platform,
+		PCRs:         []PCRSummary{},
+		BootEvents:   []EventSummary{},
+		VerityEvents: VerityEvents(a.VerityEventLog),
+	}
+
+	for _, evidence := range a.Evidence {
+		summary.Evidence = append(summary.Evidence, evidence.Type)
+	}
+
+	var err error
+	if len(a.AkCert) > 0 {
+		summary.AKCert, err = summarizeCertificate(a.AkCert)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse AK certificate: %w", err)
+		}
+	}
+	if len(a.EkCert) > 0 {
+		summary.EKCert, err = summarizeCertificate(a.EkCert)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse EK certificate: %w", err)
+		}
+	}
+
+	if len(a.AkPublic) > 0 {
+		akPub, err := tpm2.DecodePublic(a.AkPublic)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode AK public area: %w", err)
+		}
+		akName, err := akPub.Name()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't compute AK name: %w", err)
+		}
+		summary.AKName = fmt.Sprintf("%s:%x", akName.Digest.Alg, akName.Digest.Value)
+	}
+
+	if len(a.QuoteData) > 0 {
+		summary.Quote, err = summarizeQuote(a.QuoteData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(a.QuoteSignature) > 0 {
+		signature, err := tpm2.DecodeSignature(bytes.NewBuffer(a.QuoteSignature))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse quote signature: %w", err)
+		}
+		summary.Signature = signature.Alg.String()
+		if signature.RSA != nil {
+			summary.Signature += "-" + signature.RSA.HashAlg.String()
+		} else if signature.ECC != nil {
+			summary.Signature += "-" + signature.ECC.HashAlg.String()
+		}
+	}
+
+	pcrs := make([]PCRValue, len(a.PCRs))
+	copy(pcrs, a.PCRs)
+	sort.Slice(pcrs, func(i, j int) bool {
+		return pcrs[i].Index < pcrs[j].Index
+	})
+	for _, pcr := range pcrs {
+		summary.PCRs = append(summary.PCRs, PCRSummary{Index: pcr.Index, Value: hex.EncodeToString(pcr.Value)})
+	}
+
+	if len(a.BootEventLog) > 0 {
+		bootEventLog, err := ParseEventLog(a.BootEventLog)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse boot event log: %w", err)
+		}
+		for _, event := range DiffEvents(bootEventLog) {
+			summary.BootEvents = append(summary.BootEvents, EventSummary{
+				Sequence:    event.Sequence,
+				PCR:         event.PCR,
+				Type:        event.Type,
+				Digest:      hex.EncodeToString(event.Digest),
+				Description: event.Description,
+			})
+		}
+	}
+
+	if len(a.IMAEventLog) > 0 {
+		imaLog, err := ParseIMALog(a.IMAEventLog)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse IMA event log: %w", err)
+		}
+		for _, entry := range imaLog.Entries {
+			summary.IMAEvents = append(summary.IMAEvents, EventSummary{
+				Sequence:    entry.Sequence,
+				PCR:         entry.PCR,
+				Type:        entry.Template,
+				Digest:      entry.Algorithm + ":" + hex.EncodeToString(entry.Digest),
+				Description: entry.Path,
+			})
+		}
+	}
+
+	if len(a.ContainerEventLog) > 0 {
+		containerLog, err := ParseContainerLog(a.ContainerEventLog)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse container event log: %w", err)
+		}
+		for _, entry := range containerLog.Entries {
+			summary.ContainerEvents = append(summary.ContainerEvents, entry.Event)
+		}
+	}
+
+	return summary, nil
+}
+
+func summarizeCertificate(der []byte) (*CertificateSummary, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return &CertificateSummary{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.Text(16),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		PublicKey:    fmt.Sprintf("%s sha256:%x", cert.PublicKeyAlgorithm, fingerprint),
+	}, nil
+}
+
+func summarizeQuote(quoteData []byte) (*QuoteSummary, error) {
+	quote, err := tpm2.DecodeAttestationData(quoteData)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse quote: %w", err)
+	}
+	if quote.Type != tpm2.TagAttestQuote || quote.AttestedQuoteInfo == nil {
+		return nil, fmt.Errorf("attested data type is not a quote")
+	}
+
+	clock := NewClockObservation(quote)
+	summary := &QuoteSummary{
+		Nonce:           hex.EncodeToString(quote.ExtraData),
+		Clock:           clock.Clock,
+		ResetCount:      clock.ResetCount,
+		RestartCount:    clock.RestartCount,
+		Safe:            clock.Safe,
+		FirmwareVersion: fmt.Sprintf("%016x", clock.FirmwareVersion),
+		PCRBank:         quote.AttestedQuoteInfo.PCRSelection.Hash.String(),
+		PCRs:            append([]int{}, quote.AttestedQuoteInfo.PCRSelection.PCRs...),
+		PCRDigest:       hex.EncodeToString(quote.AttestedQuoteInfo.PCRDigest),
+	}
+	sort.Ints(summary.PCRs)
+
+	if quote.QualifiedSigner.Digest != nil {
+		summary.QualifiedSigner = fmt.Sprintf("%s:%x", quote.QualifiedSigner.Digest.Alg, quote.QualifiedSigner.Digest.Value)
+	}
+
+	return summary, nil
+}
+
+// VerityEvents splits a verity event log into its events
+func VerityEvents(verityLog []byte) []string {
+	verityString := string(verityLog[:])
+	verityLogs := strings.Split(verityString, "\n")
+	return slices.DeleteFunc(verityLogs, func(s string) bool {
+		return s == ""
+	})
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed platforms.yaml
+var defaultPlatforms []byte
+
+// PlatformProfile describes where a platform's vTPM keeps the AK and EK and
+// which CAs issue its AK certificates
+type PlatformProfile struct {
+	Description       string   `yaml:"description"`
+	AKHandle          uint32   `yaml:"akHandle"`
+	AKTemplateNVIndex uint32   `yaml:"akTemplateNVIndex"`
+	AKCertNVIndex     uint32   `yaml:"akCertNVIndex"`
+	EKHandle          uint32   `yaml:"ekHandle"`
+	EKCertNVIndex     uint32   `yaml:"ekCertNVIndex"`
+	RootCAs           []string `yaml:"rootCAs"`
+	IntermediateCAs   []string `yaml:"intermediateCAs"`
+
+	// AKEKUs are the EKUs required in AK certificates. Defaults to
+	// tcg-kp-AIKCertificate.
+	AKEKUs []string `yaml:"akEKUs"`
+}
+
+type platformsFile struct {
+	Platforms map[string]*PlatformProfile `yaml:"platforms"`
+}
+
+// LoadPlatformProfiles returns the built-in platform profiles, extended or
+// overridden by the profiles in path if set
+func LoadPlatformProfiles(path string) (map[string]*PlatformProfile, error) {
+	var builtin platformsFile
+	err := yaml.Unmarshal(defaultPlatforms, &builtin)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize built-in platform profiles: %w", err)
+	}
+
+	if path == "" {
+		return builtin.Platforms, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read platform profiles: %w", err)
+	}
+
+	var custom platformsFile
+	err = yaml.Unmarshal(data, &custom)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize platform profiles: %w", err)
+	}
+
+	for name, profile := range custom.Platforms {
+		builtin.Platforms[name] = profile
+	}
+
+	return builtin.Platforms, nil
+}
+
+// LookupPlatform returns the named platform profile
+func LookupPlatform(name string, path string) (*PlatformProfile, error) {
+	profiles, err := LoadPlatformProfiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown platform %s, expected one of %v", name, names)
+	}
+
+	return profile, nil
+}
+
+// FlagValues maps the profile to the values of the command line flags it
+// provides defaults for
+func (p *PlatformProfile) FlagValues() map[string][]string {
+	values := map[string][]string{
+		"ak-location":          {fmt.Sprintf("%d", p.AKHandle)},
+		"ak-template-location": {fmt.Sprintf("%d", p.AKTemplateNVIndex)},
+		"cert-location":        {fmt.Sprintf("%d", p.AKCertNVIndex)},
+		"ek-location":          {fmt.Sprintf("%d", p.EKHandle)},
+		"ek-cert-location":     {fmt.Sprintf("%d", p.EKCertNVIndex)},
+		"root-ca-path":         p.RootCAs,
+		"intermediate-ca-path": p.IntermediateCAs,
+	}
+	if p.AKEKUs != nil {
+		values["ak-eku"] = p.AKEKUs
+	}
+	return values
+}
@@ -0,0 +1,377 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is a set of CEL rules evaluated against a verified attestation.
+// Every rule must evaluate to true for the attestation to be accepted.
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules"`
+
+	// Digest is the SHA-256 of the policy file
+	Digest []byte `yaml:"-"`
+
+	programs []cel.Program
+}
+
+type PolicyRule struct {
+	Name       string `yaml:"name"`
+	Expression string `yaml:"expression"`
+	Message    string `yaml:"message,omitempty"`
+
+	// TrustClaim is the attestation result claim the rule appraises, one of
+	// instance-identity, configuration, executables or file-system. Defaults
+	// to configuration.
+	TrustClaim TrustClaim `yaml:"trustClaim,omitempty"`
+}
+
+// PolicyRuleError reports the rule that rejected an attestation
+type PolicyRuleError struct {
+	Rule PolicyRule
+	Err  error
+}
+
+func (e *PolicyRuleError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PolicyRuleError) Unwrap() error {
+	return e.Err
+}
+
+// PolicyInput holds the verified contents of an attestation that are exposed
+// to policy rules
+type PolicyInput struct {
+	PCRs         []PCRValue
+	QuotedPCRs   []int
+	Nonce        []byte
+	Clock        ClockObservation
+	AKCert       *x509.Certificate
+	BootEventLog *EventLog
+	VerityEvents []string
+	VerityHash   []byte
+	IMAEntries   []IMAEntry
+	Containers   []ContainerLogEntry
+	SecureBoot   *SecureBootState
+	SNPReport    *SNPReport
+	TDXQuote     *TDXQuote
+}
+
+func policyEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("pcrs", cel.MapType(cel.IntType, cel.StringType)),
+		cel.Variable("quotedPcrs", cel.ListType(cel.IntType)),
+		cel.Variable("nonce", cel.StringType),
+		cel.Variable("clock", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("akCert", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("bootEvents", cel.ListType(cel.MapType(cel.StringType, cel.DynType))),
+		cel.Variable("verityEvents", cel.ListType(cel.StringType)),
+		cel.Variable("verityHash", cel.StringType),
+		cel.Variable("cmdline", cel.StringType),
+		cel.Variable("imaEvents", cel.ListType(cel.MapType(cel.StringType, cel.DynType))),
+		cel.Variable("containers", cel.ListType(cel.MapType(cel.StringType, cel.DynType))),
+		cel.Variable("secureBoot", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("snp", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("tdx", cel.MapType(cel.StringType, cel.DynType)),
+	)
+}
+
+// LoadPolicy reads a YAML policy file and compiles its rules
+func LoadPolicy(path string) (*Policy, error) {
+	policyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read policy: %w", err)
+	}
+
+	var policy Policy
+	err = yaml.Unmarshal(policyBytes, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize policy: %w", err)
+	}
+
+	if len(policy.Rules) == 0 {
+		return nil, fmt.Errorf("policy %s has no rules", path)
+	}
+
+	digest := sha256.Sum256(policyBytes)
+	policy.Digest = digest[:]
+
+	env, err := policyEnv()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create CEL environment: %w", err)
+	}
+
+	for i, rule := range policy.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("policy rule %d has no name", i)
+		}
+
+		if rule.TrustClaim == "" {
+			policy.Rules[i].TrustClaim = TrustClaimConfiguration
+		} else if _, err := ParseTrustClaim(string(rule.TrustClaim)); err != nil {
+			return nil, fmt.Errorf("policy rule %s: %w", rule.Name, err)
+		}
+
+		ast, iss := env.Compile(rule.Expression)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("couldn't compile policy rule %s: %w", rule.Name, iss.Err())
+		}
+
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("policy rule %s must evaluate to a bool, got %s", rule.Name, ast.OutputType())
+		}
+
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't build policy rule %s: %w", rule.Name, err)
+		}
+		policy.programs = append(policy.programs, program)
+	}
+
+	return &policy, nil
+}
+
+// Appraises reports whether any rule of the policy appraises the claim
+func (p *Policy) Appraises(claim TrustClaim) bool {
+	for _, rule := range p.Rules {
+		if rule.TrustClaim == claim {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate runs every rule against the input and returns an error naming the
+// first rule that is not satisfied
+func (p *Policy) Evaluate(input *PolicyInput) error {
+	activation := input.activation()
+
+	for i, program := range p.programs {
+		rule := p.Rules[i]
+
+		out, _, err := program.Eval(activation)
+		if err != nil {
+			return &PolicyRuleError{Rule: rule, Err: fmt.Errorf("policy rule %s failed to evaluate: %w", rule.Name, err)}
+		}
+
+		if out != types.True {
+			if rule.Message != "" {
+				return &PolicyRuleError{Rule: rule, Err: fmt.Errorf("policy rule %s not satisfied: %s", rule.Name, rule.Message)}
+			}
+			return &PolicyRuleError{Rule: rule, Err: fmt.Errorf("policy rule %s not satisfied: %s", rule.Name, rule.Expression)}
+		}
+	}
+
+	return nil
+}
+
+func (input *PolicyInput) activation() map[string]any {
+	pcrs := make(map[int64]string)
+	for _, pcr := range input.PCRs {
+		pcrs[int64(pcr.Index)] = hex.EncodeToString(pcr.Value)
+	}
+
+	quotedPcrs := make([]int64, 0, len(input.QuotedPCRs))
+	for _, pcr := range input.QuotedPCRs {
+		quotedPcrs = append(quotedPcrs, int64(pcr))
+	}
+	sort.Slice(quotedPcrs, func(i, j int) bool {
+		return quotedPcrs[i] < quotedPcrs[j]
+	})
+
+	akCert := make(map[string]any)
+	if input.AKCert != nil {
+		akCert["subject"] = input.AKCert.Subject.String()
+		akCert["issuer"] = input.AKCert.Issuer.String()
+		akCert["serialNumber"] = input.AKCert.SerialNumber.Text(16)
+		akCert["notBefore"] = input.AKCert.NotBefore
+		akCert["notAfter"] = input.AKCert.NotAfter
+	}
+
+	bootEvents := []map[string]any{}
+	cmdline := ""
+	if input.BootEventLog != nil {
+		for _, event := range input.BootEventLog.Events {
+			bootEvents = append(bootEvents, map[string]any{
+				"sequence": int64(event.Sequence),
+				"pcr":      int64(event.PCR),
+				"type":     event.Type.String(),
+				"digest":   hex.EncodeToString(event.Digest(tpm2.AlgSHA256)),
+				"data":     event.Data,
+			})
+		}
+		cmdline = input.BootEventLog.KernelCmdline()
+	}
+
+	verityEvents := input.VerityEvents
+	if verityEvents == nil {
+		verityEvents = []string{}
+	}
+
+	imaEvents := []map[string]any{}
+	for _, entry := range input.IMAEntries {
+		imaEvents = append(imaEvents, map[string]any{
+			"sequence":  int64(entry.Sequence),
+			"template":  entry.Template,
+			"path":      entry.Path,
+			"algorithm": entry.Algorithm,
+			"digest":    hex.EncodeToString(entry.Digest),
+			"signed":    len(entry.Signature) > 0,
+			"violation": entry.Violation(),
+		})
+	}
+
+	containers := []map[string]any{}
+	for _, entry := range input.Containers {
+		mounts := []map[string]any{}
+		for _, mount := range entry.Event.Mounts {
+			options := mount.Options
+			if options == nil {
+				options = []string{}
+			}
+			mounts = append(mounts, map[string]any{
+				"source":      mount.Source,
+				"destination": mount.Destination,
+				"options":     options,
+			})
+		}
+		args := entry.Event.Args
+		if args == nil {
+			args = []string{}
+		}
+		containers = append(containers, map[string]any{
+			"sequence":    int64(entry.Sequence),
+			"imageName":   entry.Event.ImageName,
+			"imageDigest": entry.Event.ImageDigest,
+			"args":        args,
+			"mounts":      mounts,
+		})
+	}
+
+	secureBoot := make(map[string]any)
+	if input.SecureBoot != nil {
+		state := input.SecureBoot
+		authorities := []map[string]any{}
+		for _, authority := range state.Authorities {
+			entry := efiSignatureActivation(authority.Signature)
+			entry["sequence"] = int64(authority.Sequence)
+			entry["variable"] = authority.Variable
+			authorities = append(authorities, entry)
+		}
+
+		components := []map[string]any{}
+		for _, component := range state.Components {
+			authority := ""
+			if component.Authority != nil {
+				authority = component.Authority.Signature.Subject()
+			}
+			components = append(components, map[string]any{
+				"sequence":  int64(component.Sequence),
+				"digest":    hex.EncodeToString(component.Digest),
+				"authority": authority,
+			})
+		}
+
+		secureBoot["enabled"] = state.Enabled
+		secureBoot["pk"] = efiSignaturesActivation(state.PK)
+		secureBoot["kek"] = efiSignaturesActivation(state.KEK)
+		secureBoot["db"] = efiSignaturesActivation(state.DB)
+		secureBoot["dbx"] = efiSignaturesActivation(state.DBX)
+		secureBoot["authorities"] = authorities
+		secureBoot["components"] = components
+	}
+
+	snp := make(map[string]any)
+	if input.SNPReport != nil {
+		report := input.SNPReport
+		snp["measurement"] = hex.EncodeToString(report.Measurement)
+		snp["hostData"] = hex.EncodeToString(report.HostData)
+		snp["familyId"] = hex.EncodeToString(report.FamilyID)
+		snp["imageId"] = hex.EncodeToString(report.ImageID)
+		snp["chipId"] = hex.EncodeToString(report.ChipID)
+		snp["policy"] = report.Policy
+		snp["debug"] = report.Debug()
+		snp["guestSvn"] = uint64(report.GuestSVN)
+		snp["vmpl"] = uint64(report.VMPL)
+		snp["reportedTcb"] = map[string]any{
+			"bootloader": uint64(report.ReportedTCB.Bootloader),
+			"tee":        uint64(report.ReportedTCB.TEE),
+			"snp":        uint64(report.ReportedTCB.SNP),
+			"microcode":  uint64(report.ReportedTCB.Microcode),
+		}
+	}
+
+	tdx := make(map[string]any)
+	if input.TDXQuote != nil {
+		quote := input.TDXQuote
+		rtmrs := make([]string, 0, len(quote.RTMRs))
+		for _, rtmr := range quote.RTMRs {
+			rtmrs = append(rtmrs, hex.EncodeToString(rtmr))
+		}
+		tdx["mrtd"] = hex.EncodeToString(quote.MRTD)
+		tdx["rtmrs"] = rtmrs
+		tdx["mrSeam"] = hex.EncodeToString(quote.MRSEAM)
+		tdx["mrConfigId"] = hex.EncodeToString(quote.MRConfigID)
+		tdx["mrOwner"] = hex.EncodeToString(quote.MROwner)
+		tdx["mrOwnerConfig"] = hex.EncodeToString(quote.MROwnerConfig)
+		tdx["teeTcbSvn"] = hex.EncodeToString(quote.TEETCBSVN)
+		tdx["tdAttributes"] = quote.TDAttributes
+		tdx["xfam"] = quote.XFAM
+		tdx["debug"] = quote.Debug()
+	}
+
+	return map[string]any{
+		"pcrs":       pcrs,
+		"quotedPcrs": quotedPcrs,
+		"nonce":      hex.EncodeToString(input.Nonce),
+		"clock": map[string]any{
+			"clock":           input.Clock.Clock,
+			"resetCount":      uint64(input.Clock.ResetCount),
+			"restartCount":    uint64(input.Clock.RestartCount),
+			"safe":            input.Clock.Safe,
+			"firmwareVersion": input.Clock.FirmwareVersion,
+		},
+		"akCert":       akCert,
+		"bootEvents":   bootEvents,
+		"verityEvents": verityEvents,
+		"verityHash":   hex.EncodeToString(input.VerityHash),
+		"cmdline":      cmdline,
+		"imaEvents":    imaEvents,
+		"containers":   containers,
+		"secureBoot":   secureBoot,
+		"snp":          snp,
+		"tdx":          tdx,
+	}
+}
+
+func efiSignaturesActivation(signatures []EFISignature) []map[string]any {
+	entries := []map[string]any{}
+	for _, signature := range signatures {
+		entries = append(entries, efiSignatureActivation(signature))
+	}
+	return entries
+}
+
+func efiSignatureActivation(signature EFISignature) map[string]any {
+	entry := map[string]any{
+		"type":    signature.Type,
+		"subject": signature.Subject(),
+		"issuer":  "",
+		"sha256":  hex.EncodeToString(signature.Hash),
+	}
+	if signature.Certificate != nil {
+		entry["issuer"] = signature.Certificate.Issuer.String()
+	}
+	return entry
+}
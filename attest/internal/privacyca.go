@@ -0,0 +1,402 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"gopkg.in/yaml.v3"
+)
+
+// PrivacyCA issues AK certificates to TPMs that prove, through credential
+// activation, that their AK is resident on the same TPM as a trusted EK.
+//
+// The CA state is kept in a directory:
+//
+//	ca.pem          CA certificate
+//	ca-key.pem      CA private key
+//	issued/*.pem    issued AK certificates, named by serial number
+type PrivacyCA struct {
+	Dir  string
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// AKCertTemplate configures the AK certificates issued by a privacy CA
+type AKCertTemplate struct {
+	Subject struct {
+		CommonName         string   `yaml:"commonName"`
+		Organization       []string `yaml:"organization"`
+		OrganizationalUnit []string `yaml:"organizationalUnit"`
+		Country            []string `yaml:"country"`
+	} `yaml:"subject"`
+	Validity              time.Duration `yaml:"validity"`
+	Policies              []string      `yaml:"policies"`
+	ExtKeyUsages          []string      `yaml:"extKeyUsages"`
+	CRLDistributionPoints []string      `yaml:"crlDistributionPoints"`
+}
+
+const (
+	caCertFile  = "ca.pem"
+	caKeyFile   = "ca-key.pem"
+	caIssuedDir = "issued"
+)
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// InitPrivacyCA creates a new CA key and self-signed certificate in dir
+func InitPrivacyCA(dir string, commonName string, validity time.Duration) (*PrivacyCA, error) {
+	if _, err := os.Stat(filepath.Join(dir, caKeyFile)); err == nil {
+		return nil, fmt.Errorf("CA already initialized in %s", dir)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate CA key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create CA certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse CA certificate: %w", err)
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't serialize CA key: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Join(dir, caIssuedDir), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create CA directory: %w", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, caKeyFile), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't write CA key: %w", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, caCertFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't write CA certificate: %w", err)
+	}
+
+	return &PrivacyCA{Dir: dir, Cert: cert, Key: key}, nil
+}
+
+// OpenPrivacyCA loads a CA previously created with InitPrivacyCA
+func OpenPrivacyCA(dir string) (*PrivacyCA, error) {
+	certBytes, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CA certificate: %w", err)
+	}
+
+	certs, err := ParsePEMCertificates(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse CA certificate: %w", err)
+	}
+
+	keyBytes, err := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CA key: %w", err)
+	}
+
+	key, err := ParsePEMPrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse CA key: %w", err)
+	}
+
+	return &PrivacyCA{Dir: dir, Cert: certs[0], Key: key}, nil
+}
+
+// LoadAKCertTemplate reads a YAML AK certificate template
+func LoadAKCertTemplate(path string) (*AKCertTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read AK certificate template: %w", err)
+	}
+
+	var template AKCertTemplate
+	err = yaml.Unmarshal(data, &template)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize AK certificate template: %w", err)
+	}
+
+	return &template, nil
+}
+
+// Issue validates the request and issues an AK certificate for it. The
+// certificate is returned wrapped in a credential challenge, and is stored in
+// the CA directory. If ekTrust is nil, the EK certificate isn't validated.
+func (ca *PrivacyCA) Issue(req *AKCertRequest, template *AKCertTemplate, ekTrust *TrustStore, currentTime time.Time) (*AKCertChallenge, *x509.Certificate, error) {
+	if ekTrust != nil {
+		if len(req.EkCert) == 0 {
+			return nil, nil, fmt.Errorf("request has no EK certificate")
+		}
+
+		ekCert, err := ParseEKCertificate(req.EkCert)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = ekTrust.VerifyEKCert(ekCert, currentTime)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't verify EK certificate: %w", err)
+		}
+	}
+
+	err := ValidateAKPublic(req.AkPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certTemplate, err := template.certificate(req.AkPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	validity := template.Validity
+	if validity == 0 {
+		validity = 365 * 24 * time.Hour
+	}
+
+	akCertBytes, err := IssueAKCert(req.AkPublic, certTemplate, validity, ca.Cert, ca.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	akCert, err := x509.ParseCertificate(akCertBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't parse issued AK certificate: %w", err)
+	}
+
+	challenge, err := NewAKCertChallenge(req, akCertBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't create credential challenge: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Join(ca.Dir, caIssuedDir), 0700)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(ca.Dir, caIssuedDir, akCert.SerialNumber.Text(16)+".pem"),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: akCertBytes}), 0644)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't store issued AK certificate: %w", err)
+	}
+
+	return challenge, akCert, nil
+}
+
+// Issued returns the AK certificates issued by the CA, oldest first
+func (ca *PrivacyCA) Issued() ([]*x509.Certificate, error) {
+	entries, err := os.ReadDir(filepath.Join(ca.Dir, caIssuedDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't read issued certificates: %w", err)
+	}
+
+	var certs []*x509.Certificate
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(ca.Dir, caIssuedDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		fileCerts, err := ParsePEMCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		certs = append(certs, fileCerts...)
+	}
+
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].NotBefore.Before(certs[j].NotBefore)
+	})
+
+	return certs, nil
+}
+
+func (t *AKCertTemplate) certificate(akPublic []byte) (x509.Certificate, error) {
+	cert := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         t.Subject.CommonName,
+			Organization:       t.Subject.Organization,
+			OrganizationalUnit: t.Subject.OrganizationalUnit,
+			Country:            t.Subject.Country,
+		},
+		CRLDistributionPoints: t.CRLDistributionPoints,
+	}
+
+	if cert.Subject.CommonName == "" {
+		akPub, err := tpm2.DecodePublic(akPublic)
+		if err != nil {
+			return cert, fmt.Errorf("couldn't decode AK public area: %w", err)
+		}
+		akName, err := akPub.Name()
+		if err != nil {
+			return cert, fmt.Errorf("couldn't compute AK name: %w", err)
+		}
+		cert.Subject.CommonName = fmt.Sprintf("AK %x", akName.Digest.Value)
+	}
+
+	for _, policy := range t.Policies {
+		oid, err := ParseOID(policy)
+		if err != nil {
+			return cert, fmt.Errorf("couldn't parse certificate policy: %w", err)
+		}
+		cert.PolicyIdentifiers = append(cert.PolicyIdentifiers, oid)
+	}
+
+	for _, eku := range t.ExtKeyUsages {
+		oid, err := ParseOID(eku)
+		if err != nil {
+			return cert, fmt.Errorf("couldn't parse extended key usage: %w", err)
+		}
+		cert.UnknownExtKeyUsage = append(cert.UnknownExtKeyUsage, oid)
+	}
+
+	return cert, nil
+}
+
+// VerifyEKCert validates an EK certificate against the TPM manufacturer roots
+// and intermediates of the trust store
+func (t *TrustStore) VerifyEKCert(ekCert *x509.Certificate, currentTime time.Time) error {
+	// EK certificates put the TPM manufacturer, model and version in a
+	// critical subject alternative name with only a directoryName, which the
+	// x509 package leaves unhandled
+	cert := *ekCert
+	cert.UnhandledCriticalExtensions = nil
+	for _, ext := range ekCert.UnhandledCriticalExtensions {
+		if !ext.Equal(oidSubjectAltName) {
+			cert.UnhandledCriticalExtensions = append(cert.UnhandledCriticalExtensions, ext)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	for _, root := range t.Roots {
+		roots.AddCert(root)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range t.Intermediates {
+		intermediates.AddCert(intermediate)
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   currentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// ValidateAKPublic checks that the AK public area describes a restricted
+// signing key that was generated by, and can't leave, the TPM
+func ValidateAKPublic(akPublic []byte) error {
+	akPub, err := tpm2.DecodePublic(akPublic)
+	if err != nil {
+		return fmt.Errorf("couldn't decode AK public area: %w", err)
+	}
+
+	required := []struct {
+		flag tpm2.KeyProp
+		name string
+	}{
+		{tpm2.FlagFixedTPM, "fixedTPM"},
+		{tpm2.FlagFixedParent, "fixedParent"},
+		{tpm2.FlagSensitiveDataOrigin, "sensitiveDataOrigin"},
+		{tpm2.FlagRestricted, "restricted"},
+		{tpm2.FlagSign, "sign"},
+	}
+
+	for _, attr := range required {
+		if akPub.Attributes&attr.flag == 0 {
+			return fmt.Errorf("AK public area doesn't have the %s attribute", attr.name)
+		}
+	}
+
+	if akPub.Attributes&tpm2.FlagDecrypt != 0 {
+		return fmt.Errorf("AK public area has the decrypt attribute")
+	}
+
+	return nil
+}
+
+// CheckAKPublic checks that the AK public area has the attributes of an AK
+// and carries the certified public key, and returns the AK name
+func CheckAKPublic(akPublic []byte, certified crypto.PublicKey) ([]byte, error) {
+	err := ValidateAKPublic(akPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	akPub, err := tpm2.DecodePublic(akPublic)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode AK public area: %w", err)
+	}
+
+	key, err := akPub.Key()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get AK public key: %w", err)
+	}
+	if !publicKeysEqual(key, certified) {
+		return nil, fmt.Errorf("AK public area doesn't match the certified key")
+	}
+
+	akName, err := akPub.Name()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't compute AK name: %w", err)
+	}
+
+	// The name is the name algorithm followed by the digest of the public area
+	alg := akName.Digest.Alg
+	return append([]byte{byte(alg >> 8), byte(alg)}, akName.Digest.Value...), nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate serial number: %w", err)
+	}
+	return serial, nil
+}
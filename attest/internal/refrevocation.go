@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// RefValueRevocationsPayloadType is the DSSE payload type of reference value
+// revocation lists
+const RefValueRevocationsPayloadType = "application/vnd.image-attestation.ref-value-revocations+json"
+
+// RefValueRevocations is a signed list of build images whose reference values
+// must no longer verify, e.g. because of a CVE. Like a CRL, the list is only
+// valid until its next update, so that an older list missing a revocation
+// can't be replayed for long.
+type RefValueRevocations struct {
+	Sequence    uint64               `json:"sequence"`
+	IssuedAt    time.Time            `json:"issuedAt"`
+	NextUpdate  time.Time            `json:"nextUpdate"`
+	Revocations []RefValueRevocation `json:"revocations"`
+}
+
+// RefValueRevocation revokes the reference values of a build image
+type RefValueRevocation struct {
+	ImageDigest string    `json:"imageDigest"` // hex SHA-256
+	Reason      string    `json:"reason"`
+	RevokedAt   time.Time `json:"revokedAt"`
+}
+
+// LoadRefValueRevocations reads a revocation list from a DSSE envelope signed
+// by one of the keys
+func LoadRefValueRevocations(path string, keys []crypto.PublicKey) (*RefValueRevocations, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read reference value revocations: %w", err)
+	}
+
+	payload, err := verifyEnvelope(data, keys, RefValueRevocationsPayloadType)
+	if err != nil {
+		return nil, fmt.Errorf("reference value revocations %s: %w", path, err)
+	}
+
+	revocations := &RefValueRevocations{}
+	err = json.Unmarshal(payload, revocations)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize reference value revocations: %w", err)
+	}
+
+	return revocations, nil
+}
+
+// Issue increments the sequence number and sets the list's validity, before
+// signing a new version of it
+func (r *RefValueRevocations) Issue(at time.Time, validFor time.Duration) error {
+	if validFor <= 0 {
+		return fmt.Errorf("revocation list validity must be positive, got %s", validFor)
+	}
+
+	r.Sequence++
+	r.IssuedAt = at.UTC().Truncate(time.Second)
+	r.NextUpdate = r.IssuedAt.Add(validFor)
+	return nil
+}
+
+// CheckFresh fails if the list wasn't issued yet or is past its next update
+// at the given time
+func (r *RefValueRevocations) CheckFresh(at time.Time) error {
+	if r.IssuedAt.IsZero() || r.NextUpdate.IsZero() {
+		return fmt.Errorf("reference value revocations have no issuedAt or nextUpdate time")
+	}
+	if at.Before(r.IssuedAt) {
+		return fmt.Errorf("reference value revocations %d are issued at %s, after %s",
+			r.Sequence, r.IssuedAt.Format(time.RFC3339), at.Format(time.RFC3339))
+	}
+	if at.After(r.NextUpdate) {
+		return fmt.Errorf("reference value revocations %d expired at %s",
+			r.Sequence, r.NextUpdate.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Sign serializes the list and signs it into a DSSE envelope
+func (r *RefValueRevocations) Sign(key crypto.Signer) ([]byte, error) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't serialize reference value revocations: %w", err)
+	}
+
+	return signEnvelope(RefValueRevocationsPayloadType, payload, key)
+}
+
+// Revoke adds an image to the list, or updates the reason it was revoked for
+func (r *RefValueRevocations) Revoke(imageDigest string, reason string, at time.Time) error {
+	imageDigest = strings.ToLower(strings.TrimPrefix(imageDigest, "sha256:"))
+	decoded, err := hex.DecodeString(imageDigest)
+	if err != nil || len(decoded) != 32 {
+		return fmt.Errorf("invalid image SHA-256 digest %q", imageDigest)
+	}
+
+	if existing := r.Lookup(imageDigest); existing != nil {
+		existing.Reason = reason
+		return nil
+	}
+
+	r.Revocations = append(r.Revocations, RefValueRevocation{
+		ImageDigest: imageDigest,
+		Reason:      reason,
+		RevokedAt:   at.UTC().Truncate(time.Second),
+	})
+	return nil
+}
+
+// Lookup returns the revocation of an image, or nil if it isn't revoked
+func (r *RefValueRevocations) Lookup(imageDigest string) *RefValueRevocation {
+	if r == nil {
+		return nil
+	}
+
+	for i, revocation := range r.Revocations {
+		if strings.EqualFold(revocation.ImageDigest, imageDigest) {
+			return &r.Revocations[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefValueRevocationsCheckFresh(t *testing.T) {
+	revocations := &RefValueRevocations{}
+	err := revocations.Issue(testNow, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		revocations *RefValueRevocations
+		at          time.Time
+		wantErr     string
+	}{
+		{"fresh", revocations, testNow.Add(time.Hour), ""},
+		{"at issue", revocations, testNow, ""},
+		{"at next update", revocations, testNow.Add(7 * 24 * time.Hour), ""},
+		// A stale list could be an older one replayed without later revocations
+		{"after next update", revocations, testNow.Add(7*24*time.Hour + time.Second), "expired at"},
+		{"before issue", revocations, testNow.Add(-time.Hour), "are issued at"},
+		{"never issued", &RefValueRevocations{}, testNow, "no issuedAt or nextUpdate"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkError(t, test.revocations.CheckFresh(test.at), test.wantErr)
+		})
+	}
+}
+
+func TestRefValueRevocationsIssue(t *testing.T) {
+	revocations := &RefValueRevocations{}
+	for sequence := uint64(1); sequence <= 2; sequence++ {
+		err := revocations.Issue(testNow, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revocations.Sequence != sequence {
+			t.Fatalf("Issue() sequence = %d, want %d", revocations.Sequence, sequence)
+		}
+	}
+
+	checkError(t, revocations.Issue(testNow, 0), "must be positive")
+}
+
+func TestLoadRefValueRevocations(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revocations := &RefValueRevocations{}
+	digest := testImageDigest(2)
+	err = revocations.Revoke("sha256:"+digest, "CVE-2024-0001", testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = revocations.Issue(testNow, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := revocations.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	err = os.WriteFile(path, envelope, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadRefValueRevocations(path, []crypto.PublicKey{key.Public()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revocation := loaded.Lookup(digest); revocation == nil || revocation.Reason != "CVE-2024-0001" {
+		t.Fatalf("Lookup() = %v, want the revocation of %s", revocation, digest)
+	}
+	if loaded.Lookup(testImageDigest(1)) != nil {
+		t.Fatal("Lookup() found a revocation of an image that isn't revoked")
+	}
+
+	_, err = LoadRefValueRevocations(path, []crypto.PublicKey{otherKey.Public()})
+	if err == nil {
+		t.Fatal("LoadRefValueRevocations() accepted a list signed by an untrusted key")
+	}
+}
@@ -0,0 +1,537 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	scai "github.com/in-toto/attestation/go/predicates/scai/v0"
+	ita "github.com/in-toto/attestation/go/v1"
+	"golang.org/x/exp/slices"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// RefValueSet is a verified set of reference values of one build image, as
+// generated by ref-values. Values that the set doesn't assert are nil.
+type RefValueSet struct {
+	// Path is the file the set was loaded from
+	Path string
+
+	ImageName   string
+	ImageDigest string // hex SHA-256
+
+	// Producer describes the build that generated the set, if recorded
+	Producer *ita.ResourceDescriptor
+
+	Kernel        []byte
+	Initramfs     []byte
+	VerityHash    []byte
+	PCRs          []PCRValue
+	KernelCmdline *string
+
+	// Validity is the intersection of the validity windows of the assertions
+	Validity RefValueValidity
+}
+
+// Image names the build image of the set
+func (s *RefValueSet) Image() string {
+	if s.ImageName == "" {
+		return "sha256:" + s.ImageDigest
+	}
+	return fmt.Sprintf("%s (sha256:%s)", s.ImageName, s.ImageDigest)
+}
+
+// ExecutablesPCRs are the PCRs measuring the executables that boot: the
+// UEFI boot loaders (4) and the files GRUB loads, e.g. the kernel (9)
+var ExecutablesPCRs = []int{4, 9}
+
+// AppraisesExecutables reports whether matching the set compares the kernel,
+// the initramfs or one of the ExecutablesPCRs
+func (s *RefValueSet) AppraisesExecutables() bool {
+	return s.Kernel != nil || s.Initramfs != nil || slices.ContainsFunc(ExecutablesPCRs, func(index int) bool {
+		return hasPCR(s.PCRs, index)
+	})
+}
+
+// AppraisesConfiguration reports whether matching the set compares the kernel
+// command line, either directly or through PCR 8
+func (s *RefValueSet) AppraisesConfiguration() bool {
+	return s.KernelCmdline != nil || hasPCR(s.PCRs, KernelCmdlinePCR)
+}
+
+// AppraisesFileSystem reports whether matching the set compares the verity
+// root hash
+func (s *RefValueSet) AppraisesFileSystem() bool {
+	return s.VerityHash != nil
+}
+
+func hasPCR(pcrs []PCRValue, index int) bool {
+	for _, pcr := range pcrs {
+		if pcr.Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// Measurements are the verified measurements of an attestation that are
+// compared with reference values
+type Measurements struct {
+	PCRs          []PCRValue
+	VerityHash    []byte
+	Kernel        []byte // nil if the boot event log has no GRUB linux command
+	Initramfs     []byte // nil if the boot event log has no GRUB initrd command
+	KernelCmdline string
+
+	// KernelError and InitramfsError are why Kernel or Initramfs is nil
+	KernelError    error
+	InitramfsError error
+}
+
+// NewRefValueSet reads the reference values from a SCAI statement
+func NewRefValueSet(statement *ita.Statement) (*RefValueSet, error) {
+	subject, digest, report, err := parseRefValueStatement(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &RefValueSet{
+		ImageName:   subject.GetName(),
+		ImageDigest: digest,
+		Producer:    report.GetProducer(),
+	}
+	for _, assertion := range report.GetAttributes() {
+		err = set.setAttribute(assertion)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", assertion.GetAttribute(), err)
+		}
+	}
+
+	// A set without the root file system and PCR reference values would match
+	// other images
+	if set.VerityHash == nil {
+		return nil, fmt.Errorf("no verity hash reference value for image sha256:%s", digest)
+	}
+	if len(set.PCRs) == 0 {
+		return nil, fmt.Errorf("no VMM-set PCR reference values for image sha256:%s", digest)
+	}
+
+	return set, nil
+}
+
+// parseRefValueStatement returns the subject, its hex SHA-256 digest and the
+// SCAI report of a reference value statement
+func parseRefValueStatement(statement *ita.Statement) (*ita.ResourceDescriptor, string, *scai.AttributeReport, error) {
+	if statement.GetPredicateType() != SCAIPredicateType {
+		return nil, "", nil, fmt.Errorf("unexpected predicate type %s", statement.GetPredicateType())
+	}
+
+	if len(statement.GetSubject()) != 1 {
+		return nil, "", nil, fmt.Errorf("expected one image subject, got %d", len(statement.GetSubject()))
+	}
+	subject := statement.GetSubject()[0]
+	digest := strings.ToLower(subject.GetDigest()["sha256"])
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != 64 {
+		return nil, "", nil, fmt.Errorf("image subject has no SHA-256 digest")
+	}
+
+	predicateJSON, err := protojson.Marshal(statement.GetPredicate())
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("couldn't serialize SCAI report: %w", err)
+	}
+	report := &scai.AttributeReport{}
+	err = protojson.Unmarshal(predicateJSON, report)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("couldn't parse SCAI report: %w", err)
+	}
+
+	return subject, digest, report, nil
+}
+
+func (s *RefValueSet) setAttribute(assertion *scai.AttributeAssertion) error {
+	target := assertion.GetTarget()
+
+	err := s.Validity.intersect(assertion.GetConditions())
+	if err != nil {
+		return err
+	}
+
+	switch assertion.GetAttribute() {
+	case RefValueKernel:
+		return decodeTargetDigest(target, &s.Kernel)
+	case RefValueInitramfs:
+		return decodeTargetDigest(target, &s.Initramfs)
+	case RefValueVerityHash:
+		return decodeTargetDigest(target, &s.VerityHash)
+	case RefValueVMMPCRs:
+		var expectedPcrs ExpectedPCRs
+		err := json.Unmarshal(target.GetContent(), &expectedPcrs)
+		if err != nil {
+			return fmt.Errorf("couldn't deserialize expected PCR values: %w", err)
+		}
+		s.PCRs = expectedPcrs.PCRs
+	case RefValueKernelCmdline:
+		cmdline := string(target.GetContent())
+		s.KernelCmdline = &cmdline
+	}
+
+	return nil
+}
+
+func decodeTargetDigest(target *ita.ResourceDescriptor, digest *[]byte) error {
+	decoded, err := hex.DecodeString(target.GetDigest()["sha256"])
+	if err != nil || len(decoded) == 0 {
+		return fmt.Errorf("target has no SHA-256 digest")
+	}
+	*digest = decoded
+	return nil
+}
+
+// Match compares the measurements with every reference value the set
+// asserts
+func (s *RefValueSet) Match(m *Measurements) error {
+	if s.Kernel != nil && m.Kernel == nil {
+		return fmt.Errorf("kernel hash mismatch, expected %x: %w", s.Kernel, m.KernelError)
+	}
+	if s.Kernel != nil && !bytes.Equal(s.Kernel, m.Kernel) {
+		return fmt.Errorf("kernel hash mismatch, expected %x, got %x", s.Kernel, m.Kernel)
+	}
+	if s.Initramfs != nil && m.Initramfs == nil {
+		return fmt.Errorf("initramfs hash mismatch, expected %x: %w", s.Initramfs, m.InitramfsError)
+	}
+	if s.Initramfs != nil && !bytes.Equal(s.Initramfs, m.Initramfs) {
+		return fmt.Errorf("initramfs hash mismatch, expected %x, got %x", s.Initramfs, m.Initramfs)
+	}
+	if s.VerityHash != nil && !bytes.Equal(s.VerityHash, m.VerityHash) {
+		return fmt.Errorf("verity hash mismatch, expected %x, got %x", s.VerityHash, m.VerityHash)
+	}
+	if s.KernelCmdline != nil && *s.KernelCmdline != m.KernelCmdline {
+		return fmt.Errorf("kernel command line mismatch")
+	}
+
+	attestationPcrs := make(map[int][]byte)
+	for _, pcr := range m.PCRs {
+		attestationPcrs[pcr.Index] = pcr.Value
+	}
+	for _, expectedPcr := range s.PCRs {
+		if attestedPcr, ok := attestationPcrs[expectedPcr.Index]; !ok {
+			return fmt.Errorf("PCR %d missing from attestation", expectedPcr.Index)
+		} else if !bytes.Equal(expectedPcr.Value, attestedPcr) {
+			return fmt.Errorf("PCR %d value mismatch", expectedPcr.Index)
+		}
+	}
+
+	return nil
+}
+
+// ContainerRefValueSet is a verified set of reference values of a container
+// image, as generated by ref-values --container
+type ContainerRefValueSet struct {
+	// Path is the file the set was loaded from
+	Path string
+
+	ImageName   string
+	ImageDigest string // hex SHA-256 of the manifest, or of the config
+
+	ManifestDigest []byte
+	ConfigDigest   []byte
+	Layers         [][]byte // digests of the layer blobs
+	LayerDiffIDs   [][]byte // digests of the uncompressed layers of docker save archives
+	Entrypoint     *ContainerEntrypoint
+	Mounts         []ContainerMount // the allowed bind mounts
+
+	Producer *ita.ResourceDescriptor
+	Validity RefValueValidity
+}
+
+// Image names the container image of the set
+func (s *ContainerRefValueSet) Image() string {
+	if s.ImageName == "" {
+		return "sha256:" + s.ImageDigest
+	}
+	return fmt.Sprintf("%s (sha256:%s)", s.ImageName, s.ImageDigest)
+}
+
+// NewContainerRefValueSet reads the container reference values from a SCAI
+// statement
+func NewContainerRefValueSet(statement *ita.Statement) (*ContainerRefValueSet, error) {
+	subject, digest, report, err := parseRefValueStatement(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &ContainerRefValueSet{
+		ImageName:   subject.GetName(),
+		ImageDigest: digest,
+		Producer:    report.GetProducer(),
+	}
+	for _, assertion := range report.GetAttributes() {
+		err = set.setAttribute(assertion)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", assertion.GetAttribute(), err)
+		}
+	}
+
+	if set.ConfigDigest == nil {
+		return nil, fmt.Errorf("no container config reference value for image sha256:%s", digest)
+	}
+	if set.Entrypoint == nil {
+		return nil, fmt.Errorf("no container entrypoint reference value for image sha256:%s", digest)
+	}
+
+	return set, nil
+}
+
+func (s *ContainerRefValueSet) setAttribute(assertion *scai.AttributeAssertion) error {
+	target := assertion.GetTarget()
+
+	err := s.Validity.intersect(assertion.GetConditions())
+	if err != nil {
+		return err
+	}
+
+	switch assertion.GetAttribute() {
+	case RefValueContainerManifest:
+		return decodeTargetDigest(target, &s.ManifestDigest)
+	case RefValueContainerConfig:
+		return decodeTargetDigest(target, &s.ConfigDigest)
+	case RefValueContainerLayer:
+		var layer []byte
+		err := decodeTargetDigest(target, &layer)
+		if err != nil {
+			return err
+		}
+		s.Layers = append(s.Layers, layer)
+	case RefValueContainerLayerDiffID:
+		var diffID []byte
+		err := decodeTargetDigest(target, &diffID)
+		if err != nil {
+			return err
+		}
+		s.LayerDiffIDs = append(s.LayerDiffIDs, diffID)
+	case RefValueContainerEntrypoint:
+		s.Entrypoint = &ContainerEntrypoint{}
+		err := json.Unmarshal(target.GetContent(), s.Entrypoint)
+		if err != nil {
+			return fmt.Errorf("couldn't deserialize entrypoint: %w", err)
+		}
+	case RefValueContainerMounts:
+		err := json.Unmarshal(target.GetContent(), &s.Mounts)
+		if err != nil {
+			return fmt.Errorf("couldn't deserialize mounts: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Match compares the image digest of a container start event with the
+// manifest digest, or with the config digest (the image ID) of the set, its
+// process arguments with the entrypoint and command of the image, and its
+// mounts with the allowed mounts
+func (s *ContainerRefValueSet) Match(event *ContainerEvent) error {
+	digest, err := hex.DecodeString(ociDigestMap(event.ImageDigest)["sha256"])
+	if err != nil || len(digest) == 0 {
+		return fmt.Errorf("container image has no SHA-256 digest")
+	}
+
+	if !bytes.Equal(digest, s.ManifestDigest) && !bytes.Equal(digest, s.ConfigDigest) {
+		return fmt.Errorf("image digest mismatch, got %s", event.ImageDigest)
+	}
+
+	if len(event.Args) == 0 {
+		return fmt.Errorf("container event has no process arguments, measure the runtime config with quote --measure-container-config")
+	}
+	args := append(slices.Clone(s.Entrypoint.Entrypoint), s.Entrypoint.Cmd...)
+	if !slices.Equal(args, event.Args) {
+		return fmt.Errorf("process arguments mismatch, expected %q, got %q", args, event.Args)
+	}
+
+	for _, mount := range event.Mounts {
+		if !slices.ContainsFunc(s.Mounts, mount.Equal) {
+			return fmt.Errorf("mount %s is not allowed", mount)
+		}
+	}
+
+	return nil
+}
+
+// isContainerRefValueStatement reports whether a reference value statement
+// asserts container reference values
+func isContainerRefValueStatement(statement *ita.Statement) bool {
+	attributes := statement.GetPredicate().GetFields()["attributes"].GetListValue().GetValues()
+	for _, attribute := range attributes {
+		switch attribute.GetStructValue().GetFields()["attribute"].GetStringValue() {
+		case RefValueContainerManifest, RefValueContainerConfig, RefValueContainerLayer, RefValueContainerLayerDiffID, RefValueContainerEntrypoint, RefValueContainerMounts:
+			return true
+		}
+	}
+	return false
+}
+
+// RefValueStore is a directory of DSSE-signed reference value sets, one file
+// per set, keyed by the digest of the build or container image
+type RefValueStore struct {
+	Sets          map[string]*RefValueSet
+	ContainerSets map[string]*ContainerRefValueSet
+
+	// Revocations lists the images whose sets must not match, if set
+	Revocations *RefValueRevocations
+}
+
+// LoadRefValueStore reads the .json and .jsonl files of a directory as DSSE
+// envelopes of SCAI reference value statements signed by one of the keys
+func LoadRefValueStore(dir string, keys []crypto.PublicKey) (*RefValueStore, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read reference value store: %w", err)
+	}
+
+	store := &RefValueStore{
+		Sets:          make(map[string]*RefValueSet),
+		ContainerSets: make(map[string]*ContainerRefValueSet),
+	}
+	paths := make(map[string]string)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".json" && ext != ".jsonl") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read reference values: %w", err)
+		}
+
+		statement, err := VerifyStatement(data, keys)
+		if err != nil {
+			return nil, fmt.Errorf("reference values %s: %w", path, err)
+		}
+
+		var digest string
+		if isContainerRefValueStatement(statement) {
+			set, err := NewContainerRefValueSet(statement)
+			if err != nil {
+				return nil, fmt.Errorf("reference values %s: %w", path, err)
+			}
+			set.Path = path
+			digest = set.ImageDigest
+			store.ContainerSets[digest] = set
+		} else {
+			set, err := NewRefValueSet(statement)
+			if err != nil {
+				return nil, fmt.Errorf("reference values %s: %w", path, err)
+			}
+			set.Path = path
+			digest = set.ImageDigest
+			store.Sets[digest] = set
+		}
+
+		if existing, ok := paths[digest]; ok {
+			return nil, fmt.Errorf("reference values %s and %s are both for image sha256:%s", existing, path, digest)
+		}
+		paths[digest] = path
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("reference value store %s is empty", dir)
+	}
+
+	return store, nil
+}
+
+// Match returns the set of the image whose reference values all match the
+// measurements and that is neither revoked nor outside of its validity window
+// at the given time. If there is none, the error lists why each set was
+// rejected.
+func (s *RefValueStore) Match(m *Measurements, at time.Time) (*RefValueSet, error) {
+	if len(s.Sets) == 0 {
+		return nil, fmt.Errorf("no VM reference values in the store")
+	}
+
+	var digests []string
+	for digest := range s.Sets {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+
+	var mismatches []string
+	var invalid []string
+	for _, digest := range digests {
+		set := s.Sets[digest]
+		err := set.Match(m)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %s", set.Image(), err))
+			continue
+		}
+
+		if revocation := s.Revocations.Lookup(set.ImageDigest); revocation != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: revoked at %s: %s", set.Image(), revocation.RevokedAt.Format(time.RFC3339), revocation.Reason))
+			continue
+		}
+
+		err = set.Validity.Check(at)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", set.Image(), err))
+			continue
+		}
+
+		return set, nil
+	}
+
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("attestation matches reference values that are no longer accepted:\n  %s", strings.Join(invalid, "\n  "))
+	}
+	return nil, fmt.Errorf("no reference values match the attestation:\n  %s", strings.Join(mismatches, "\n  "))
+}
+
+// MatchContainer returns the set of the container image started by the event,
+// like Match
+func (s *RefValueStore) MatchContainer(event *ContainerEvent, at time.Time) (*ContainerRefValueSet, error) {
+	if len(s.ContainerSets) == 0 {
+		return nil, fmt.Errorf("no container reference values in the store")
+	}
+
+	var digests []string
+	for digest := range s.ContainerSets {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+
+	var mismatches []string
+	var invalid []string
+	for _, digest := range digests {
+		set := s.ContainerSets[digest]
+		err := set.Match(event)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %s", set.Image(), err))
+			continue
+		}
+
+		if revocation := s.Revocations.Lookup(set.ImageDigest); revocation != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: revoked at %s: %s", set.Image(), revocation.RevokedAt.Format(time.RFC3339), revocation.Reason))
+			continue
+		}
+
+		err = set.Validity.Check(at)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", set.Image(), err))
+			continue
+		}
+
+		return set, nil
+	}
+
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("container image %s matches reference values that are no longer accepted:\n  %s", event.ImageDigest, strings.Join(invalid, "\n  "))
+	}
+	return nil, fmt.Errorf("no reference values match container image %s:\n  %s", event.ImageDigest, strings.Join(mismatches, "\n  "))
+}
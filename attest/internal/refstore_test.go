@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	scai "github.com/in-toto/attestation/go/predicates/scai/v0"
+	ita "github.com/in-toto/attestation/go/v1"
+)
+
+var (
+	testVerityHash = bytes.Repeat([]byte{0x7c}, sha256.Size)
+	testPCRs       = []PCRValue{{Index: 4, Value: bytes.Repeat([]byte{4}, sha256.Size)}, {Index: 9, Value: bytes.Repeat([]byte{9}, sha256.Size)}}
+)
+
+// newTestRefValueStatement returns a reference value statement for the image
+// with the given digest, asserting the verity hash and PCRs if set
+func newTestRefValueStatement(t *testing.T, imageDigest string, verityHash []byte, pcrs []PCRValue, validity RefValueValidity) *ita.Statement {
+	t.Helper()
+
+	conditions, err := validity.Conditions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var assertions []*scai.AttributeAssertion
+	if verityHash != nil {
+		assertion, err := NewRefValueDigestAssertion(RefValueVerityHash, "verity-root-hash", verityHash, nil, conditions, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertions = append(assertions, assertion)
+	}
+	if pcrs != nil {
+		content, err := json.Marshal(ExpectedPCRs{PCRs: pcrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256(content)
+		assertion, err := NewRefValueDigestAssertion(RefValueVMMPCRs, "expected-pcrs.json", digest[:], content, conditions, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertions = append(assertions, assertion)
+	}
+
+	subject := &ita.ResourceDescriptor{Name: "image.zip", Digest: map[string]string{"sha256": imageDigest}}
+	statement, err := NewSCAIStatement([]*ita.ResourceDescriptor{subject}, assertions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return statement
+}
+
+// newTestRefValueSet returns the set of a statement asserting the test verity
+// hash and PCRs
+func newTestRefValueSet(t *testing.T, imageDigest string, validity RefValueValidity) *RefValueSet {
+	t.Helper()
+
+	set, err := NewRefValueSet(newTestRefValueStatement(t, imageDigest, testVerityHash, testPCRs, validity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func testImageDigest(b byte) string {
+	return hex.EncodeToString(bytes.Repeat([]byte{b}, sha256.Size))
+}
+
+func TestNewRefValueSet(t *testing.T) {
+	tests := []struct {
+		name       string
+		verityHash []byte
+		pcrs       []PCRValue
+		wantErr    string
+	}{
+		{"complete", testVerityHash, testPCRs, ""},
+		// Sets without these would match any image
+		{"no verity hash", nil, testPCRs, "no verity hash reference value"},
+		{"no PCRs", testVerityHash, nil, "no VMM-set PCR reference values"},
+		{"empty PCRs", testVerityHash, []PCRValue{}, "no VMM-set PCR reference values"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set, err := NewRefValueSet(newTestRefValueStatement(t, testImageDigest(1), test.verityHash, test.pcrs, RefValueValidity{}))
+			checkError(t, err, test.wantErr)
+			if err == nil && (!set.AppraisesExecutables() || set.AppraisesConfiguration() || !set.AppraisesFileSystem()) {
+				t.Fatal("set of the verity hash and PCRs 4 and 9 should appraise the executables and file system only")
+			}
+		})
+	}
+}
+
+func TestLoadRefValueStoreDuplicates(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"a.json", "b.json"} {
+		envelope, err := SignStatement(newTestRefValueStatement(t, testImageDigest(1), testVerityHash, testPCRs, RefValueValidity{}), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), envelope, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = LoadRefValueStore(dir, []crypto.PublicKey{key.Public()})
+	checkError(t, err, "are both for image sha256:"+testImageDigest(1))
+}
+
+func TestRefValueStoreMatch(t *testing.T) {
+	measurements := &Measurements{PCRs: testPCRs, VerityHash: testVerityHash}
+	otherMeasurements := &Measurements{PCRs: testPCRs, VerityHash: make([]byte, sha256.Size)}
+
+	current := newTestRefValueSet(t, testImageDigest(1), RefValueValidity{NotAfter: testNow.Add(time.Hour)})
+	revoked := newTestRefValueSet(t, testImageDigest(2), RefValueValidity{})
+	expired := newTestRefValueSet(t, testImageDigest(3), RefValueValidity{NotAfter: testNow.Add(-time.Hour)})
+	revocations := &RefValueRevocations{}
+	err := revocations.Revoke(revoked.ImageDigest, "CVE-2024-0001", testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(sets ...*RefValueSet) *RefValueStore {
+		s := &RefValueStore{Sets: make(map[string]*RefValueSet), Revocations: revocations}
+		for _, set := range sets {
+			s.Sets[set.ImageDigest] = set
+		}
+		return s
+	}
+
+	tests := []struct {
+		name         string
+		store        *RefValueStore
+		measurements *Measurements
+		at           time.Time
+		want         *RefValueSet
+		wantErr      string
+	}{
+		{"current", store(current), measurements, testNow, current, ""},
+		// Revoked and expired sets are skipped for another matching set
+		{"rollout", store(revoked, current, expired), measurements, testNow, current, ""},
+		{"revoked", store(revoked), measurements, testNow, nil, "no longer accepted:\n  " + revoked.Image() + ": revoked at"},
+		{"expired", store(expired), measurements, testNow, nil, "no longer accepted:\n  " + expired.Image() + ": expired at"},
+		{"expired since", store(current), measurements, testNow.Add(2 * time.Hour), nil, "no longer accepted"},
+		{"mismatch", store(revoked, current), otherMeasurements, testNow, nil, "no reference values match the attestation"},
+		{"no sets", store(), measurements, testNow, nil, "no VM reference values"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set, err := test.store.Match(test.measurements, test.at)
+			checkError(t, err, test.wantErr)
+			if set != test.want {
+				t.Fatalf("Match() = %v, want %v", set, test.want)
+			}
+		})
+	}
+}
+
+func TestRefValueStoreMatchContainer(t *testing.T) {
+	entrypoint := &ContainerEntrypoint{Entrypoint: []string{"/bin/build"}}
+	newSet := func(b byte, validity RefValueValidity) *ContainerRefValueSet {
+		return &ContainerRefValueSet{
+			ImageDigest:    testImageDigest(b),
+			ManifestDigest: bytes.Repeat([]byte{b}, sha256.Size),
+			Entrypoint:     entrypoint,
+			Validity:       validity,
+		}
+	}
+	event := func(b byte) *ContainerEvent {
+		return &ContainerEvent{ImageDigest: "sha256:" + testImageDigest(b), Args: []string{"/bin/build"}}
+	}
+
+	revocations := &RefValueRevocations{}
+	err := revocations.Revoke(testImageDigest(2), "CVE-2024-0001", testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &RefValueStore{
+		ContainerSets: map[string]*ContainerRefValueSet{
+			testImageDigest(1): newSet(1, RefValueValidity{}),
+			testImageDigest(2): newSet(2, RefValueValidity{}),
+			testImageDigest(3): newSet(3, RefValueValidity{NotAfter: testNow.Add(-time.Hour)}),
+		},
+		Revocations: revocations,
+	}
+
+	tests := []struct {
+		name    string
+		event   *ContainerEvent
+		wantErr string
+	}{
+		{"current", event(1), ""},
+		{"revoked", event(2), "no longer accepted:\n  sha256:" + testImageDigest(2) + ": revoked at"},
+		{"expired", event(3), "no longer accepted:\n  sha256:" + testImageDigest(3) + ": expired at"},
+		{"unknown image", event(4), "no reference values match container image"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set, err := store.MatchContainer(test.event, testNow)
+			checkError(t, err, test.wantErr)
+			if err == nil && !strings.HasSuffix(test.event.ImageDigest, set.ImageDigest) {
+				t.Fatalf("MatchContainer() = %s, want %s", set.ImageDigest, test.event.ImageDigest)
+			}
+		})
+	}
+}
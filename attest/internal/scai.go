@@ -1,7 +1,12 @@
 package internal
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/in-toto/scai-demos/scai-gen/pkg/generators"
 
@@ -12,7 +17,168 @@ import (
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
-func NewRefValueSCAIAssertion(attribute string, targetPath string, includeTargetContent bool) (*scai.AttributeAssertion, error) {
+// SCAIPredicateType is the in-toto predicate type of SCAI attribute reports
+const SCAIPredicateType = "https://in-toto.io/attestation/scai/attribute-report/v0.2"
+
+// Attributes of the SCAI reference value assertions generated by ref-values
+const (
+	RefValueKernel        = "REF_VALUE:kernel"
+	RefValueInitramfs     = "REF_VALUE:initramfs"
+	RefValueVerityHash    = "REF_VALUE:verity-hash"
+	RefValueVMMPCRs       = "REF_VALUE:vmm-pcrs"
+	RefValueKernelCmdline = "REF_VALUE:kernel-cmdline"
+
+	RefValueContainerManifest    = "REF_VALUE:container-manifest"
+	RefValueContainerConfig      = "REF_VALUE:container-config"
+	RefValueContainerLayer       = "REF_VALUE:container-layer"
+	RefValueContainerLayerDiffID = "REF_VALUE:container-layer-diff-id"
+	RefValueContainerEntrypoint  = "REF_VALUE:container-entrypoint"
+	RefValueContainerMounts      = "REF_VALUE:container-mounts"
+)
+
+// RefValueValidity is the window in which reference values are valid, recorded
+// as the conditions of their SCAI assertions. A zero time leaves the window
+// open on that side.
+type RefValueValidity struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Conditions encodes the window as SCAI assertion conditions
+func (v RefValueValidity) Conditions() (*structpb.Struct, error) {
+	conditions := map[string]any{}
+	if !v.NotBefore.IsZero() {
+		conditions["notBefore"] = v.NotBefore.UTC().Format(time.RFC3339)
+	}
+	if !v.NotAfter.IsZero() {
+		conditions["notAfter"] = v.NotAfter.UTC().Format(time.RFC3339)
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+	return structpb.NewStruct(conditions)
+}
+
+// Check rejects times outside of the window
+func (v RefValueValidity) Check(at time.Time) error {
+	if !v.NotBefore.IsZero() && at.Before(v.NotBefore) {
+		return fmt.Errorf("not valid before %s", v.NotBefore.Format(time.RFC3339))
+	}
+	if !v.NotAfter.IsZero() && at.After(v.NotAfter) {
+		return fmt.Errorf("expired at %s", v.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// parseRefValueValidity decodes the window of SCAI assertion conditions
+func parseRefValueValidity(conditions *structpb.Struct) (RefValueValidity, error) {
+	var validity RefValueValidity
+	for name, bound := range map[string]*time.Time{"notBefore": &validity.NotBefore, "notAfter": &validity.NotAfter} {
+		value, ok := conditions.GetFields()[name]
+		if !ok {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value.GetStringValue())
+		if err != nil {
+			return validity, fmt.Errorf("invalid %s condition: %w", name, err)
+		}
+		*bound = parsed
+	}
+	return validity, nil
+}
+
+// intersect narrows the window to the window of SCAI assertion conditions
+func (v *RefValueValidity) intersect(conditions *structpb.Struct) error {
+	validity, err := parseRefValueValidity(conditions)
+	if err != nil {
+		return err
+	}
+	if validity.NotBefore.After(v.NotBefore) {
+		v.NotBefore = validity.NotBefore
+	}
+	if !validity.NotAfter.IsZero() && (v.NotAfter.IsZero() || validity.NotAfter.Before(v.NotAfter)) {
+		v.NotAfter = validity.NotAfter
+	}
+	return nil
+}
+
+// Producer identifies the build that generated reference values
+type Producer struct {
+	Repository  string // e.g. https://github.com/chkimes/image-attestation
+	Commit      string // git commit SHA-1
+	WorkflowRun string // URL of the CI run
+	Builder     string // builder identity, e.g. the workflow ref
+}
+
+// ResourceDescriptor describes the producer as a SCAI producer, named after
+// the builder and located at the workflow run, or nil if nothing is known
+// about it
+func (p Producer) ResourceDescriptor() (*ita.ResourceDescriptor, error) {
+	annotations := map[string]any{}
+	for name, value := range map[string]string{
+		"repository":  p.Repository,
+		"commit":      p.Commit,
+		"workflowRun": p.WorkflowRun,
+		"builder":     p.Builder,
+	} {
+		if value != "" {
+			annotations[name] = value
+		}
+	}
+	if len(annotations) == 0 {
+		return nil, nil
+	}
+
+	annotationsStruct, err := structpb.NewStruct(annotations)
+	if err != nil {
+		return nil, fmt.Errorf("error generating producer annotations: %w", err)
+	}
+
+	producer := &ita.ResourceDescriptor{
+		Name:        p.Builder,
+		Uri:         p.WorkflowRun,
+		Annotations: annotationsStruct,
+	}
+	if p.Commit != "" {
+		producer.Digest = map[string]string{"gitCommit": p.Commit}
+	}
+
+	// The spec requires a name, URI or digest
+	if producer.Name == "" && producer.Uri == "" && producer.Digest == nil {
+		producer.Uri = p.Repository
+	}
+
+	return producer, producer.Validate()
+}
+
+// NewEvidenceDescriptor generates the resource descriptor for a file backing a
+// reference value, e.g. the provenance of the kernel, which can be downloaded
+// from downloadLocation
+func NewEvidenceDescriptor(path string, downloadLocation string) (*ita.ResourceDescriptor, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	evidence, err := generators.NewRdForFile(path, path, "", "sha256", false, evidenceMediaType(path), downloadLocation, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error generating resource descriptor for evidence %s: %w", path, err)
+	}
+	return evidence, nil
+}
+
+func evidenceMediaType(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".sigstore.json"):
+		return "application/vnd.dev.sigstore.bundle"
+	case strings.HasSuffix(path, ".intoto.jsonl"):
+		return "application/vnd.in-toto+json"
+	case strings.HasSuffix(path, ".json"):
+		return "application/json"
+	}
+	return ""
+}
+
+func NewRefValueSCAIAssertion(attribute string, targetPath string, includeTargetContent bool, conditions *structpb.Struct, evidence *ita.ResourceDescriptor) (*scai.AttributeAssertion, error) {
 	// generate the resource descriptor for the reference value target
 	target, err := generators.NewRdForFile(targetPath, "", "", "sha256", includeTargetContent, "", "", nil)
 	if err != nil {
@@ -20,7 +186,25 @@ func NewRefValueSCAIAssertion(attribute string, targetPath string, includeTarget
 	}
 
 	// generate the SCAI assertion for the reference value
-	scaiAA, err := generators.NewSCAIAssertion(attribute, target, nil, nil)
+	scaiAA, err := generators.NewSCAIAssertion(attribute, target, conditions, evidence)
+	if err != nil {
+		return nil, fmt.Errorf("error generating SCAI assertion: %w", err)
+	}
+
+	return scaiAA, nil
+}
+
+// NewRefValueDigestAssertion generates a SCAI assertion for a reference value
+// known only by its SHA-256 digest, e.g. one learned from a boot event log,
+// and optionally its content
+func NewRefValueDigestAssertion(attribute string, name string, digest []byte, content []byte, conditions *structpb.Struct, evidence *ita.ResourceDescriptor) (*scai.AttributeAssertion, error) {
+	target := &ita.ResourceDescriptor{
+		Name:    name,
+		Digest:  map[string]string{"sha256": hex.EncodeToString(digest)},
+		Content: content,
+	}
+
+	scaiAA, err := generators.NewSCAIAssertion(attribute, target, conditions, evidence)
 	if err != nil {
 		return nil, fmt.Errorf("error generating SCAI assertion: %w", err)
 	}
@@ -28,6 +212,104 @@ func NewRefValueSCAIAssertion(attribute string, targetPath string, includeTarget
 	return scaiAA, nil
 }
 
+// NewContainerRefValueAssertions generates the SCAI assertions of the
+// manifest, config, layer and entrypoint reference values of a container
+// image, and of the bind mounts its containers may have
+func NewContainerRefValueAssertions(image *ContainerImage, mounts []ContainerMount, conditions *structpb.Struct, evidence *ita.ResourceDescriptor) ([]*scai.AttributeAssertion, error) {
+	type refValue struct {
+		attribute string
+		target    *ita.ResourceDescriptor
+	}
+	var refValues []refValue
+
+	if image.ManifestDigest != "" {
+		refValues = append(refValues, refValue{RefValueContainerManifest, &ita.ResourceDescriptor{
+			Name:      image.Name,
+			Digest:    ociDigestMap(image.ManifestDigest),
+			MediaType: image.ManifestMediaType,
+		}})
+	}
+
+	refValues = append(refValues, refValue{RefValueContainerConfig, &ita.ResourceDescriptor{
+		Name:   "config",
+		Digest: ociDigestMap(image.ConfigDigest),
+	}})
+
+	// Diff IDs are digests of the uncompressed layers, which don't match the
+	// layer blobs
+	for i, layer := range image.Layers {
+		attribute := RefValueContainerLayer
+		if layer.DiffID {
+			attribute = RefValueContainerLayerDiffID
+		}
+		refValues = append(refValues, refValue{attribute, &ita.ResourceDescriptor{
+			Name:      fmt.Sprintf("layer-%d", i),
+			Digest:    ociDigestMap(layer.Digest),
+			MediaType: layer.MediaType,
+		}})
+	}
+
+	entrypoint, err := image.EntrypointJSON()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't serialize entrypoint: %w", err)
+	}
+	entrypointDigest := sha256.Sum256(entrypoint)
+	refValues = append(refValues, refValue{RefValueContainerEntrypoint, &ita.ResourceDescriptor{
+		Name:      "entrypoint",
+		Digest:    map[string]string{"sha256": hex.EncodeToString(entrypointDigest[:])},
+		Content:   entrypoint,
+		MediaType: "application/json",
+	}})
+
+	if mounts == nil {
+		mounts = []ContainerMount{}
+	}
+	mountsJSON, err := json.Marshal(mounts)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't serialize mounts: %w", err)
+	}
+	mountsDigest := sha256.Sum256(mountsJSON)
+	refValues = append(refValues, refValue{RefValueContainerMounts, &ita.ResourceDescriptor{
+		Name:      "mounts",
+		Digest:    map[string]string{"sha256": hex.EncodeToString(mountsDigest[:])},
+		Content:   mountsJSON,
+		MediaType: "application/json",
+	}})
+
+	var assertions []*scai.AttributeAssertion
+	for _, refValue := range refValues {
+		if refValue.target.GetDigest()["sha256"] == "" {
+			return nil, fmt.Errorf("%s has no SHA-256 digest", refValue.target.GetName())
+		}
+		scaiAA, err := generators.NewSCAIAssertion(refValue.attribute, refValue.target, conditions, evidence)
+		if err != nil {
+			return nil, fmt.Errorf("error generating SCAI assertion: %w", err)
+		}
+		assertions = append(assertions, scaiAA)
+	}
+
+	return assertions, nil
+}
+
+// NewContainerSubject generates the resource descriptor of a container image
+// as the subject of its reference values
+func NewContainerSubject(image *ContainerImage) *ita.ResourceDescriptor {
+	return &ita.ResourceDescriptor{
+		Name:      image.Name,
+		Digest:    ociDigestMap(image.Digest()),
+		MediaType: image.ManifestMediaType,
+	}
+}
+
+// ociDigestMap converts a "sha256:" OCI digest to a resource descriptor digest
+func ociDigestMap(digest string) map[string]string {
+	algorithm, encoded, _ := strings.Cut(digest, ":")
+	if algorithm != "sha256" {
+		return nil
+	}
+	return map[string]string{"sha256": strings.ToLower(encoded)}
+}
+
 func NewSCAIStatement(subject []*ita.ResourceDescriptor, attributeAssertions []*scai.AttributeAssertion, producer *ita.ResourceDescriptor) (*ita.Statement, error) {
 	// create the in-toto predicate (SCAI report)
 	scaiReport := &scai.AttributeReport{
@@ -49,5 +331,5 @@ func NewSCAIStatement(subject []*ita.ResourceDescriptor, attributeAssertions []*
 		return nil, fmt.Errorf("error unmarshalling SCAI report: %w", err)
 	}
 
-	return generators.NewStatement(subject, "https://in-toto.io/attestation/scai/attribute-report/v0.2", reportStruct)
+	return generators.NewStatement(subject, SCAIPredicateType, reportStruct)
 }
@@ -0,0 +1,326 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"unicode/utf16"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// SecureBootPCR is the PCR that records the Secure Boot policy and the
+// authorities used to verify boot components
+const SecureBootPCR = 7
+
+// bootComponentsPCR is the PCR that records the boot applications loaded by
+// the firmware
+const bootComponentsPCR = 4
+
+const sbatLevelVariable = "SbatLevel"
+
+// EFI GUIDs in the byte order they are stored in
+var (
+	efiGlobalVariableGUID        = efiGUID("8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	efiImageSecurityDatabaseGUID = efiGUID("d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+	efiCertX509GUID              = efiGUID("a5c059a1-94e4-4aa7-87b5-ab155c2bf072")
+	efiCertSHA256GUID            = efiGUID("c1c41626-504c-4092-aca9-41f936934328")
+)
+
+// efiGUID encodes a GUID string in the mixed-endian EFI_GUID layout
+func efiGUID(s string) [16]byte {
+	raw, err := hex.DecodeString(s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:36])
+	if err != nil {
+		panic(err)
+	}
+
+	var guid [16]byte
+	binary.LittleEndian.PutUint32(guid[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(guid[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(guid[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(guid[8:], raw[8:])
+	return guid
+}
+
+// EFIVariable is the UEFI_VARIABLE_DATA of an EFI variable event
+type EFIVariable struct {
+	VendorGUID [16]byte
+	Name       string
+	Data       []byte
+}
+
+// ParseEFIVariable decodes the data of an EV_EFI_VARIABLE_* event
+func ParseEFIVariable(data []byte) (*EFIVariable, error) {
+	r := bytes.NewReader(data)
+
+	var header struct {
+		VendorGUID [16]byte
+		NameLength uint64
+		DataLength uint64
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("couldn't read EFI variable header: %w", err)
+	}
+	if header.NameLength > uint64(r.Len())/2 || header.DataLength > uint64(r.Len())-2*header.NameLength {
+		return nil, fmt.Errorf("EFI variable exceeds event data")
+	}
+
+	name := make([]uint16, header.NameLength)
+	if err := binary.Read(r, binary.LittleEndian, name); err != nil {
+		return nil, fmt.Errorf("couldn't read EFI variable name: %w", err)
+	}
+
+	variable := &EFIVariable{
+		VendorGUID: header.VendorGUID,
+		Name:       string(utf16.Decode(name)),
+		Data:       make([]byte, header.DataLength),
+	}
+	if _, err := r.Read(variable.Data); err != nil && header.DataLength > 0 {
+		return nil, fmt.Errorf("couldn't read EFI variable data: %w", err)
+	}
+
+	return variable, nil
+}
+
+// EFISignature is an entry of an EFI signature database, either an X.509
+// certificate or a SHA-256 hash
+type EFISignature struct {
+	Type        string // x509 or sha256
+	Owner       [16]byte
+	Certificate *x509.Certificate
+	Hash        []byte // SHA-256 of the image, or of the certificate
+}
+
+// Subject returns the certificate subject, or the hash for hash entries
+func (s *EFISignature) Subject() string {
+	if s.Certificate != nil {
+		return s.Certificate.Subject.String()
+	}
+	return hex.EncodeToString(s.Hash)
+}
+
+// ParseEFISignatureLists decodes the EFI_SIGNATURE_LISTs of a signature
+// database variable such as db or dbx. Entries of other types are skipped.
+func ParseEFISignatureLists(data []byte) ([]EFISignature, error) {
+	var signatures []EFISignature
+
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var header struct {
+			Type          [16]byte
+			ListSize      uint32
+			HeaderSize    uint32
+			SignatureSize uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+			return nil, fmt.Errorf("couldn't read signature list header: %w", err)
+		}
+
+		// The signature header and the signatures follow the list header
+		bodySize := int64(header.ListSize) - 28 - int64(header.HeaderSize)
+		if bodySize < 0 || int64(header.HeaderSize)+bodySize > int64(r.Len()) || header.SignatureSize < 16 || bodySize%int64(header.SignatureSize) != 0 {
+			return nil, fmt.Errorf("malformed signature list")
+		}
+		if _, err := io.ReadFull(r, make([]byte, header.HeaderSize)); err != nil {
+			return nil, fmt.Errorf("couldn't read signature header: %w", err)
+		}
+
+		for i := int64(0); i < bodySize/int64(header.SignatureSize); i++ {
+			entry := make([]byte, header.SignatureSize)
+			if _, err := io.ReadFull(r, entry); err != nil {
+				return nil, fmt.Errorf("couldn't read signature: %w", err)
+			}
+
+			signature := EFISignature{}
+			copy(signature.Owner[:], entry[:16])
+
+			switch header.Type {
+			case efiCertX509GUID:
+				cert, err := x509.ParseCertificate(entry[16:])
+				if err != nil {
+					return nil, fmt.Errorf("couldn't parse signature database certificate: %w", err)
+				}
+				hash := sha256.Sum256(cert.Raw)
+				signature.Type = "x509"
+				signature.Certificate = cert
+				signature.Hash = hash[:]
+			case efiCertSHA256GUID:
+				signature.Type = "sha256"
+				signature.Hash = entry[16:]
+			default:
+				continue
+			}
+
+			signatures = append(signatures, signature)
+		}
+	}
+
+	return signatures, nil
+}
+
+// SecureBootAuthority is a signature database entry that verified a boot
+// component, as recorded by an EV_EFI_VARIABLE_AUTHORITY event
+type SecureBootAuthority struct {
+	Sequence  int
+	Variable  string // e.g. db, or Shim and MokList for authorities logged by shim
+	Signature EFISignature
+}
+
+// BootComponent is a boot application loaded by the firmware and the
+// authority that verified it
+type BootComponent struct {
+	Sequence int
+	Digest   []byte
+
+	// Authority is the authority logged for the component, or nil if the
+	// component was verified by an authority already logged for an earlier
+	// component
+	Authority *SecureBootAuthority
+}
+
+// SecureBootState is the Secure Boot configuration recorded in PCR 7
+type SecureBootState struct {
+	Enabled     bool
+	PK          []EFISignature
+	KEK         []EFISignature
+	DB          []EFISignature
+	DBX         []EFISignature
+	Authorities []SecureBootAuthority
+	Components  []BootComponent
+
+	// SbatLevel is the SBAT revocation level applied by shim, if logged
+	SbatLevel string
+}
+
+// SecureBoot decodes the Secure Boot configuration and authority events of
+// PCR 7. The event data is checked against the event digests, so the result
+// can be trusted once the log has been verified against the quoted PCRs.
+func (l *EventLog) SecureBoot() (*SecureBootState, error) {
+	state := &SecureBootState{}
+
+	// The firmware measures the authority when it first verifies an image with
+	// it, and the image itself into PCR 4 right after
+	var pending *SecureBootAuthority
+	for _, event := range l.Events {
+		switch {
+		case event.PCR == SecureBootPCR && event.Type == EvEFIVariableDriverConfig:
+			variable, err := l.verifiedVariable(event)
+			if err != nil {
+				return nil, err
+			}
+
+			err = state.setVariable(variable)
+			if err != nil {
+				return nil, fmt.Errorf("event %d: %w", event.Sequence, err)
+			}
+
+		case event.PCR == SecureBootPCR && event.Type == EvEFIVariableAuthority:
+			variable, err := l.verifiedVariable(event)
+			if err != nil {
+				return nil, err
+			}
+
+			// shim records its SBAT revocation level along with the authorities
+			if variable.Name == sbatLevelVariable {
+				state.SbatLevel = string(variable.Data)
+				continue
+			}
+
+			authority := &SecureBootAuthority{
+				Sequence:  event.Sequence,
+				Variable:  variable.Name,
+				Signature: parseAuthoritySignature(variable.Data),
+			}
+			state.Authorities = append(state.Authorities, *authority)
+			pending = authority
+
+		case event.PCR == bootComponentsPCR && event.Type == EvEFIBootServicesApp:
+			state.Components = append(state.Components, BootComponent{
+				Sequence:  event.Sequence,
+				Digest:    event.Digest(tpm2.AlgSHA256),
+				Authority: pending,
+			})
+			pending = nil
+		}
+	}
+
+	return state, nil
+}
+
+// verifiedVariable decodes the EFI variable of an event after checking that
+// the event digest covers the event data
+func (l *EventLog) verifiedVariable(event Event) (*EFIVariable, error) {
+	digest := sha256.Sum256(event.Data)
+	if !bytes.Equal(event.Digest(tpm2.AlgSHA256), digest[:]) {
+		return nil, fmt.Errorf("event %d digest doesn't match its data", event.Sequence)
+	}
+
+	variable, err := ParseEFIVariable(event.Data)
+	if err != nil {
+		return nil, fmt.Errorf("event %d: %w", event.Sequence, err)
+	}
+	return variable, nil
+}
+
+func (s *SecureBootState) setVariable(variable *EFIVariable) error {
+	var target *[]EFISignature
+	switch {
+	case variable.VendorGUID == efiGlobalVariableGUID && variable.Name == "SecureBoot":
+		s.Enabled = len(variable.Data) == 1 && variable.Data[0] == 1
+		return nil
+	case variable.VendorGUID == efiGlobalVariableGUID && variable.Name == "PK":
+		target = &s.PK
+	case variable.VendorGUID == efiGlobalVariableGUID && variable.Name == "KEK":
+		target = &s.KEK
+	case variable.VendorGUID == efiImageSecurityDatabaseGUID && variable.Name == "db":
+		target = &s.DB
+	case variable.VendorGUID == efiImageSecurityDatabaseGUID && variable.Name == "dbx":
+		target = &s.DBX
+	default:
+		return nil
+	}
+
+	signatures, err := ParseEFISignatureLists(variable.Data)
+	if err != nil {
+		return fmt.Errorf("couldn't parse %s: %w", variable.Name, err)
+	}
+	*target = signatures
+	return nil
+}
+
+// parseAuthoritySignature decodes the authority of an EV_EFI_VARIABLE_AUTHORITY
+// event. The firmware logs an EFI_SIGNATURE_DATA, while shim logs the bare
+// certificate.
+func parseAuthoritySignature(data []byte) EFISignature {
+	candidates := [][]byte{data}
+	if len(data) > 16 {
+		candidates = append(candidates, data[16:])
+	}
+
+	for i, candidate := range candidates {
+		cert, err := x509.ParseCertificate(candidate)
+		if err != nil {
+			continue
+		}
+
+		hash := sha256.Sum256(cert.Raw)
+		signature := EFISignature{Type: "x509", Certificate: cert, Hash: hash[:]}
+		if i == 1 {
+			copy(signature.Owner[:], data[:16])
+		}
+		return signature
+	}
+
+	if len(data) == 16+sha256.Size {
+		signature := EFISignature{Type: "sha256", Hash: data[16:]}
+		copy(signature.Owner[:], data[:16])
+		return signature
+	}
+
+	hash := sha256.Sum256(data)
+	return EFISignature{Type: "unknown", Hash: hash[:]}
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// newTestSignatureList encodes an EFI_SIGNATURE_LIST of SHA-256 hashes whose
+// header sizes can be overridden
+func newTestSignatureList(headerSize uint32, listSizeDelta int, hashes ...[]byte) []byte {
+	const signatureSize = 16 + 32
+
+	var buf bytes.Buffer
+	buf.Write(efiCertSHA256GUID[:])
+	binary.Write(&buf, binary.LittleEndian, uint32(28+int(headerSize)+len(hashes)*signatureSize+listSizeDelta))
+	binary.Write(&buf, binary.LittleEndian, headerSize)
+	binary.Write(&buf, binary.LittleEndian, uint32(signatureSize))
+	for _, hash := range hashes {
+		buf.Write(make([]byte, 16)) // owner
+		buf.Write(hash)
+	}
+	return buf.Bytes()
+}
+
+func TestParseEFISignatureLists(t *testing.T) {
+	hash1 := bytes.Repeat([]byte{1}, 32)
+	hash2 := bytes.Repeat([]byte{2}, 32)
+
+	signatures, err := ParseEFISignatureLists(append(newTestSignatureList(0, 0, hash1), newTestSignatureList(0, 0, hash2)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != 2 || !bytes.Equal(signatures[0].Hash, hash1) || !bytes.Equal(signatures[1].Hash, hash2) {
+		t.Fatalf("ParseEFISignatureLists() = %v, want both hashes", signatures)
+	}
+
+	malformed := map[string][]byte{
+		// The signature header isn't in the data, so the list runs past it
+		"header size past the end": newTestSignatureList(48, 0, hash1),
+		"list size past the end":   newTestSignatureList(0, 48, hash1, hash2),
+		"truncated list header":    newTestSignatureList(0, 0, hash1)[:20],
+	}
+	for name, data := range malformed {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseEFISignatureLists(data)
+			if err == nil || !strings.Contains(err.Error(), "signature list") {
+				t.Fatalf("ParseEFISignatureLists() = %v, want malformed signature list error", err)
+			}
+		})
+	}
+}
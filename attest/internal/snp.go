@@ -0,0 +1,355 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	snpReportSize        = 1184
+	snpSignedSize        = 0x2A0
+	snpSignatureAlgoP384 = 1
+
+	// Guest policy bit allowing the host to debug the VM
+	snpPolicyDebug = 1 << 19
+
+	// Report flags
+	snpFlagMaskChipID = 1 << 1
+)
+
+// VCEK extensions carrying the TCB and chip ID the VCEK was issued for
+var (
+	oidVCEKBootloaderSPL = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 3704, 1, 3, 1}
+	oidVCEKTEESPL        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 3704, 1, 3, 2}
+	oidVCEKSNPSPL        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 3704, 1, 3, 3}
+	oidVCEKMicrocodeSPL  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 3704, 1, 3, 8}
+	oidVCEKHardwareID    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 3704, 1, 4}
+)
+
+// AMDARKFingerprints are the hex SHA-256 fingerprints of the
+// SubjectPublicKeyInfo of the AMD root keys (ARK), as served by the AMD KDS
+// cert_chain endpoint of each product. The ARK of the certificate chain must
+// be one of these or pinned with SNPCheckOptions.ARKFingerprints, so the chain
+// isn't its own trust root. Only ARK-Milan is built in, the ARKs of Genoa and
+// later products must be pinned.
+var AMDARKFingerprints = map[string]string{
+	"9f056bee44377e29308cb5ffa895bdfb62d18881fa6bed8d6f075b0204089cb9": "ARK-Milan",
+}
+
+// SNPReport is an AMD SEV-SNP attestation report (ATTESTATION_REPORT in the
+// SEV-SNP firmware ABI)
+type SNPReport struct {
+	Version         uint32
+	GuestSVN        uint32
+	Policy          uint64
+	FamilyID        []byte
+	ImageID         []byte
+	VMPL            uint32
+	SignatureAlgo   uint32
+	CurrentTCB      SNPTCB
+	PlatformInfo    uint64
+	Flags           uint32
+	ReportData      []byte
+	Measurement     []byte
+	HostData        []byte
+	IDKeyDigest     []byte
+	AuthorKeyDigest []byte
+	ReportID        []byte
+	ReportedTCB     SNPTCB
+	ChipID          []byte
+	CommittedTCB    SNPTCB
+	LaunchTCB       SNPTCB
+
+	raw []byte
+}
+
+// SNPTCB is a TCB_VERSION, the security patch levels of the platform
+type SNPTCB struct {
+	Bootloader uint8
+	TEE        uint8
+	SNP        uint8
+	Microcode  uint8
+}
+
+func parseSNPTCB(data []byte) SNPTCB {
+	return SNPTCB{
+		Bootloader: data[0],
+		TEE:        data[1],
+		SNP:        data[6],
+		Microcode:  data[7],
+	}
+}
+
+func (t SNPTCB) String() string {
+	return fmt.Sprintf("bootloader=%d tee=%d snp=%d microcode=%d", t.Bootloader, t.TEE, t.SNP, t.Microcode)
+}
+
+// ParseSNPReport parses an SEV-SNP attestation report
+func ParseSNPReport(data []byte) (*SNPReport, error) {
+	if len(data) < snpReportSize {
+		return nil, fmt.Errorf("SNP report too short (%d bytes)", len(data))
+	}
+	data = data[:snpReportSize]
+
+	le := binary.LittleEndian
+	report := &SNPReport{
+		Version:         le.Uint32(data[0x00:]),
+		GuestSVN:        le.Uint32(data[0x04:]),
+		Policy:          le.Uint64(data[0x08:]),
+		FamilyID:        data[0x10:0x20],
+		ImageID:         data[0x20:0x30],
+		VMPL:            le.Uint32(data[0x30:]),
+		SignatureAlgo:   le.Uint32(data[0x34:]),
+		CurrentTCB:      parseSNPTCB(data[0x38:0x40]),
+		PlatformInfo:    le.Uint64(data[0x40:]),
+		Flags:           le.Uint32(data[0x48:]),
+		ReportData:      data[0x50:0x90],
+		Measurement:     data[0x90:0xC0],
+		HostData:        data[0xC0:0xE0],
+		IDKeyDigest:     data[0xE0:0x110],
+		AuthorKeyDigest: data[0x110:0x140],
+		ReportID:        data[0x140:0x160],
+		ReportedTCB:     parseSNPTCB(data[0x180:0x188]),
+		ChipID:          data[0x1A0:0x1E0],
+		CommittedTCB:    parseSNPTCB(data[0x1E0:0x1E8]),
+		LaunchTCB:       parseSNPTCB(data[0x1F0:0x1F8]),
+		raw:             data,
+	}
+
+	if report.Version < 2 {
+		return nil, fmt.Errorf("unsupported SNP report version %d", report.Version)
+	}
+
+	return report, nil
+}
+
+// Debug reports whether the guest policy allows debugging the VM, which
+// exposes its memory to the host
+func (r *SNPReport) Debug() bool {
+	return r.Policy&snpPolicyDebug != 0
+}
+
+// SNPCertificates are the AMD root key (ARK), signing key (ASK) and the
+// versioned chip endorsement key (VCEK) that signs the report
+type SNPCertificates struct {
+	ARK  *x509.Certificate
+	ASK  *x509.Certificate
+	VCEK *x509.Certificate
+}
+
+// LoadSNPCertificates reads the ASK and ARK from a PEM bundle, as served by
+// the AMD KDS cert_chain endpoint, and the VCEK in PEM or DER form
+func LoadSNPCertificates(certChainPath string, vcekPath string) (SNPCertificates, error) {
+	var certs SNPCertificates
+
+	chainBytes, err := os.ReadFile(certChainPath)
+	if err != nil {
+		return certs, fmt.Errorf("couldn't read SNP certificate chain: %w", err)
+	}
+	chain, err := ParsePEMCertificates(chainBytes)
+	if err != nil {
+		return certs, fmt.Errorf("couldn't parse SNP certificate chain: %w", err)
+	}
+	for _, cert := range chain {
+		if bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+			certs.ARK = cert
+		} else {
+			certs.ASK = cert
+		}
+	}
+	if certs.ARK == nil || certs.ASK == nil {
+		return certs, fmt.Errorf("SNP certificate chain must contain the ASK and the self-signed ARK")
+	}
+
+	vcekBytes, err := os.ReadFile(vcekPath)
+	if err != nil {
+		return certs, fmt.Errorf("couldn't read VCEK: %w", err)
+	}
+	if block, _ := pem.Decode(vcekBytes); block != nil {
+		vcekBytes = block.Bytes
+	}
+	certs.VCEK, err = x509.ParseCertificate(vcekBytes)
+	if err != nil {
+		return certs, fmt.Errorf("couldn't parse VCEK: %w", err)
+	}
+
+	return certs, nil
+}
+
+// SNPCheckOptions configures the appraisal of an SNP report
+type SNPCheckOptions struct {
+	// Measurement is the expected launch measurement, if set
+	Measurement []byte
+
+	// AllowDebug accepts reports of VMs whose policy allows debugging
+	AllowDebug bool
+
+	// VMPL is the privilege level the report must be requested from. On Azure
+	// the paravisor (HCL) runs at VMPL 0 and the guest OS below it, so only
+	// VMPL 0 reports bind the HCL runtime data the paravisor generated.
+	VMPL uint32
+
+	// ARKFingerprints are hex SHA-256 fingerprints of the SubjectPublicKeyInfo
+	// of further trusted ARKs, e.g. of products not in AMDARKFingerprints
+	ARKFingerprints []string
+
+	// CurrentTime is the time at which the certificates must be valid.
+	// Defaults to now.
+	CurrentTime time.Time
+}
+
+// Verify validates the VCEK chain to a trusted ARK, the report signature, the
+// VCEK TCB and chip ID, the VMPL and the guest policy and measurement
+func (r *SNPReport) Verify(certs SNPCertificates, opts SNPCheckOptions) error {
+	if certs.ARK == nil || certs.ASK == nil || certs.VCEK == nil {
+		return fmt.Errorf("ARK, ASK and VCEK certificates are required")
+	}
+
+	err := checkARK(certs.ARK, opts.ARKFingerprints)
+	if err != nil {
+		return err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certs.ARK)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs.ASK)
+
+	_, err = certs.VCEK.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   opts.CurrentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't verify VCEK certificate chain: %w", err)
+	}
+
+	if r.SignatureAlgo != snpSignatureAlgoP384 {
+		return fmt.Errorf("unsupported SNP report signature algorithm %d", r.SignatureAlgo)
+	}
+
+	vcekPub, ok := certs.VCEK.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("VCEK public key is not an ECDSA key")
+	}
+
+	// r and s are little-endian and zero padded to 72 bytes
+	sigR := new(big.Int).SetBytes(reversed(r.raw[0x2A0 : 0x2A0+72]))
+	sigS := new(big.Int).SetBytes(reversed(r.raw[0x2A0+72 : 0x2A0+144]))
+	digest := sha512.Sum384(r.raw[:snpSignedSize])
+	if !ecdsa.Verify(vcekPub, digest[:], sigR, sigS) {
+		return fmt.Errorf("SNP report signature verification failed")
+	}
+
+	err = r.checkVCEK(certs.VCEK)
+	if err != nil {
+		return err
+	}
+
+	if r.VMPL != opts.VMPL {
+		return fmt.Errorf("SNP report is from VMPL %d, expected VMPL %d", r.VMPL, opts.VMPL)
+	}
+
+	if r.Debug() && !opts.AllowDebug {
+		return fmt.Errorf("SNP guest policy %x allows debugging", r.Policy)
+	}
+
+	if opts.Measurement != nil && !bytes.Equal(r.Measurement, opts.Measurement) {
+		return fmt.Errorf("SNP measurement mismatch, expected %x, got %x", opts.Measurement, r.Measurement)
+	}
+
+	return nil
+}
+
+// checkARK checks that the ARK is a known AMD root key or one of the given
+// fingerprints
+func checkARK(ark *x509.Certificate, fingerprints []string) error {
+	sum := sha256.Sum256(ark.RawSubjectPublicKeyInfo)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	if _, ok := AMDARKFingerprints[fingerprint]; ok {
+		return nil
+	}
+	for _, trusted := range fingerprints {
+		if strings.EqualFold(trusted, fingerprint) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("ARK %s with key fingerprint %s isn't a trusted AMD root key", ark.Subject, fingerprint)
+}
+
+// checkVCEK checks that the VCEK was issued for the reported TCB and, unless
+// masked, the chip that produced the report
+func (r *SNPReport) checkVCEK(vcek *x509.Certificate) error {
+	spls := []struct {
+		name     string
+		oid      asn1.ObjectIdentifier
+		reported uint8
+	}{
+		{"bootloader", oidVCEKBootloaderSPL, r.ReportedTCB.Bootloader},
+		{"TEE", oidVCEKTEESPL, r.ReportedTCB.TEE},
+		{"SNP", oidVCEKSNPSPL, r.ReportedTCB.SNP},
+		{"microcode", oidVCEKMicrocodeSPL, r.ReportedTCB.Microcode},
+	}
+
+	for _, spl := range spls {
+		idx := slices.IndexFunc(vcek.Extensions, func(ext pkix.Extension) bool { return ext.Id.Equal(spl.oid) })
+		if idx == -1 {
+			return fmt.Errorf("VCEK has no %s SPL extension", spl.name)
+		}
+
+		var value int
+		_, err := asn1.Unmarshal(vcek.Extensions[idx].Value, &value)
+		if err != nil {
+			return fmt.Errorf("couldn't parse VCEK %s SPL: %w", spl.name, err)
+		}
+		if value != int(spl.reported) {
+			return fmt.Errorf("VCEK %s SPL %d doesn't match the reported TCB (%d)", spl.name, value, spl.reported)
+		}
+	}
+
+	if r.Flags&snpFlagMaskChipID != 0 {
+		return nil
+	}
+
+	idx := slices.IndexFunc(vcek.Extensions, func(ext pkix.Extension) bool { return ext.Id.Equal(oidVCEKHardwareID) })
+	if idx == -1 {
+		return fmt.Errorf("VCEK has no hardware ID extension")
+	}
+
+	hwID := vcek.Extensions[idx].Value
+	var octets []byte
+	if _, err := asn1.Unmarshal(hwID, &octets); err == nil {
+		hwID = octets
+	}
+	if !bytes.Equal(hwID, r.ChipID) {
+		return fmt.Errorf("VCEK hardware ID doesn't match the report chip ID")
+	}
+
+	return nil
+}
+
+func reversed(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The recorded report, its VCEK and the Milan ASK/ARK bundle in testdata/snp
+// are the example attestation of github.com/google/go-sev-guest (Apache 2.0),
+// from a Milan VM whose guest policy allows debugging.
+const (
+	recordedSNPMeasurement = "b07af9620f3b839b47996422ddec6058338951d984e312115131ea82705eaf5b6bdf8a9ece31a5a608eb0cf2e4872b01"
+	recordedSNPPolicy      = 0xb0000
+)
+
+func loadRecordedSNP(t *testing.T) ([]byte, SNPCertificates) {
+	t.Helper()
+
+	report, err := os.ReadFile("testdata/snp/report.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := LoadSNPCertificates("testdata/snp/milan-cert-chain.pem", "testdata/snp/vcek.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report, certs
+}
+
+func TestSNPReportVerifyRecorded(t *testing.T) {
+	data, certs := loadRecordedSNP(t)
+	measurement, _ := hex.DecodeString(recordedSNPMeasurement)
+
+	tampered := bytes.Clone(data)
+	tampered[0x50] ^= 1
+
+	tests := []struct {
+		name    string
+		report  []byte
+		opts    SNPCheckOptions
+		wantErr string
+	}{
+		{"debug policy", data, SNPCheckOptions{}, "allows debugging"},
+		{"debug allowed", data, SNPCheckOptions{AllowDebug: true}, ""},
+		{"measurement", data, SNPCheckOptions{AllowDebug: true, Measurement: measurement}, ""},
+		{"measurement mismatch", data, SNPCheckOptions{AllowDebug: true, Measurement: make([]byte, 48)}, "measurement mismatch"},
+		{"tampered report", tampered, SNPCheckOptions{AllowDebug: true}, "signature verification failed"},
+		{"expired VCEK", data, SNPCheckOptions{AllowDebug: true, CurrentTime: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}, "VCEK certificate chain"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := ParseSNPReport(test.report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Policy != recordedSNPPolicy {
+				t.Fatalf("policy = %x, want %x", report.Policy, recordedSNPPolicy)
+			}
+
+			if test.opts.CurrentTime.IsZero() {
+				test.opts.CurrentTime = testNow
+			}
+			checkError(t, report.Verify(certs, test.opts), test.wantErr)
+		})
+	}
+}
+
+func TestSNPReportVerifyPinnedARK(t *testing.T) {
+	data, certs := loadRecordedSNP(t)
+	report, err := ParseSNPReport(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A chain to a self-signed ARK that isn't AMD's fails, even if the
+	// bundle is otherwise consistent
+	fake := newTestSNPChain(t)
+	certs.ARK = fake.ark.cert
+	err = report.Verify(certs, SNPCheckOptions{AllowDebug: true, CurrentTime: testNow})
+	checkError(t, err, "isn't a trusted AMD root key")
+}
+
+// testSNPChain is a generated ARK, ASK and VCEK
+type testSNPChain struct {
+	ark, ask, vcek *testCA
+}
+
+var testSNPTCB = SNPTCB{Bootloader: 3, TEE: 0, SNP: 8, Microcode: 115}
+
+func newTestSNPChain(t *testing.T) testSNPChain {
+	t.Helper()
+
+	ark := newTestCert(t, "ARK-Test CA", 1, nil, nil)
+	ask := newTestCert(t, "SEV-Test CA", 2, ark, nil)
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testSNPChain{ark: ark, ask: ask, vcek: newTestVCEK(t, ask, key, testSNPTCB)}
+}
+
+// newTestVCEK issues a VCEK for the TCB and a fixed chip ID
+func newTestVCEK(t *testing.T, ask *testCA, key *ecdsa.PrivateKey, tcb SNPTCB) *testCA {
+	t.Helper()
+
+	spl := func(oid asn1.ObjectIdentifier, value uint8) pkix.Extension {
+		der, err := asn1.Marshal(int(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkix.Extension{Id: oid, Value: der}
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "SEV-VCEK"},
+		NotBefore:    testNow.Add(-24 * time.Hour),
+		NotAfter:     testNow.Add(365 * 24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			spl(oidVCEKBootloaderSPL, tcb.Bootloader),
+			spl(oidVCEKTEESPL, tcb.TEE),
+			spl(oidVCEKSNPSPL, tcb.SNP),
+			spl(oidVCEKMicrocodeSPL, tcb.Microcode),
+			{Id: oidVCEKHardwareID, Value: bytes.Repeat([]byte{0xc1}, 64)},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ask.cert, key.Public(), ask.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (c testSNPChain) certificates() SNPCertificates {
+	return SNPCertificates{ARK: c.ark.cert, ASK: c.ask.cert, VCEK: c.vcek.cert}
+}
+
+func (c testSNPChain) arkFingerprint() string {
+	sum := sha256.Sum256(c.ark.cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// newTestSNPReport builds a report signed by the chain's VCEK
+func newTestSNPReport(t *testing.T, chain testSNPChain, policy uint64, vmpl uint32, reportData []byte, measurement []byte) []byte {
+	t.Helper()
+
+	le := binary.LittleEndian
+	tcb := func(data []byte) {
+		data[0], data[1], data[6], data[7] = testSNPTCB.Bootloader, testSNPTCB.TEE, testSNPTCB.SNP, testSNPTCB.Microcode
+	}
+
+	report := make([]byte, snpReportSize)
+	le.PutUint32(report[0x00:], 2)
+	le.PutUint64(report[0x08:], policy)
+	le.PutUint32(report[0x30:], vmpl)
+	le.PutUint32(report[0x34:], snpSignatureAlgoP384)
+	copy(report[0x50:0x90], reportData)
+	copy(report[0x90:0xC0], measurement)
+	tcb(report[0x180:0x188])
+	copy(report[0x1A0:0x1E0], bytes.Repeat([]byte{0xc1}, 64))
+
+	digest := sha512.Sum384(report[:snpSignedSize])
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, chain.vcek.key.(*ecdsa.PrivateKey), digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// r and s are little-endian and zero padded to 72 bytes
+	sigR.FillBytes(report[0x2A0 : 0x2A0+72])
+	sigS.FillBytes(report[0x2A0+72 : 0x2A0+144])
+	copy(report[0x2A0:0x2A0+72], reversed(report[0x2A0:0x2A0+72]))
+	copy(report[0x2A0+72:0x2A0+144], reversed(report[0x2A0+72:0x2A0+144]))
+
+	return report
+}
+
+// newTestHCLRuntimeData returns HCL runtime data carrying the AK public key
+func newTestHCLRuntimeData(t *testing.T, akPub *rsa.PublicKey) []byte {
+	t.Helper()
+
+	runtimeData, err := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kid": hclAKPubKeyID,
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(akPub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(akPub.E)).Bytes()),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runtimeData
+}
+
+// newTestHCLReport wraps a hardware report and the runtime data into an HCL
+// report as read from its NV index, with trailing padding
+func newTestHCLReport(hwReport []byte, reportType uint32, runtimeData []byte) []byte {
+	le := binary.LittleEndian
+
+	header := make([]byte, hclHeaderSize)
+	copy(header, hclSignatureMagic)
+
+	dataHeader := make([]byte, hclDataHeaderSize)
+	le.PutUint32(dataHeader[8:], reportType)
+	le.PutUint32(dataHeader[12:], hclHashTypeSHA256)
+	le.PutUint32(dataHeader[16:], uint32(len(runtimeData)))
+
+	hwReport = append(bytes.Clone(hwReport), make([]byte, hclHWReportSize-len(hwReport))...)
+	report := bytes.Join([][]byte{header, hwReport, dataHeader, runtimeData}, nil)
+	return append(report, make([]byte, 256)...)
+}
+
+// verifyTestHCLSNP runs the checks of verify --snp-cert-chain-path
+func verifyTestHCLSNP(data []byte, certs SNPCertificates, akPub crypto.PublicKey, opts SNPCheckOptions) error {
+	hclReport, err := ParseHCLReport(data)
+	if err != nil {
+		return err
+	}
+	report, err := ParseSNPReport(hclReport.HWReport)
+	if err != nil {
+		return err
+	}
+	err = report.Verify(certs, opts)
+	if err != nil {
+		return err
+	}
+	err = hclReport.CheckReportData(report.ReportData)
+	if err != nil {
+		return err
+	}
+	return hclReport.CheckAKBinding(akPub)
+}
+
+func TestHCLSNPReport(t *testing.T) {
+	chain := newTestSNPChain(t)
+
+	ak, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherAK, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtimeData := newTestHCLRuntimeData(t, &ak.PublicKey)
+	runtimeDataHash := sha256.Sum256(runtimeData)
+	measurement := bytes.Repeat([]byte{0x5a}, 48)
+
+	report := newTestSNPReport(t, chain, 0x30000, 0, runtimeDataHash[:], measurement)
+	debugReport := newTestSNPReport(t, chain, 0x30000|snpPolicyDebug, 0, runtimeDataHash[:], measurement)
+	unboundReport := newTestSNPReport(t, chain, 0x30000, 0, make([]byte, 32), measurement)
+	// The guest OS runs at VMPL 2 below the paravisor, and can request
+	// reports binding runtime data of its choice
+	guestReport := newTestSNPReport(t, chain, 0x30000, 2, runtimeDataHash[:], measurement)
+
+	// Same VCEK key, issued for a newer microcode
+	otherTCB := chain
+	otherTCB.vcek = newTestVCEK(t, chain.ask, chain.vcek.key.(*ecdsa.PrivateKey),
+		SNPTCB{Bootloader: testSNPTCB.Bootloader, TEE: testSNPTCB.TEE, SNP: testSNPTCB.SNP, Microcode: testSNPTCB.Microcode + 1})
+
+	opts := SNPCheckOptions{ARKFingerprints: []string{chain.arkFingerprint()}, CurrentTime: testNow}
+
+	tests := []struct {
+		name    string
+		hcl     []byte
+		certs   SNPCertificates
+		akPub   crypto.PublicKey
+		opts    SNPCheckOptions
+		wantErr string
+	}{
+		{"bound", newTestHCLReport(report, HCLReportTypeSNP, runtimeData), chain.certificates(), &ak.PublicKey, opts, ""},
+		{"measurement", newTestHCLReport(report, HCLReportTypeSNP, runtimeData), chain.certificates(), &ak.PublicKey,
+			SNPCheckOptions{ARKFingerprints: opts.ARKFingerprints, Measurement: measurement, CurrentTime: testNow}, ""},
+		{"measurement mismatch", newTestHCLReport(report, HCLReportTypeSNP, runtimeData), chain.certificates(), &ak.PublicKey,
+			SNPCheckOptions{ARKFingerprints: opts.ARKFingerprints, Measurement: make([]byte, 48), CurrentTime: testNow}, "measurement mismatch"},
+		{"ARK not pinned", newTestHCLReport(report, HCLReportTypeSNP, runtimeData), chain.certificates(), &ak.PublicKey,
+			SNPCheckOptions{CurrentTime: testNow}, "isn't a trusted AMD root key"},
+		{"guest VMPL", newTestHCLReport(guestReport, HCLReportTypeSNP, runtimeData), chain.certificates(), &ak.PublicKey, opts, "from VMPL 2, expected VMPL 0"},
+		{"debug policy", newTestHCLReport(debugReport, HCLReportTypeSNP, runtimeData), chain.certificates(), &ak.PublicKey, opts, "allows debugging"},
+		{"VCEK of another TCB", newTestHCLReport(report, HCLReportTypeSNP, runtimeData), otherTCB.certificates(), &ak.PublicKey, opts, "doesn't match the reported TCB"},
+		{"report data doesn't bind the runtime data", newTestHCLReport(unboundReport, HCLReportTypeSNP, runtimeData), chain.certificates(), &ak.PublicKey, opts, "doesn't match the HCL runtime data hash"},
+		{"runtime data of another AK", newTestHCLReport(report, HCLReportTypeSNP, newTestHCLRuntimeData(t, &otherAK.PublicKey)), chain.certificates(), &ak.PublicKey, opts, "doesn't match the HCL runtime data hash"},
+		{"another AK", newTestHCLReport(report, HCLReportTypeSNP, runtimeData), chain.certificates(), &otherAK.PublicKey, opts, "isn't bound"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkError(t, verifyTestHCLSNP(test.hcl, test.certs, test.akPub, test.opts), test.wantErr)
+		})
+	}
+}
+
+func checkError(t *testing.T, err error, wantErr string) {
+	t.Helper()
+
+	if wantErr == "" {
+		if err != nil {
+			t.Fatalf("got %v, want nil", err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), wantErr) {
+		t.Fatalf("got %v, want error containing %q", err, wantErr)
+	}
+}
@@ -0,0 +1,488 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	tdxQuoteVersion       = 4
+	tdxAttestationKeyType = 2 // ECDSA-256-with-P-256
+	tdxTEEType            = 0x81
+
+	tdxHeaderSize    = 48
+	tdxBodySize      = 584
+	tdxQEReportSize  = 384
+	tdxSignatureSize = 64
+	tdxPublicKeySize = 64
+
+	tdxCertDataQEReport     = 6
+	tdxCertDataPCKCertChain = 5
+
+	// TD attribute bit allowing the host to debug the TD
+	tdxAttributeDebug = 1 << 0
+
+	// Enclave identity of the TD quoting enclave in Intel PCS responses
+	tdxQEIdentityID      = "TD_QE"
+	tdxQEIdentityVersion = 2
+	tdxQETCBUpToDate     = "UpToDate"
+)
+
+// TDXQuote is an Intel TDX quote, version 4, with ECDSA P-256 attestation
+type TDXQuote struct {
+	TEETCBSVN     []byte
+	MRSEAM        []byte
+	MRSignerSEAM  []byte
+	SEAMAttrs     uint64
+	TDAttributes  uint64
+	XFAM          uint64
+	MRTD          []byte
+	MRConfigID    []byte
+	MROwner       []byte
+	MROwnerConfig []byte
+	RTMRs         [4][]byte
+	ReportData    []byte
+
+	signedData        []byte
+	signature         []byte
+	attestationKey    []byte
+	qeReport          []byte
+	qeReportSignature []byte
+	qeAuthData        []byte
+	pckCertChain      []byte
+}
+
+// ParseTDXQuote parses a TDX quote v4 with QE report certification data
+func ParseTDXQuote(data []byte) (*TDXQuote, error) {
+	if len(data) < tdxHeaderSize+tdxBodySize+4 {
+		return nil, fmt.Errorf("TDX quote too short (%d bytes)", len(data))
+	}
+
+	le := binary.LittleEndian
+	if version := le.Uint16(data[0:]); version != tdxQuoteVersion {
+		return nil, fmt.Errorf("unsupported TDX quote version %d", version)
+	}
+	if keyType := le.Uint16(data[2:]); keyType != tdxAttestationKeyType {
+		return nil, fmt.Errorf("unsupported TDX attestation key type %d", keyType)
+	}
+	if teeType := le.Uint32(data[4:]); teeType != tdxTEEType {
+		return nil, fmt.Errorf("quote TEE type %x is not TDX", teeType)
+	}
+
+	body := data[tdxHeaderSize : tdxHeaderSize+tdxBodySize]
+	quote := &TDXQuote{
+		TEETCBSVN:     body[0:16],
+		MRSEAM:        body[16:64],
+		MRSignerSEAM:  body[64:112],
+		SEAMAttrs:     le.Uint64(body[112:]),
+		TDAttributes:  le.Uint64(body[120:]),
+		XFAM:          le.Uint64(body[128:]),
+		MRTD:          body[136:184],
+		MRConfigID:    body[184:232],
+		MROwner:       body[232:280],
+		MROwnerConfig: body[280:328],
+		ReportData:    body[520:584],
+		signedData:    data[:tdxHeaderSize+tdxBodySize],
+	}
+	for i := range quote.RTMRs {
+		quote.RTMRs[i] = body[328+48*i : 376+48*i]
+	}
+
+	sigData, err := readSized(data[tdxHeaderSize+tdxBodySize:], 4)
+	if err != nil {
+		return nil, fmt.Errorf("TDX quote signature data: %w", err)
+	}
+	if len(sigData) < tdxSignatureSize+tdxPublicKeySize+6 {
+		return nil, fmt.Errorf("TDX quote signature data too short")
+	}
+	quote.signature = sigData[:tdxSignatureSize]
+	quote.attestationKey = sigData[tdxSignatureSize : tdxSignatureSize+tdxPublicKeySize]
+
+	certData := sigData[tdxSignatureSize+tdxPublicKeySize:]
+	if certType := le.Uint16(certData); certType != tdxCertDataQEReport {
+		return nil, fmt.Errorf("unsupported TDX certification data type %d", certType)
+	}
+	qeCertData, err := readSized(certData[2:], 4)
+	if err != nil {
+		return nil, fmt.Errorf("TDX QE report certification data: %w", err)
+	}
+	if len(qeCertData) < tdxQEReportSize+tdxSignatureSize+2 {
+		return nil, fmt.Errorf("TDX QE report certification data too short")
+	}
+	quote.qeReport = qeCertData[:tdxQEReportSize]
+	quote.qeReportSignature = qeCertData[tdxQEReportSize : tdxQEReportSize+tdxSignatureSize]
+
+	rest := qeCertData[tdxQEReportSize+tdxSignatureSize:]
+	quote.qeAuthData, err = readSized(rest, 2)
+	if err != nil {
+		return nil, fmt.Errorf("TDX QE authentication data: %w", err)
+	}
+	rest = rest[2+len(quote.qeAuthData):]
+
+	if len(rest) < 2 {
+		return nil, fmt.Errorf("TDX quote has no PCK certification data")
+	}
+	if certType := le.Uint16(rest); certType != tdxCertDataPCKCertChain {
+		return nil, fmt.Errorf("unsupported TDX PCK certification data type %d", certType)
+	}
+	quote.pckCertChain, err = readSized(rest[2:], 4)
+	if err != nil {
+		return nil, fmt.Errorf("TDX PCK certificate chain: %w", err)
+	}
+
+	return quote, nil
+}
+
+// readSized reads a little-endian length prefix of sizeLen bytes and the data
+// following it
+func readSized(data []byte, sizeLen int) ([]byte, error) {
+	if len(data) < sizeLen {
+		return nil, fmt.Errorf("truncated")
+	}
+
+	var size int
+	if sizeLen == 2 {
+		size = int(binary.LittleEndian.Uint16(data))
+	} else {
+		size = int(binary.LittleEndian.Uint32(data))
+	}
+
+	if len(data)-sizeLen < size {
+		return nil, fmt.Errorf("truncated")
+	}
+	return data[sizeLen : sizeLen+size], nil
+}
+
+// Debug reports whether the TD attributes allow debugging the TD
+func (q *TDXQuote) Debug() bool {
+	return q.TDAttributes&tdxAttributeDebug != 0
+}
+
+// TDXQEIdentity is the identity of the TD quoting enclave (QE), as published
+// by Intel PCS at https://api.trustedservices.intel.com/tdx/certification/v4/qe/identity
+type TDXQEIdentity struct {
+	IssueDate      time.Time
+	NextUpdate     time.Time
+	MRSigner       []byte
+	ISVProdID      uint16
+	MiscSelect     []byte
+	MiscSelectMask []byte
+	Attributes     []byte
+	AttributesMask []byte
+
+	// TCBLevels are sorted by descending ISVSVN
+	TCBLevels []TDXQETCBLevel
+}
+
+// TDXQETCBLevel is the TCB status of QEs from an ISVSVN on
+type TDXQETCBLevel struct {
+	ISVSVN uint16
+	Status string
+}
+
+// LoadTDXQEIdentity reads a QE identity response of Intel PCS and verifies
+// its signature with the issuer chain, i.e. the PEM certificates of the
+// response's SGX-Enclave-Identity-Issuer-Chain header, to one of the roots
+func LoadTDXQEIdentity(path string, issuerChainPath string, roots []*x509.Certificate, currentTime time.Time) (*TDXQEIdentity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read TDX QE identity: %w", err)
+	}
+	chainBytes, err := os.ReadFile(issuerChainPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read TDX QE identity issuer chain: %w", err)
+	}
+	chain, err := ParsePEMCertificates(chainBytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse TDX QE identity issuer chain: %w", err)
+	}
+
+	var response struct {
+		EnclaveIdentity json.RawMessage `json:"enclaveIdentity"`
+		Signature       string          `json:"signature"`
+	}
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize TDX QE identity: %w", err)
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, root := range roots {
+		rootPool.AddCert(root)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediates,
+		CurrentTime:   currentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't verify TDX QE identity issuer chain: %w", err)
+	}
+
+	signingKey, ok := chain[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("TDX QE identity signing key is not an ECDSA key")
+	}
+	signature, err := hex.DecodeString(response.Signature)
+	if err != nil || len(signature) != tdxSignatureSize {
+		return nil, fmt.Errorf("malformed TDX QE identity signature")
+	}
+	if !verifyP256(signingKey, response.EnclaveIdentity, signature) {
+		return nil, fmt.Errorf("TDX QE identity signature verification failed")
+	}
+
+	return parseTDXQEIdentity(response.EnclaveIdentity)
+}
+
+func parseTDXQEIdentity(data []byte) (*TDXQEIdentity, error) {
+	var enclaveIdentity struct {
+		ID             string    `json:"id"`
+		Version        int       `json:"version"`
+		IssueDate      time.Time `json:"issueDate"`
+		NextUpdate     time.Time `json:"nextUpdate"`
+		MiscSelect     string    `json:"miscselect"`
+		MiscSelectMask string    `json:"miscselectMask"`
+		Attributes     string    `json:"attributes"`
+		AttributesMask string    `json:"attributesMask"`
+		MRSigner       string    `json:"mrsigner"`
+		ISVProdID      uint16    `json:"isvprodid"`
+		TCBLevels      []struct {
+			TCB struct {
+				ISVSVN uint16 `json:"isvsvn"`
+			} `json:"tcb"`
+			TCBStatus string `json:"tcbStatus"`
+		} `json:"tcbLevels"`
+	}
+	err := json.Unmarshal(data, &enclaveIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't deserialize TDX QE identity: %w", err)
+	}
+	if enclaveIdentity.ID != tdxQEIdentityID || enclaveIdentity.Version != tdxQEIdentityVersion {
+		return nil, fmt.Errorf("unsupported enclave identity %s version %d, expected %s version %d",
+			enclaveIdentity.ID, enclaveIdentity.Version, tdxQEIdentityID, tdxQEIdentityVersion)
+	}
+
+	identity := &TDXQEIdentity{
+		IssueDate:  enclaveIdentity.IssueDate,
+		NextUpdate: enclaveIdentity.NextUpdate,
+		ISVProdID:  enclaveIdentity.ISVProdID,
+	}
+	fields := []struct {
+		name  string
+		value string
+		size  int
+		out   *[]byte
+	}{
+		{"mrsigner", enclaveIdentity.MRSigner, 32, &identity.MRSigner},
+		{"miscselect", enclaveIdentity.MiscSelect, 4, &identity.MiscSelect},
+		{"miscselectMask", enclaveIdentity.MiscSelectMask, 4, &identity.MiscSelectMask},
+		{"attributes", enclaveIdentity.Attributes, 16, &identity.Attributes},
+		{"attributesMask", enclaveIdentity.AttributesMask, 16, &identity.AttributesMask},
+	}
+	for _, field := range fields {
+		*field.out, err = hex.DecodeString(field.value)
+		if err != nil || len(*field.out) != field.size {
+			return nil, fmt.Errorf("malformed TDX QE identity %s %q", field.name, field.value)
+		}
+	}
+
+	for _, level := range enclaveIdentity.TCBLevels {
+		identity.TCBLevels = append(identity.TCBLevels, TDXQETCBLevel{ISVSVN: level.TCB.ISVSVN, Status: level.TCBStatus})
+	}
+	sort.Slice(identity.TCBLevels, func(i, j int) bool {
+		return identity.TCBLevels[i].ISVSVN > identity.TCBLevels[j].ISVSVN
+	})
+
+	return identity, nil
+}
+
+// Check fails if the identity isn't valid at the given time, or if the QE
+// report's MRSIGNER, ISVPRODID, MISCSELECT or ATTRIBUTES don't match it, or if
+// its ISVSVN isn't at an up-to-date TCB level
+func (i *TDXQEIdentity) Check(qeReport []byte, at time.Time) error {
+	if at.Before(i.IssueDate) || at.After(i.NextUpdate) {
+		return fmt.Errorf("TDX QE identity is valid from %s to %s, not at %s",
+			i.IssueDate.Format(time.RFC3339), i.NextUpdate.Format(time.RFC3339), at.Format(time.RFC3339))
+	}
+
+	mrSigner := qeReport[128:160]
+	if !bytes.Equal(mrSigner, i.MRSigner) {
+		return fmt.Errorf("QE MRSIGNER %x doesn't match the QE identity (%x)", mrSigner, i.MRSigner)
+	}
+	isvProdID := binary.LittleEndian.Uint16(qeReport[256:])
+	if isvProdID != i.ISVProdID {
+		return fmt.Errorf("QE ISVPRODID %d doesn't match the QE identity (%d)", isvProdID, i.ISVProdID)
+	}
+	if !maskedEqual(qeReport[16:20], i.MiscSelectMask, i.MiscSelect) {
+		return fmt.Errorf("QE MISCSELECT %x doesn't match the QE identity", qeReport[16:20])
+	}
+	if !maskedEqual(qeReport[48:64], i.AttributesMask, i.Attributes) {
+		return fmt.Errorf("QE ATTRIBUTES %x don't match the QE identity", qeReport[48:64])
+	}
+
+	isvSVN := binary.LittleEndian.Uint16(qeReport[258:])
+	for _, level := range i.TCBLevels {
+		if level.ISVSVN > isvSVN {
+			continue
+		}
+		if level.Status != tdxQETCBUpToDate {
+			return fmt.Errorf("QE ISVSVN %d is at TCB level %s", isvSVN, level.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("QE ISVSVN %d is below all TCB levels of the QE identity", isvSVN)
+}
+
+func maskedEqual(value []byte, mask []byte, expected []byte) bool {
+	for i := range value {
+		if value[i]&mask[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TDXCheckOptions configures the appraisal of a TDX quote
+type TDXCheckOptions struct {
+	// Roots are the trusted Intel SGX root CAs
+	Roots []*x509.Certificate
+
+	// PCKRevocation checks the PCK certificate chain against the CRLs of the
+	// PCK CA and the root CA
+	PCKRevocation *RevocationChecker
+
+	// QEIdentity is the expected identity of the quoting enclave
+	QEIdentity *TDXQEIdentity
+
+	// MRTD is the expected build-time measurement of the TD, if set
+	MRTD []byte
+
+	// RTMRs are the expected runtime measurement registers, by index
+	RTMRs map[int][]byte
+
+	// AllowDebug accepts quotes of TDs whose attributes allow debugging
+	AllowDebug bool
+
+	// CurrentTime is the time at which the PCK chain must be valid. Defaults
+	// to now.
+	CurrentTime time.Time
+}
+
+// Verify validates the PCK chain and its revocation status, the QE report
+// signed by the PCK and the QE identity, the attestation key certified by the
+// QE report, the quote signature and the TD attributes and measurements. It
+// doesn't evaluate the TD's TCB level against Intel's TCB info.
+func (q *TDXQuote) Verify(opts TDXCheckOptions) error {
+	if opts.PCKRevocation == nil || opts.QEIdentity == nil {
+		return fmt.Errorf("PCK revocation checks and the QE identity are required")
+	}
+	currentTime := opts.CurrentTime
+	if currentTime.IsZero() {
+		currentTime = time.Now()
+	}
+
+	pckChain, err := ParsePEMCertificates(bytes.TrimRight(q.pckCertChain, "\x00"))
+	if err != nil {
+		return fmt.Errorf("couldn't parse PCK certificate chain: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	for _, root := range opts.Roots {
+		roots.AddCert(root)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range pckChain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	pckCert := pckChain[0]
+	chains, err := pckCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   currentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't verify PCK certificate chain: %w", err)
+	}
+
+	err = opts.PCKRevocation.CheckChain(chains[0])
+	if err != nil {
+		return fmt.Errorf("PCK certificate revocation check failed: %w", err)
+	}
+
+	pckPub, ok := pckCert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("PCK public key is not an ECDSA key")
+	}
+	if !verifyP256(pckPub, q.qeReport, q.qeReportSignature) {
+		return fmt.Errorf("QE report signature verification failed")
+	}
+
+	err = opts.QEIdentity.Check(q.qeReport, currentTime)
+	if err != nil {
+		return err
+	}
+
+	// The QE report data binds the attestation key and the QE authentication
+	// data
+	binding := sha256.Sum256(append(append([]byte{}, q.attestationKey...), q.qeAuthData...))
+	qeReportData := q.qeReport[320:384]
+	expected := make([]byte, len(qeReportData))
+	copy(expected, binding[:])
+	if !bytes.Equal(qeReportData, expected) {
+		return fmt.Errorf("QE report doesn't certify the attestation key")
+	}
+
+	attestationKey := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(q.attestationKey[:32]),
+		Y:     new(big.Int).SetBytes(q.attestationKey[32:]),
+	}
+	if !verifyP256(attestationKey, q.signedData, q.signature) {
+		return fmt.Errorf("TDX quote signature verification failed")
+	}
+
+	if q.Debug() && !opts.AllowDebug {
+		return fmt.Errorf("TD attributes %x allow debugging", q.TDAttributes)
+	}
+
+	if opts.MRTD != nil && !bytes.Equal(q.MRTD, opts.MRTD) {
+		return fmt.Errorf("MRTD mismatch, expected %x, got %x", opts.MRTD, q.MRTD)
+	}
+
+	for index, expected := range opts.RTMRs {
+		if index < 0 || index >= len(q.RTMRs) {
+			return fmt.Errorf("invalid RTMR index %d", index)
+		}
+		if !bytes.Equal(q.RTMRs[index], expected) {
+			return fmt.Errorf("RTMR%d mismatch, expected %x, got %x", index, expected, q.RTMRs[index])
+		}
+	}
+
+	return nil
+}
+
+// verifyP256 checks a raw r || s ECDSA P-256 signature over SHA-256 of data
+func verifyP256(pub *ecdsa.PublicKey, data []byte, signature []byte) bool {
+	digest := sha256.Sum256(data)
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:64])
+	return ecdsa.Verify(pub, digest[:], r, s)
+}
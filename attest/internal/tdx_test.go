@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The recorded quote from a Sapphire Rapids TD and the Intel PCS collateral in
+// testdata/tdx (PCK platform CA and root CA CRLs, the QE identity and its
+// issuer chain) are the test data of github.com/google/go-tdx-guest
+// (Apache 2.0). The CRLs and the QE identity are all valid in June 2023.
+const recordedTDXMRTD = "6363b8043668a3ad953278e10389574d326c6749fb78aa810ecd9336923db86f22fc00b8dcd404bc10d5e119d7215cbb"
+
+var tdxTestNow = time.Date(2023, 6, 20, 0, 0, 0, 0, time.UTC)
+
+func loadRecordedTDX(t *testing.T) ([]byte, TDXCheckOptions) {
+	t.Helper()
+
+	quote, err := os.ReadFile("testdata/tdx/quote.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := LoadTrustStore([]string{"testdata/tdx/sgx-root-ca.pem"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crls, err := LoadCRLs([]string{"testdata/tdx/pck-platform-ca.crl", "testdata/tdx/sgx-root-ca.crl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qeIdentity, err := LoadTDXQEIdentity("testdata/tdx/qe-identity.json", "testdata/tdx/qe-identity-issuer-chain.pem", roots.Roots, tdxTestNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return quote, TDXCheckOptions{
+		Roots:         roots.Roots,
+		PCKRevocation: &RevocationChecker{CRLs: crls, Offline: true, CurrentTime: tdxTestNow},
+		QEIdentity:    qeIdentity,
+		CurrentTime:   tdxTestNow,
+	}
+}
+
+func TestTDXQuoteVerifyRecorded(t *testing.T) {
+	data, defaults := loadRecordedTDX(t)
+	mrtd, _ := hex.DecodeString(recordedTDXMRTD)
+
+	tampered := bytes.Clone(data)
+	tampered[tdxHeaderSize+520] ^= 1
+
+	qeIdentity := func(modify func(*TDXQEIdentity)) *TDXQEIdentity {
+		identity := *defaults.QEIdentity
+		identity.TCBLevels = append([]TDXQETCBLevel(nil), identity.TCBLevels...)
+		modify(&identity)
+		return &identity
+	}
+	staleCRLs := *defaults.PCKRevocation
+	staleCRLs.CurrentTime = time.Date(2023, 7, 9, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		quote   []byte
+		modify  func(*TDXCheckOptions)
+		wantErr string
+	}{
+		{"verified", data, func(*TDXCheckOptions) {}, ""},
+		{"MRTD", data, func(o *TDXCheckOptions) { o.MRTD = mrtd }, ""},
+		{"MRTD mismatch", data, func(o *TDXCheckOptions) { o.MRTD = make([]byte, 48) }, "MRTD mismatch"},
+		{"RTMR mismatch", data, func(o *TDXCheckOptions) { o.RTMRs = map[int][]byte{2: make([]byte, 48)} }, "RTMR2 mismatch"},
+		{"tampered quote", tampered, func(*TDXCheckOptions) {}, "quote signature verification failed"},
+		{"no collateral", data, func(o *TDXCheckOptions) { o.QEIdentity = nil }, "are required"},
+		{"no PCK CRL", data, func(o *TDXCheckOptions) {
+			o.PCKRevocation = &RevocationChecker{Offline: true, CurrentTime: tdxTestNow}
+		}, "not available offline"},
+		{"stale PCK CRL", data, func(o *TDXCheckOptions) { o.PCKRevocation = &staleCRLs }, "expired"},
+		{"other MRSIGNER", data, func(o *TDXCheckOptions) {
+			o.QEIdentity = qeIdentity(func(i *TDXQEIdentity) { i.MRSigner = make([]byte, 32) })
+		}, "MRSIGNER"},
+		{"other ISVPRODID", data, func(o *TDXCheckOptions) {
+			o.QEIdentity = qeIdentity(func(i *TDXQEIdentity) { i.ISVProdID = 1 })
+		}, "ISVPRODID"},
+		{"other ATTRIBUTES", data, func(o *TDXCheckOptions) {
+			o.QEIdentity = qeIdentity(func(i *TDXQEIdentity) { i.Attributes = make([]byte, 16) })
+		}, "ATTRIBUTES"},
+		{"out-of-date ISVSVN", data, func(o *TDXCheckOptions) {
+			o.QEIdentity = qeIdentity(func(i *TDXQEIdentity) {
+				i.TCBLevels = []TDXQETCBLevel{{ISVSVN: 5, Status: "UpToDate"}, {ISVSVN: 4, Status: "OutOfDate"}}
+			})
+		}, "TCB level OutOfDate"},
+		{"ISVSVN below all levels", data, func(o *TDXCheckOptions) {
+			o.QEIdentity = qeIdentity(func(i *TDXQEIdentity) { i.TCBLevels = []TDXQETCBLevel{{ISVSVN: 8, Status: "UpToDate"}} })
+		}, "below all TCB levels"},
+		{"stale QE identity", data, func(o *TDXCheckOptions) {
+			o.QEIdentity = qeIdentity(func(i *TDXQEIdentity) { i.NextUpdate = tdxTestNow.Add(-time.Hour) })
+		}, "QE identity is valid from"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			quote, err := ParseTDXQuote(test.quote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quote.Debug() {
+				t.Fatalf("recorded TD attributes %x allow debugging", quote.TDAttributes)
+			}
+
+			opts := defaults
+			test.modify(&opts)
+			checkError(t, quote.Verify(opts), test.wantErr)
+		})
+	}
+}
+
+func TestLoadTDXQEIdentity(t *testing.T) {
+	roots, err := LoadTrustStore([]string{"testdata/tdx/sgx-root-ca.pem"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chain = "testdata/tdx/qe-identity-issuer-chain.pem"
+
+	identity, err := LoadTDXQEIdentity("testdata/tdx/qe-identity.json", chain, roots.Roots, tdxTestNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(identity.MRSigner) != "dc9e2a7c6f948f17474e34a7fc43ed030f7c1563f1babddf6340c82e0e54a8c5" || identity.ISVProdID != 2 {
+		t.Fatalf("QE identity MRSIGNER %x ISVPRODID %d, want Intel's TD QE", identity.MRSigner, identity.ISVProdID)
+	}
+
+	response, err := os.ReadFile("testdata/tdx/qe-identity.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedPath := filepath.Join(t.TempDir(), "qe-identity.json")
+	err = os.WriteFile(tamperedPath, bytes.Replace(response, []byte(`"isvsvn":4`), []byte(`"isvsvn":3`), 1), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherRoot := newTestCert(t, "Root CA", 1, nil, nil)
+
+	tests := []struct {
+		name    string
+		path    string
+		roots   TrustStore
+		at      time.Time
+		wantErr string
+	}{
+		{"tampered", tamperedPath, *roots, tdxTestNow, "signature verification failed"},
+		{"untrusted issuer", "testdata/tdx/qe-identity.json", TrustStore{Roots: []*x509.Certificate{otherRoot.cert}}, tdxTestNow, "issuer chain"},
+		{"expired issuer", "testdata/tdx/qe-identity.json", *roots, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), "issuer chain"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadTDXQEIdentity(test.path, chain, test.roots.Roots, test.at)
+			checkError(t, err, test.wantErr)
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OIDTCGKpAIKCertificate is the TCG extended key usage for attestation key
+// certificates (tcg-kp-AIKCertificate)
+var OIDTCGKpAIKCertificate = asn1.ObjectIdentifier{2, 23, 133, 8, 3}
+
+// TrustStore holds the root and intermediate CA certificates used to build
+// the certificate chain of an AK certificate
+type TrustStore struct {
+	Roots         []*x509.Certificate
+	Intermediates []*x509.Certificate
+}
+
+// AKCertOptions configures the checks applied to an AK certificate on top of
+// the chain validation
+type AKCertOptions struct {
+	// CurrentTime is the time at which the chain must be valid. If zero, the
+	// current system time is used.
+	CurrentTime time.Time
+
+	// RequiredEKUs must all be present in the AK certificate's extended key
+	// usages
+	RequiredEKUs []asn1.ObjectIdentifier
+}
+
+// LoadTrustStore reads PEM-encoded roots and intermediates. Each path may be a
+// single certificate, a bundle of concatenated certificates, or a directory of
+// .pem/.crt files. Empty paths are ignored.
+func LoadTrustStore(rootPaths []string, intermediatePaths []string) (*TrustStore, error) {
+	store := &TrustStore{}
+
+	for _, path := range rootPaths {
+		if path == "" {
+			continue
+		}
+		certs, err := loadCertificates(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load root CA %s: %w", path, err)
+		}
+		store.Roots = append(store.Roots, certs...)
+	}
+
+	for _, path := range intermediatePaths {
+		if path == "" {
+			continue
+		}
+		certs, err := loadCertificates(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load intermediate CA %s: %w", path, err)
+		}
+		store.Intermediates = append(store.Intermediates, certs...)
+	}
+
+	if len(store.Roots) == 0 {
+		return nil, fmt.Errorf("trust store has no root CAs")
+	}
+
+	return store, nil
+}
+
+func loadCertificates(path string) ([]*x509.Certificate, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return ParsePEMCertificates(data)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		fileCerts, err := ParsePEMCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		certs = append(certs, fileCerts...)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in directory")
+	}
+
+	return certs, nil
+}
+
+// ParsePEMCertificates parses every CERTIFICATE block in the input. Anything
+// that isn't a PEM certificate is reported as an error rather than skipped.
+func ParsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	rest := data
+	for len(strings.TrimSpace(string(rest))) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("malformed PEM data after %d certificate(s)", len(certs))
+		}
+
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse certificate %d: %w", len(certs)+1, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificates found")
+	}
+
+	return certs, nil
+}
+
+// ParsePEMPrivateKey parses a PKCS #8, PKCS #1 or SEC 1 private key
+func ParsePEMPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("malformed PEM data")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse private key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key type %T can't sign", key)
+	}
+
+	return signer, nil
+}
+
+// VerifyAKCert builds and validates the chain from the AK certificate to one
+// of the trusted roots, and checks that the leaf is fit for use as an AK
+func (t *TrustStore) VerifyAKCert(akCert *x509.Certificate, opts AKCertOptions) ([][]*x509.Certificate, error) {
+	currentTime := opts.CurrentTime
+	if currentTime.IsZero() {
+		currentTime = time.Now()
+	}
+
+	if currentTime.Before(akCert.NotBefore) || currentTime.After(akCert.NotAfter) {
+		return nil, fmt.Errorf("AK certificate is not valid at %s (valid from %s to %s)",
+			currentTime.Format(time.RFC3339), akCert.NotBefore.Format(time.RFC3339), akCert.NotAfter.Format(time.RFC3339))
+	}
+
+	if akCert.KeyUsage != 0 && akCert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return nil, fmt.Errorf("AK certificate key usage doesn't allow digital signatures")
+	}
+
+	for _, eku := range opts.RequiredEKUs {
+		if !hasEKU(akCert, eku) {
+			return nil, fmt.Errorf("AK certificate is missing extended key usage %s", eku)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	for _, root := range t.Roots {
+		roots.AddCert(root)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range t.Intermediates {
+		intermediates.AddCert(intermediate)
+	}
+
+	// vTPM CA certificates carry TCG-specific EKUs that the x509 package
+	// doesn't know about, so the EKUs are checked above instead
+	chains, err := akCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   currentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't build a valid chain: %w", err)
+	}
+
+	return chains, nil
+}
+
+// extKeyUsageOIDs are the EKUs the x509 package parses into ExtKeyUsage
+// instead of UnknownExtKeyUsage
+var extKeyUsageOIDs = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageAny:                            {2, 5, 29, 37, 0},
+	x509.ExtKeyUsageServerAuth:                     {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	x509.ExtKeyUsageClientAuth:                     {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	x509.ExtKeyUsageCodeSigning:                    {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	x509.ExtKeyUsageEmailProtection:                {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	x509.ExtKeyUsageIPSECEndSystem:                 {1, 3, 6, 1, 5, 5, 7, 3, 5},
+	x509.ExtKeyUsageIPSECTunnel:                    {1, 3, 6, 1, 5, 5, 7, 3, 6},
+	x509.ExtKeyUsageIPSECUser:                      {1, 3, 6, 1, 5, 5, 7, 3, 7},
+	x509.ExtKeyUsageTimeStamping:                   {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	x509.ExtKeyUsageOCSPSigning:                    {1, 3, 6, 1, 5, 5, 7, 3, 9},
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     {1, 3, 6, 1, 4, 1, 311, 10, 3, 3},
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      {2, 16, 840, 1, 113730, 4, 1},
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: {1, 3, 6, 1, 4, 1, 311, 2, 1, 22},
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     {1, 3, 6, 1, 4, 1, 311, 61, 1, 1},
+}
+
+// hasEKU checks both the EKUs the x509 package knows and the unknown ones
+func hasEKU(cert *x509.Certificate, eku asn1.ObjectIdentifier) bool {
+	for _, known := range cert.ExtKeyUsage {
+		if oid, ok := extKeyUsageOIDs[known]; ok && oid.Equal(eku) {
+			return true
+		}
+	}
+	for _, unknown := range cert.UnknownExtKeyUsage {
+		if unknown.Equal(eku) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseOID parses a dotted-decimal object identifier such as 2.23.133.8.3
+func ParseOID(s string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, n)
+	}
+
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+
+	return oid, nil
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+func TestHasEKU(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		Subject:            pkix.Name{CommonName: "AK"},
+		NotBefore:          testNow,
+		NotAfter:           testNow.AddDate(1, 0, 0),
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{{2, 23, 133, 8, 3}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		oid  string
+		want bool
+	}{
+		{"2.23.133.8.3", true},      // TCG AK certificate, unknown to the x509 package
+		{"1.3.6.1.5.5.7.3.2", true}, // client authentication, parsed as ExtKeyUsage
+		{"1.3.6.1.5.5.7.3.1", false},
+		{"2.23.133.8.1", false},
+	}
+
+	for _, test := range tests {
+		oid, err := ParseOID(test.oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hasEKU(cert, oid); got != test.want {
+			t.Errorf("hasEKU(%s) = %v, want %v", test.oid, got, test.want)
+		}
+	}
+}
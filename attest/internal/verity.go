@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// veritySuperblock is the superblock veritysetup format writes at the start of
+// the hash device
+type veritySuperblock struct {
+	Signature     [8]byte // "verity\0\0"
+	Version       uint32
+	HashType      uint32 // 0 for Chrome OS, 1 for normal
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	_             [6]byte
+	Salt          [256]byte
+	_             [168]byte
+}
+
+// ReadVerityRootHash returns the dm-verity root hash from either the root
+// hash file written by veritysetup format --root-hash-file, or from the hash
+// device itself. Only SHA-256 hash trees with a superblock are supported.
+func ReadVerityRootHash(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read verity file: %w", err)
+	}
+	defer file.Close()
+
+	// A root hash file is the hex root hash, optionally followed by a newline
+	head := make([]byte, 2*sha256.Size+2)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("couldn't read verity file: %w", err)
+	}
+	if rootHash, err := hex.DecodeString(string(bytes.TrimSpace(head[:n]))); err == nil && len(rootHash) == sha256.Size {
+		return rootHash, nil
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read verity file: %w", err)
+	}
+
+	var sb veritySuperblock
+	err = binary.Read(file, binary.LittleEndian, &sb)
+	if err != nil || string(sb.Signature[:]) != "verity\x00\x00" {
+		return nil, fmt.Errorf("%s is neither a verity root hash file nor a verity hash device with a superblock", path)
+	}
+
+	algorithm := string(bytes.TrimRight(sb.Algorithm[:], "\x00"))
+	if algorithm != "sha256" {
+		return nil, fmt.Errorf("unsupported verity hash algorithm %s", algorithm)
+	}
+	if sb.HashType > 1 || sb.SaltSize > uint16(len(sb.Salt)) || sb.HashBlockSize < sha256.Size || sb.HashBlockSize%512 != 0 {
+		return nil, fmt.Errorf("unsupported verity superblock")
+	}
+	if sb.DataBlocks < 2 {
+		return nil, fmt.Errorf("verity hash tree of %d data blocks has no hash levels", sb.DataBlocks)
+	}
+
+	// The hash levels follow the superblock's block, top level first. The
+	// top level is a single block, whose salted hash is the root hash.
+	top := make([]byte, sb.HashBlockSize)
+	_, err = file.ReadAt(top, int64(sb.HashBlockSize))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read verity hash tree: %w", err)
+	}
+
+	salt := sb.Salt[:sb.SaltSize]
+	hasher := sha256.New()
+	if sb.HashType == 1 {
+		hasher.Write(salt)
+		hasher.Write(top)
+	} else {
+		hasher.Write(top)
+		hasher.Write(salt)
+	}
+	return hasher.Sum(nil), nil
+}